@@ -0,0 +1,93 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/eth/tracers/native"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/urfave/cli/v2"
+)
+
+var commandExplain = &cli.Command{
+	Name:      "explain",
+	Usage:     "explain the shield decision of every SSTORE of a transaction",
+	ArgsUsage: "<txHash>",
+	Description: `
+Replays a historical transaction on the node with the shield in audit mode and
+prints, for every storage write, the function called, the shield variable that
+governs the slot and whether the write was allowed or would have been blocked.`,
+	Flags: []cli.Flag{
+		rpcFlag,
+	},
+	Action: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return fmt.Errorf("expected a single transaction hash")
+		}
+		hash := common.HexToHash(ctx.Args().First())
+
+		client, err := rpc.DialContext(ctx.Context, ctx.String(rpcFlag.Name))
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		stores, err := traceShield(ctx.Context, client, hash)
+		if err != nil {
+			return err
+		}
+		explain(ctx.App.Writer, hash, stores)
+		return nil
+	},
+}
+
+// traceShield replays the transaction through the node's shieldTracer.
+func traceShield(ctx context.Context, client *rpc.Client, hash common.Hash) ([]native.ShieldStore, error) {
+	var stores []native.ShieldStore
+	config := map[string]interface{}{"tracer": "shieldTracer"}
+	if err := client.CallContext(ctx, &stores, "debug_traceTransaction", hash, config); err != nil {
+		return nil, err
+	}
+	return stores, nil
+}
+
+// explain renders the shield decisions in a human readable form.
+func explain(w io.Writer, hash common.Hash, stores []native.ShieldStore) {
+	fmt.Fprintf(w, "Transaction %v: %d storage writes\n", hash, len(stores))
+	for i, s := range stores {
+		function := s.Function
+		if function == "" {
+			function = "<no rule>"
+		}
+		fmt.Fprintf(w, "\n#%d %v function %s\n", i, s.Contract, function)
+		fmt.Fprintf(w, "   slot  %s\n   value %s\n", s.Slot, s.Value)
+		switch {
+		case s.Allowed:
+			fmt.Fprintf(w, "   allowed: no shield variable covers the slot\n")
+		case s.Variable < 0:
+			fmt.Fprintf(w, "   would be blocked by a function-level rule\n")
+		case s.VariableName != "":
+			fmt.Fprintf(w, "   would be blocked by FunctionShield[%d] (%s)\n", s.Variable, s.VariableName)
+		default:
+			fmt.Fprintf(w, "   would be blocked by FunctionShield[%d]\n", s.Variable)
+		}
+	}
+}
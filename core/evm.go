@@ -74,6 +74,8 @@ func NewEVMTxContext(msg Message) vm.TxContext {
 	return vm.TxContext{
 		Origin:   msg.From(),
 		GasPrice: new(big.Int).Set(msg.GasPrice()),
+
+		AccessList: msg.AccessList(),
 	}
 }
 
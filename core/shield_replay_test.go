@@ -0,0 +1,197 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"context"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// The mainnet replay is driven by the environment, as it needs an archive node
+// with the debug namespace enabled:
+//
+//	EVMSHIELD_REPLAY_RPC    endpoint of the archive node (required)
+//	EVMSHIELD_REPLAY_BLOCKS comma separated block numbers to replay
+//	EVMSHIELD_REPLAY_RULE   rule file loaded by the shielded run (required), it
+//	                        must report at least one violation in the blocks
+const defaultReplayBlocks = "15537394,15537395,15537396"
+
+// replayAccount is an account of the prestateTracer output.
+type replayAccount struct {
+	Balance *hexutil.Big                `json:"balance"`
+	Nonce   uint64                      `json:"nonce"`
+	Code    hexutil.Bytes               `json:"code"`
+	Storage map[common.Hash]common.Hash `json:"storage"`
+}
+
+// replayChain serves the headers needed by BLOCKHASH from the archive node.
+type replayChain struct {
+	client *ethclient.Client
+	engine consensus.Engine
+}
+
+func (c *replayChain) Engine() consensus.Engine { return c.engine }
+
+func (c *replayChain) GetHeader(hash common.Hash, number uint64) *types.Header {
+	header, _ := c.client.HeaderByHash(context.Background(), hash)
+	return header
+}
+
+// TestMainnetReplay replays historical mainnet blocks twice, once without rules
+// and once with the shield in audit mode, and checks that both runs end in the
+// same state. Audit mode must only report, so any divergence means the shield
+// modifies execution. The rules must fire at least once, otherwise the runs
+// are trivially identical.
+func TestMainnetReplay(t *testing.T) {
+	endpoint := os.Getenv("EVMSHIELD_REPLAY_RPC")
+	if endpoint == "" {
+		t.Skip("EVMSHIELD_REPLAY_RPC not set")
+	}
+	rule, err := os.ReadFile(os.Getenv("EVMSHIELD_REPLAY_RULE"))
+	if err != nil {
+		t.Fatalf("failed to read EVMSHIELD_REPLAY_RULE: %v", err)
+	}
+	client, err := rpc.Dial(endpoint)
+	if err != nil {
+		t.Fatalf("failed to dial %s: %v", endpoint, err)
+	}
+	defer client.Close()
+	chain := &replayChain{client: ethclient.NewClient(client), engine: ethash.NewFaker()}
+
+	// The plain run loads an empty rule set, so no rule file lying around in the
+	// working directory can shield it. The audited run works on a copy of the
+	// configured rules, as shielded calls write their rules back.
+	plainRule, auditRule := filepath.Join(t.TempDir(), "rule.json"), filepath.Join(t.TempDir(), "rule.json")
+	if err := os.WriteFile(plainRule, []byte("[]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(auditRule, rule, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var violations int
+	auditCfg := vm.Config{
+		ShieldMode:      vm.ShieldModeAudit,
+		ShieldEventHook: func(vm.ShieldViolation) { violations++ },
+	}
+	blocks := os.Getenv("EVMSHIELD_REPLAY_BLOCKS")
+	if blocks == "" {
+		blocks = defaultReplayBlocks
+	}
+	for _, field := range strings.Split(blocks, ",") {
+		number, err := strconv.ParseUint(strings.TrimSpace(field), 10, 64)
+		if err != nil {
+			t.Fatalf("invalid block number %q", field)
+		}
+		block, err := chain.client.BlockByNumber(context.Background(), new(big.Int).SetUint64(number))
+		if err != nil {
+			t.Fatalf("failed to download block %d: %v", number, err)
+		}
+		pre, err := downloadPrestate(client, number)
+		if err != nil {
+			t.Fatalf("failed to download prestate of block %d: %v", number, err)
+		}
+		plain := replayBlock(t, chain, block, pre, plainRule, vm.Config{})
+		audited := replayBlock(t, chain, block, pre, auditRule, auditCfg)
+		if plain != audited {
+			t.Errorf("block %d: state root diverged in audit mode: have %x, want %x", number, audited, plain)
+		}
+	}
+	if violations == 0 {
+		t.Error("no shield rule fired, the rule file does not exercise the replayed blocks")
+	}
+}
+
+// downloadPrestate returns every account and slot touched by the block, as it
+// was before the block. Each transaction's prestate is taken before that
+// transaction, so only the first sighting of an account or slot is kept.
+func downloadPrestate(client *rpc.Client, number uint64) (map[common.Address]*replayAccount, error) {
+	var results []struct {
+		Result map[common.Address]*replayAccount `json:"result"`
+	}
+	config := map[string]interface{}{"tracer": "prestateTracer"}
+	if err := client.CallContext(context.Background(), &results, "debug_traceBlockByNumber", hexutil.Uint64(number), config); err != nil {
+		return nil, err
+	}
+	pre := make(map[common.Address]*replayAccount)
+	for _, result := range results {
+		for addr, account := range result.Result {
+			known, ok := pre[addr]
+			if !ok {
+				pre[addr] = account
+				continue
+			}
+			for key, value := range account.Storage {
+				if _, ok := known.Storage[key]; !ok {
+					if known.Storage == nil {
+						known.Storage = make(map[common.Hash]common.Hash)
+					}
+					known.Storage[key] = value
+				}
+			}
+		}
+	}
+	return pre, nil
+}
+
+// replayBlock applies the transactions of block on top of pre with the rules of
+// ruleFile and returns the resulting state root. Block rewards are left out as
+// they do not depend on the shield.
+func replayBlock(t *testing.T, chain *replayChain, block *types.Block, pre map[common.Address]*replayAccount, ruleFile string, cfg vm.Config) common.Hash {
+	t.Setenv("EVM_SHIELD_RULE_PATH", ruleFile)
+
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	for addr, account := range pre {
+		if account.Balance != nil {
+			statedb.SetBalance(addr, account.Balance.ToInt())
+		}
+		statedb.SetNonce(addr, account.Nonce)
+		statedb.SetCode(addr, account.Code)
+		for key, value := range account.Storage {
+			statedb.SetState(addr, key, value)
+		}
+	}
+	statedb.Finalise(true)
+
+	var (
+		gp      = new(GasPool).AddGas(block.GasLimit())
+		usedGas uint64
+	)
+	for i, tx := range block.Transactions() {
+		statedb.Prepare(tx.Hash(), i)
+		if _, err := ApplyTransaction(params.MainnetChainConfig, chain, nil, gp, statedb, block.Header(), tx, &usedGas, cfg); err != nil {
+			t.Fatalf("block %d tx %d: %v", block.NumberU64(), i, err)
+		}
+	}
+	return statedb.IntermediateRoot(true)
+}
@@ -0,0 +1,109 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+// SimulationResult is the predicted shield outcome of a transaction.
+type SimulationResult struct {
+	Decisions  []vm.ShieldDecision `json:"decisions"`  // Shield decision of every SSTORE, in execution order
+	Blocked    int                 `json:"blocked"`    // Number of writes enforcement would drop
+	UsedGas    uint64              `json:"usedGas"`    // Gas used with every write let through
+	Failed     bool                `json:"failed"`     // Whether execution failed or reverted
+	ReturnData hexutil.Bytes       `json:"returnData"` // Return data of the top call frame
+}
+
+// SimulateTransaction executes tx in the context of block on top of statedb with
+// the shield in audit mode, and returns the shield decisions it triggered. All
+// state changes are reverted before returning.
+//
+// As every write is let through, decisions following a blocked write describe
+// the execution path the transaction takes when it is not shielded.
+func (p *StateProcessor) SimulateTransaction(tx *types.Transaction, block *types.Block, statedb vm.StateDB, registry *vm.RuleRegistry) (*SimulationResult, error) {
+	header := block.Header()
+	msg, err := tx.AsMessage(types.MakeSigner(p.config, header.Number), header.BaseFee)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		recorder = new(shieldRecorder)
+		cfg      = vm.Config{
+			Debug:          true,
+			Tracer:         recorder,
+			ShieldMode:     vm.ShieldModeAudit,
+			ShieldRegistry: registry,
+		}
+		vmenv = vm.NewEVM(NewEVMBlockContext(header, p.bc, nil), NewEVMTxContext(msg), statedb, p.config, cfg)
+	)
+	snapshot := statedb.Snapshot()
+	defer statedb.RevertToSnapshot(snapshot)
+
+	res, err := ApplyMessage(vmenv, msg, new(GasPool).AddGas(header.GasLimit))
+	if err != nil {
+		return nil, err
+	}
+	result := &SimulationResult{
+		Decisions:  recorder.decisions,
+		UsedGas:    res.UsedGas,
+		Failed:     res.Failed(),
+		ReturnData: res.Return(),
+	}
+	for _, decision := range recorder.decisions {
+		if !decision.Allowed {
+			result.Blocked++
+		}
+	}
+	return result, nil
+}
+
+// shieldRecorder is a vm.ShieldLogger collecting shield decisions and ignoring
+// every other tracing event.
+type shieldRecorder struct {
+	decisions []vm.ShieldDecision
+}
+
+func (r *shieldRecorder) CaptureShield(decision vm.ShieldDecision) {
+	r.decisions = append(r.decisions, decision)
+}
+
+func (r *shieldRecorder) CaptureTxStart(gasLimit uint64) {}
+
+func (r *shieldRecorder) CaptureTxEnd(restGas uint64) {}
+
+func (r *shieldRecorder) CaptureStart(env *vm.EVM, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) {
+}
+
+func (r *shieldRecorder) CaptureEnd(output []byte, gasUsed uint64, t time.Duration, err error) {}
+
+func (r *shieldRecorder) CaptureEnter(typ vm.OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) {
+}
+
+func (r *shieldRecorder) CaptureExit(output []byte, gasUsed uint64, err error) {}
+
+func (r *shieldRecorder) CaptureState(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, rData []byte, depth int, err error) {
+}
+
+func (r *shieldRecorder) CaptureFault(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, depth int, err error) {
+}
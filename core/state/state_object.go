@@ -361,6 +361,36 @@ func (s *stateObject) updateTrie(db Database) Trie {
 	return tr
 }
 
+// postStorageRoot returns the storage root the object would have after its
+// pending and dirty slots were written, working on a copy of the storage trie.
+func (s *stateObject) postStorageRoot(db Database) common.Hash {
+	if len(s.pendingStorage) == 0 && len(s.dirtyStorage) == 0 {
+		return s.data.Root
+	}
+	var tr Trie
+	if s.trie != nil {
+		tr = db.CopyTrie(s.trie)
+	} else {
+		var err error
+		if tr, err = db.OpenStorageTrie(s.db.originalRoot, s.addrHash, s.data.Root); err != nil {
+			s.setError(fmt.Errorf("can't create storage trie: %v", err))
+			return s.data.Root
+		}
+	}
+	for _, storage := range []Storage{s.pendingStorage, s.dirtyStorage} {
+		for key, value := range storage {
+			if (value == common.Hash{}) {
+				s.setError(tr.TryDelete(key[:]))
+			} else {
+				// Encoding []byte cannot fail, ok to ignore the error.
+				v, _ := rlp.EncodeToBytes(common.TrimLeftZeroes(value[:]))
+				s.setError(tr.TryUpdate(key[:], v))
+			}
+		}
+	}
+	return tr.Hash()
+}
+
 // UpdateRoot sets the trie root to the current root hash of
 func (s *stateObject) updateRoot(db Database) {
 	// If nothing changed, don't bother with hashing anything
@@ -180,6 +180,24 @@ func (s *StateDB) StopPrefetcher() {
 	}
 }
 
+// PrefetchStorage schedules the given storage slots of addr for background
+// loading by the trie prefetcher, so that subsequent reads hit a warm trie.
+// It is a noop if no prefetcher is running.
+func (s *StateDB) PrefetchStorage(addr common.Address, slots []common.Hash) {
+	if s.prefetcher == nil || len(slots) == 0 {
+		return
+	}
+	obj := s.getStateObject(addr)
+	if obj == nil || obj.data.Root == emptyRoot {
+		return
+	}
+	keys := make([][]byte, len(slots))
+	for i := range slots {
+		keys[i] = common.CopyBytes(slots[i][:])
+	}
+	s.prefetcher.prefetch(obj.addrHash, obj.data.Root, keys)
+}
+
 // setError remembers the first non-nil error it is called with.
 func (s *StateDB) setError(err error) {
 	if s.dbErr == nil {
@@ -880,6 +898,39 @@ func (s *StateDB) IntermediateRoot(deleteEmptyObjects bool) common.Hash {
 	return s.trie.Hash()
 }
 
+// PostStateRoot returns the root IntermediateRoot would compute at this point
+// of a transaction without finalising the state, so the journal of the running
+// transaction stays revertible. Only the tries of the changed accounts are
+// copied and hashed; the state itself is left untouched.
+func (s *StateDB) PostStateRoot(deleteEmptyObjects bool) common.Hash {
+	tr := s.db.CopyTrie(s.trie)
+	addrs := make(map[common.Address]struct{}, len(s.stateObjectsPending)+len(s.journal.dirties))
+	for addr := range s.stateObjectsPending {
+		addrs[addr] = struct{}{}
+	}
+	for addr := range s.journal.dirties {
+		addrs[addr] = struct{}{}
+	}
+	for addr := range addrs {
+		obj, exist := s.stateObjects[addr]
+		if !exist {
+			continue // ripeMD, see Finalise
+		}
+		if obj.deleted || obj.suicided || (deleteEmptyObjects && obj.empty()) {
+			if err := tr.TryDeleteAccount(addr[:]); err != nil {
+				s.setError(fmt.Errorf("PostStateRoot (%x) error: %v", addr[:], err))
+			}
+			continue
+		}
+		data := obj.data
+		data.Root = obj.postStorageRoot(s.db)
+		if err := tr.TryUpdateAccount(addr[:], &data); err != nil {
+			s.setError(fmt.Errorf("PostStateRoot (%x) error: %v", addr[:], err))
+		}
+	}
+	return tr.Hash()
+}
+
 // Prepare sets the current transaction hash and index which are
 // used when the EVM emits new state logs.
 func (s *StateDB) Prepare(thash common.Hash, ti int) {
@@ -695,6 +695,47 @@ func TestDeleteCreateRevert(t *testing.T) {
 	}
 }
 
+// TestPostStateRoot tests that PostStateRoot matches IntermediateRoot in the
+// middle of a transaction and leaves the journal revertible.
+func TestPostStateRoot(t *testing.T) {
+	kept, emptied, killed := common.BytesToAddress([]byte("kept")), common.BytesToAddress([]byte("emptied")), common.BytesToAddress([]byte("killed"))
+	build := func() (*StateDB, int) {
+		state, _ := New(common.Hash{}, NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		for i, addr := range []common.Address{kept, emptied, killed} {
+			state.SetBalance(addr, big.NewInt(1))
+			state.SetState(addr, common.Hash{1}, common.Hash{byte(i + 1)})
+		}
+		root, _ := state.Commit(false)
+		state, _ = New(root, state.db, state.snaps)
+
+		// A finalised change of an earlier transaction
+		state.SetState(kept, common.Hash{2}, common.Hash{2})
+		state.Finalise(true)
+
+		id := state.Snapshot()
+		state.SetState(kept, common.Hash{1}, common.Hash{})
+		state.SetState(kept, common.Hash{3}, common.Hash{3})
+		state.SetBalance(emptied, new(big.Int))
+		state.Suicide(killed)
+		return state, id
+	}
+	state, id := build()
+	have := state.PostStateRoot(true)
+	if want := state.IntermediateRoot(true); have != want {
+		// PostStateRoot does not alter the state, so this is the root it saw
+		t.Fatalf("have root %x, want %x", have, want)
+	}
+	state, id = build()
+	state.PostStateRoot(true)
+	state.RevertToSnapshot(id)
+	if have := state.GetState(kept, common.Hash{1}); have != (common.Hash{1}) {
+		t.Errorf("reverted slot: have %x", have)
+	}
+	if state.getStateObject(killed) == nil {
+		t.Error("reverted self-destruct kept")
+	}
+}
+
 // TestMissingTrieNodes tests that if the StateDB fails to load parts of the trie,
 // the Commit operation fails with an error
 // If we are missing trie nodes, we should not continue writing to the trie
@@ -27,6 +27,7 @@ import (
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/params"
 )
 
@@ -85,10 +86,23 @@ func (p *StateProcessor) Process(block *types.Block, statedb *state.StateDB, cfg
 		}
 		receipts = append(receipts, receipt)
 		allLogs = append(allLogs, receipt.Logs...)
+
+		// Activate shield rules gated on a successful governance transaction
+		if receipt.Status == types.ReceiptStatusSuccessful {
+			cfg.ShieldRegistry.ActivateOnTx(tx.Hash())
+		}
 	}
 	// Finalize the block, applying any consensus engine specific extras (e.g. block rewards)
 	p.engine.Finalize(p.bc, header, statedb, block.Transactions(), block.Uncles())
 
+	// Persist the shield activity of the block for offline analysis
+	if cfg.ShieldReportDir != "" {
+		report := vm.GenerateBlockShieldReport(block.NumberU64(), vmenv.Interpreter().ShieldEvents())
+		if err := report.Write(cfg.ShieldReportDir); err != nil {
+			log.Warn("Failed to write block shield report", "number", block.NumberU64(), "err", err)
+		}
+	}
+
 	return receipts, allLogs, *usedGas, nil
 }
 
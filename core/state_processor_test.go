@@ -337,3 +337,39 @@ func GenerateBadBlock(parent *types.Block, engine consensus.Engine, txs types.Tr
 	// Assemble and return the final block for sealing
 	return types.NewBlock(header, txs, nil, receipts, trie.NewStackTrie(nil))
 }
+
+// TestSimulateTransaction checks that simulating a transaction reports its
+// shield decisions without altering the state it ran on.
+func TestSimulateTransaction(t *testing.T) {
+	var (
+		config   = params.TestChainConfig
+		signer   = types.LatestSigner(config)
+		key, _   = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		contract = common.HexToAddress("0xc0de")
+		db       = rawdb.NewMemoryDatabase()
+		gspec    = &Genesis{
+			Config: config,
+			Alloc: GenesisAlloc{
+				common.HexToAddress("0x71562b71999873DB5b286dF957af199Ec94617F7"): {Balance: big.NewInt(1000000000000000000)},
+				contract: {Code: common.FromHex("600160005500"), Balance: new(big.Int)}, // sstore(0, 1)
+			},
+		}
+		blockchain, _ = NewBlockChain(db, nil, gspec, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+	)
+	defer blockchain.Stop()
+
+	tx, _ := types.SignTx(types.NewTransaction(0, contract, new(big.Int), 100000, big.NewInt(params.InitialBaseFee), nil), signer, key)
+	block := blockchain.CurrentBlock()
+	statedb, _ := blockchain.StateAt(block.Root())
+
+	res, err := blockchain.Processor().(*StateProcessor).SimulateTransaction(tx, block, statedb, nil)
+	if err != nil {
+		t.Fatalf("simulation failed: %v", err)
+	}
+	if len(res.Decisions) != 1 || !res.Decisions[0].Allowed || res.Blocked != 0 {
+		t.Fatalf("unexpected decisions: %+v", res.Decisions)
+	}
+	if value := statedb.GetState(contract, common.Hash{}); value != (common.Hash{}) {
+		t.Errorf("simulated write persisted: %x", value)
+	}
+}
@@ -18,19 +18,24 @@ package vm
 
 import (
 	"bytes"
-	"io/ioutil"
-	"log"
+	"errors"
+	"fmt"
+	"io"
 	"math/big"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/holiman/uint256"
 
 	//【*】
 	"encoding/hex"
 	"encoding/json"
 
-	mapset "github.com/deckarep/golang-set"
 	"github.com/ethereum/go-ethereum/crypto"
 )
 
@@ -51,26 +56,117 @@ type AccountRef common.Address
 // Address casts AccountRef to a Address
 func (ar AccountRef) Address() common.Address { return (common.Address)(ar) }
 
+//【*】Dynamic 变量预取时在已知 slot 之外多读的数量
+const dynamicPrefetchWindow = 16
+
+//【*】Dynamic 变量默认最多读取的 slot 数
+const defaultMaxDynamicSlots = 10000
+
+//【*】Shield 检查每个 slot 记录消耗的 gas
+const shieldSlotGas = 3
+
 //【*】变量名对应的绑定信息
 type Variable struct {
-	Slot      mapset.Set //所有slot
+	//IdentifyMap、DynamicUpdate 修改 slot 集合时持写锁，Shield 持读锁。
+	//并行执行时对同一变量的更新因此被串行化，MapValue 的追加顺序即加锁顺序。
+	sync.RWMutex
+
+	Name      string   //变量名，仅用于日志与追踪
+	Slot      *SlotSet //所有slot
 	StartSlot uint256.Int
 
-	IfPackage     bool
-	PackageSize   int
+	SlotRanges []SlotRange //连续的 slot 区间（如 100 个相邻的余额 slot），代替逐个列出的 slot
+
+	IfPackage       bool
+	PackageSize     int
+	ExpectedABIType string //打包变量的 Solidity 类型，用于校验 PackageSize
 	OriginalValue uint256.Int //ssload时加载的值
 	PackageStart  int
 
+	IfEnum          bool    //打包的 enum：不整体屏蔽，PackageStart 处的字节必须是合法的枚举值
+	ValidEnumValues []uint8
+
 	IfDynamic       bool
 	DynamicStart    uint256.Int //存储长度的初始slot
 	IfDynamicUpdate bool
+	MaxDynamicSlots int //Dynamic 变量最多读取的 slot 数，0 表示默认的 defaultMaxDynamicSlots
+
+	//定长数组（如 uint256[5]）占用从 StartSlot 开始的 FixedArrayLen 个连续 slot，按普通变量屏蔽。
+	//已知限制：不支持元素打包在同一 slot 中的数组（如 uint8[5]）
+	IfFixedArray  bool
+	FixedArrayLen int
+
+	//结构体：第 i 个字段占用 StartSlot+i，按各字段自己的规则屏蔽，字段的 StartSlot 由 InitSlot 计算。
+	//已知限制：不支持多个字段打包在同一 slot 中，也不支持占用多个 slot 的字段
+	IfStruct     bool
+	StructFields []Variable
 
 	IfMapping    bool
 	MappingStart uint256.Int //（key，slot）中的slot，（key，hash）中的hash
 
 	MappingValueType string //只记录最后一个的value的类型
 	Deep             int    //mapping嵌套层数
-	MapValue         []Variable
+	MapValue         []*Variable
+
+	HashLayout       string //mapping 的 hash 布局：HashLayoutSolidity（默认）或 HashLayoutVyper
+
+	MapEntryTTLBlocks   uint64 //嵌套 mapping 记录的下一层超过这么多个区块后被清理，0 表示不清理
+	discoverBlockNumber uint64 //作为下一层被发现时的区块号
+
+	IfUnderflowProtect bool //下溢保护：不整体屏蔽，只检查写入值
+	IntendedDecrement  bool //规则声明该函数对变量只做递减
+
+	IfBigValueProtect bool        //大值保护：不整体屏蔽，只阻止写入接近 MaxUint256 的值
+	BigValueThreshold uint256.Int //写入值不得大于 MaxUint256 - BigValueThreshold
+
+	IfProtectDelete bool //只屏蔽写入 0（删除），允许非零更新
+	IfProtectUpdate bool //只屏蔽非零写入（更新），允许删除
+
+	IfMonotonicIncrease bool //nonce 类计数器：新值必须严格大于当前值
+	OnlyDecrease        bool   //新值不得大于当前值
+	MaxDeltaPercent     uint64 //单次写入相对当前值的最大变化百分比，0 表示不限制；当前值为 0 时不限制
+
+	ConservedBalance bool //ERC-20 余额 mapping，与 ConservedSupply 一起检查总量守恒
+	ConservedSupply  bool //ERC-20 totalSupply
+
+	IfERC721Owner    bool        //ERC-721 _owners mapping：转移所有权时原所有者的余额必须在本交易中减少
+	OwnerBalanceSlot uint256.Int //_balances mapping 的 slot
+
+	RequiredCallPath []common.Address //调用栈顶端与之相同时才允许写入
+
+	StateMachine *StateMachine //状态变量只允许按规定的状态转移写入
+
+	EnforcementDelay  uint64 //时间锁：允许修改一次，之后 EnforcementDelay 个区块内不得再改
+	MaxWritesPerBlock uint64 //同一区块内（跨交易）最多允许写入的次数，0 表示不限制
+
+	ActiveHoursUTC [2]uint8 //只在区块时间的 UTC 小时位于 [开始, 结束) 时生效，开始大于结束表示跨午夜，两者相等表示全天生效
+
+	//写入放行后检查的不变量，失败时只记录事件，不撤销写入。只能在代码中设置
+	PostConditionFuncs []func(newVal uint256.Int, stateDB StateDB, addr common.Address) bool `json:"-"`
+}
+
+//【*】StateMachine 描述一个状态变量的有限状态机。
+// States[i] 对应 slot 中存储的数值 i，Transitions 给出每个状态可转移到的状态。
+type StateMachine struct {
+	States      []string
+	Transitions map[string][]string
+}
+
+//【*】判断 from -> to 是否是合法的状态转移，值不变视为合法
+func (m *StateMachine) allowed(from, to *uint256.Int) bool {
+	if from.Eq(to) {
+		return true
+	}
+	if !from.LtUint64(uint64(len(m.States))) || !to.LtUint64(uint64(len(m.States))) {
+		return false
+	}
+	target := m.States[to.Uint64()]
+	for _, next := range m.Transitions[m.States[from.Uint64()]] {
+		if next == target {
+			return true
+		}
+	}
+	return false
 }
 
 // Contract represents an ethereum contract in the state database. It contains
@@ -95,9 +191,105 @@ type Contract struct {
 	value *big.Int
 
 	//【*】函数名的绑定信息
+	FunctionRule
+
+	ethBalances map[common.Address]*big.Int //MonitoredEthBalances 在函数开始时的余额
+	preimages   map[common.Hash][]byte      //SHA3 记录的 (key ++ slot) 原像
+	tainted     map[uint256.Int]struct{}    //由 BLOCKHASH 派生的值
+
+	timestampUsed bool //本帧是否执行过 TIMESTAMP
+	coinbaseUsed  bool //本帧是否执行过 COINBASE
+	basefeeUsed   bool //本帧是否执行过 BASEFEE
+	lowGasLimit   bool //本帧 GASLIMIT 读到的区块 gas 上限低于 MinBlockGasLimit
+
+	entryCallStack []common.Address //函数开始执行时的调用栈
+
+	rulePath  string //加载规则的文件，Write 写回这个文件
+	ruleIndex int    //绑定的规则在规则数组中的下标，Write 只替换这一条
+
+	balanceNet *big.Int //本帧余额增加量 - 余额减少量 - totalSupply 增加量
+
+	AuditLog io.Writer `json:"-"` //被屏蔽的 SSTORE 逐行以 JSON 写入，为空则不记录
+}
+
+//【*】函数对应的规则，rule.json 的一条记录
+type FunctionRule struct {
 	Functionname   string
+	Selectors      []Selector //同一函数的其他选择器（如升级后改名）
+
+	matchedSelector string //绑定规则时匹配到的选择器（Functionname 或 Selectors 之一），为空表示没有绑定规则
+
+	ContractAddress common.Address `json:"contractAddress"` //规则所针对的合约（DELEGATECALL 时为代理合约），为空则适用于任何合约
 	FunctionShield []Variable
 	FunctionAllow  []Variable
+
+	MonitoredEthBalances []common.Address //监控 ETH 余额的地址
+	MaxEthDeltaWei       *big.Int         //允许的最大余额变化量
+
+	BatchBalancesSlot   uint256.Int       //ERC-1155 _balances[id][account] 的 slot
+	BatchTransferLimits map[string]uint64 //token id(十进制) -> 单笔最大转账数量
+
+	MonitorHashInputs []hexutil.Bytes //SHA3 输入中不应出现的敏感字节序列，只告警不屏蔽
+
+	MinGasFloor uint64 //GAS 指令最多返回的值，0 表示不限制
+
+	ChainIDFilter []uint64 //只在这些链上生效，为空则所有链都生效
+
+	BlockhashShield bool //BLOCKHASH 派生的值写入受保护 slot 时告警
+
+	BlockExtcodecopy bool //其他合约 EXTCODECOPY 本合约时只能得到全零字节，需在 RuleRegistry 中注册
+
+	PrecompileRules map[common.Address]PrecompileRule //预编译合约地址 -> 调用限制
+
+	AllowedSelfDestructBeneficiaries []common.Address //SELFDESTRUCT 允许的受益人，其他受益人被替换为第一个
+
+	ActivationTxHash common.Hash //治理交易上链后规则才在 RuleRegistry 中生效，为空则立即生效
+
+	ForbiddenBytecodePatterns []hexutil.Bytes //DELEGATECALL 的目标代码中不允许出现的字节序列，如硬编码的攻击者地址。SetCallCode 在加载规则之前执行，只有 AsDelegate 继承了调用方规则的帧会检查
+	ForbiddenConstantValues   []uint256.Int   //DELEGATECALL 的目标代码中不允许由 PUSH32 压入的常量，如攻击者地址或历史攻击中的魔数。与 ForbiddenBytecodePatterns 相同，只有继承了调用方规则的帧会检查
+
+	TimestampSensitiveSlots []uint256.Int //本帧执行过 TIMESTAMP 后，写入这些 slot 需要区块时间在窗口内
+	TimestampWindowStart    uint64        //允许的区块时间窗口（unix 秒，闭区间）
+	TimestampWindowEnd      uint64
+
+	CoinbaseSensitiveSlots []uint256.Int    //本帧执行过 COINBASE 后，只有受信任的出块者才能写入这些 slot，防止出块者操纵依赖 coinbase 的状态（MEV）
+	TrustedMiners          []common.Address //受信任的出块者（区块 coinbase）
+
+	BasefeeSensitiveSlots []uint256.Int //本帧执行过 BASEFEE 后，写入这些 slot 需要区块 basefee 在区间内，防止出块者操纵 basefee 影响依赖手续费的状态
+	MinBasefee            uint256.Int   //允许的 basefee 区间（wei，闭区间）
+	MaxBasefee            uint256.Int   //0 表示没有上限
+
+	MaxDelegatecallDepth int //调用栈中 DELEGATECALL 超过这么多层时屏蔽对受保护 slot 的写入，0 表示不限制
+
+	BlockCodecopyToMemory bool //CODECOPY 复制本合约自身（含 initcode）的代码时只能得到全零字节
+
+	MaxMemoryExpansion uint64 //MSTORE、MSTORE8、CALLDATACOPY、RETURNDATACOPY 扩展后内存超过这么多字节时中止执行，0 表示不限制
+
+	NoReentrantCallStack []common.Address //这些合约在调用栈中出现两次及以上（重入）时屏蔽对受保护 slot 的写入
+	NoSelfReentrancy     bool             //同上，针对合约自身（代理合约为存储所属的代理地址），规则不必预先知道合约地址
+
+	ShieldExprs []RuleExpr //用 And、Or、Not 组合变量的屏蔽条件，任一表达式阻止时屏蔽写入
+
+	AllowedEthRecipients []common.Address //CALL 转出 ETH 的收款地址白名单，为空则不限制
+	SafeVault            common.Address   //收款地址不在白名单时 ETH 改为转入该地址
+
+	MaxChildCodeSize uint64 //CREATE/CREATE2 的 initcode 超过该长度时创建失败，0 表示不限制
+
+	AnalyzeRevertData bool //函数 REVERT 时解码 revert 数据并通过 ShieldEventHook 报告
+
+	EnforceAccessListCoverage bool //SSTORE 的 slot 必须在交易的 EIP-2930 access list 中声明
+
+	MinBlockGasLimit uint64 //GASLIMIT 读到的区块 gas 上限低于该值时告警，并屏蔽之后对受保护 slot 的写入
+
+	DetectReadAfterWriteHazard bool //SLOAD 读取本交易中已经写过的 slot 时告警（跨函数重入的常见特征）。只有本函数或 RuleRegistry 中合约的规则启用它时才记录写入
+
+	ExpectZeroValue bool //函数不应接收 ETH：调用附带 ETH 时屏蔽本帧的所有写入，即使合约漏写或绕过了 payable 检查
+
+	RequireOriginEqualsCaller bool //只允许外部账户直接调用时写入：经由中继或其他合约调用（ORIGIN 与 CALLER 不同）时屏蔽本帧的所有写入
+
+	ExpectedPostStateRoot common.Hash //私有链/联盟链：函数执行完成时状态根必须等于该值，否则整个交易回滚
+
+	RevertOnBlock bool //屏蔽写入时以 Solidity 自定义错误 ShieldViolation(bytes32,bytes32,string) 回滚本帧，而不是跳过写入继续执行
 }
 
 // NewContract returns a new contract environment for the execution of EVM.
@@ -122,32 +314,496 @@ func NewContract(caller ContractRef, object ContractRef, value *big.Int, gas uin
 
 //【*】NewRule returns a new contract environment with the rule information for the execution of EVM.
 // function 读取文件,json反序列化，添加到contract对象内
-func (c *Contract) NewRule() *Contract {
+// 没有配置规则文件时不屏蔽；EVM_SHIELD_RULE_PATH 指定的文件打不开或规则无效属于配置错误，返回错误
+func (c *Contract) NewRule() (*Contract, error) {
+	//没有函数选择器（如空 calldata 的 STATICCALL）时基于选择器的规则无从匹配
+	if len(c.Input) < 4 {
+		return c, nil
+	}
+	path := c.ruleFilePath()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && os.Getenv(ruleFileEnv) == "" {
+			return c, nil
+		}
+		return c, err
+	}
+	return c.newRuleFromFile(path, data)
+}
+
+//【*】newRuleFromFile 绑定从 path 读取的规则，并记住 path，Write 写回同一个文件
+func (c *Contract) newRuleFromFile(path string, data []byte) (*Contract, error) {
+	if _, err := c.NewRuleFromBytes(data); err != nil {
+		return c, err
+	}
+	c.rulePath = path
+	return c, nil
+}
+
+//【*】NewRuleFromBytes 解析内存中的 JSON 规则（单个规则或规则数组）并绑定与函数选择器匹配的第一条，
+// 不访问文件系统。NewRule 等读取规则的方法都在取得数据后调用它（NewRuleWithABI 需要补全选择器，直接调用 parseRules 与 bindRule）
+func (c *Contract) NewRuleFromBytes(data []byte) (*Contract, error) {
+	if len(c.Input) < 4 {
+		return c, nil
+	}
+	rules, err := parseRules(data)
+	if err != nil {
+		return c, err
+	}
+	return c.bindRule(rules), nil
+}
+
+//【*】bindRule 绑定第一条针对本合约且与函数选择器匹配的规则
+func (c *Contract) bindRule(rules []*Contract) *Contract {
+	for i, Con := range rules {
+		if Con.appliesTo(c) && Con.matches(c.Input[0:4]) {
+			c.ruleIndex = i
+			return c.applyRule(Con)
+		}
+	}
+	return c
+}
+
+//【*】NewRuleWithRetry 与 NewRule 相同，但打开规则文件失败时按指数退避（带随机抖动）重试，
+// 避免 NFS 抖动、磁盘唤醒等临时错误让屏蔽失效。解析与校验错误不会重试；
+// 文件不存在与 NewRule 相同处理，立即返回。负的 baseDelay 按 0 处理
+func (c *Contract) NewRuleWithRetry(maxRetries int, baseDelay time.Duration) (*Contract, error) {
+	if len(c.Input) < 4 {
+		return c, nil
+	}
+	delay := baseDelay
+	if delay < 0 {
+		delay = 0
+	}
+	path := c.ruleFilePath()
+	for attempt := 0; ; attempt++ {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			return c.newRuleFromFile(path, data)
+		}
+		if os.IsNotExist(err) {
+			if os.Getenv(ruleFileEnv) == "" {
+				return c, nil
+			}
+			return c, err
+		}
+		var pathErr *os.PathError
+		if !errors.As(err, &pathErr) || attempt >= maxRetries {
+			return c, err
+		}
+		time.Sleep(delay + time.Duration(rand.Int63n(int64(delay)/2+1)))
+		delay *= 2
+	}
+}
+
+//【*】规则文件的位置：设置了环境变量时只使用它指定的文件（如容器中挂载的配置），
+//否则每个合约地址一个文件，旧的全局文件作为回退
+const (
+	ruleFileEnv      = "EVM_SHIELD_RULE_PATH"
+	ruleFileDir      = "rules"
+	fallbackRuleFile = "./rule.json"
+)
+
+//【*】addressRuleFile 合约自身的规则文件 ./rules/<地址>.json
+func (c *Contract) addressRuleFile() string {
+	return filepath.Join(ruleFileDir, c.Address().Hex()+".json")
+}
+
+//【*】ruleFilePath 优先使用 EVM_SHIELD_RULE_PATH，其次是合约地址对应的规则文件，不存在时回退到 ./rule.json
+func (c *Contract) ruleFilePath() string {
+	if path := os.Getenv(ruleFileEnv); path != "" {
+		return path
+	}
+	if c.self != nil {
+		if path := c.addressRuleFile(); fileExists(path) {
+			return path
+		}
+	}
+	return fallbackRuleFile
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+//【*】parseRules 反序列化并校验一个规则或以 JSON 数组给出的多个规则
+func parseRules(data []byte) ([]*Contract, error) {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var rules []*Contract
+		if err := json.Unmarshal(trimmed, &rules); err != nil {
+			return nil, err
+		}
+		for i, Con := range rules {
+			if Con == nil {
+				return nil, fmt.Errorf("rule %d: null", i)
+			}
+			if err := Con.ValidateRule(); err != nil {
+				return nil, fmt.Errorf("rule %d: %v", i, err)
+			}
+			//多个规则文件合并成的数组中，同一个 slot 可能被重复列出
+			if err := Con.mergeSameStartSlot(); err != nil {
+				return nil, fmt.Errorf("rule %d: %v", i, err)
+			}
+		}
+		return rules, nil
+	}
 	var Con Contract
-	file, _ := os.Open("./rule.json")
-	defer file.Close()
-	decoder := json.NewDecoder(file)
-	err := decoder.Decode(&Con)
+	if err := json.Unmarshal(data, &Con); err != nil {
+		return nil, err
+	}
+	if err := Con.ValidateRule(); err != nil {
+		return nil, err
+	}
+	return []*Contract{&Con}, nil
+}
+
+//【*】mergeSameStartSlot 分别合并屏蔽列表与白名单中 StartSlot 相同的变量
+func (r *FunctionRule) mergeSameStartSlot() error {
+	shield, err := mergeSameStartSlot(r.FunctionShield)
 	if err != nil {
-		log.Println(err)
+		return fmt.Errorf("FunctionShield: %v", err)
 	}
-	fn, _ := hex.DecodeString(Con.Functionname)
+	allow, err := mergeSameStartSlot(r.FunctionAllow)
+	if err != nil {
+		return fmt.Errorf("FunctionAllow: %v", err)
+	}
+	r.FunctionShield, r.FunctionAllow = shield, allow
+	return nil
+}
 
-	if bytes.Equal(c.Input[0:4], fn) {
-		c.Functionname = Con.Functionname
-		c.FunctionShield = Con.FunctionShield
+//【*】applyRule 将已匹配的规则绑定到 contract 上，由调用方（bindRule）按合约地址与函数选择器匹配
+func (c *Contract) applyRule(Con *Contract) *Contract {
+	if len(c.Input) < 4 {
+		return c
+	}
+	c.FunctionRule = Con.FunctionRule
+	//规则作为模板不被修改，每次执行在自己的拷贝上识别 slot
+	c.FunctionShield = cloneVariables(Con.FunctionShield)
+	c.FunctionAllow = cloneVariables(Con.FunctionAllow)
+	//Functionname 保持规则中的主选择器，Write 写回的规则不会被别名覆盖
+	c.matchedSelector = hex.EncodeToString(c.Input[0:4])
+	for i := 0; i < len(c.FunctionShield); i++ {
+		c.FunctionShield[i].InitSlot()
+	}
+	for i := 0; i < len(c.FunctionAllow); i++ {
+		c.FunctionAllow[i].InitSlot()
+	}
+	for i := 0; i < len(c.ShieldExprs); i++ {
+		c.ShieldExprs[i].initSlots()
+	}
+	//常量 keccak 计算出的 mapping slot 在执行前就可以确定
+	if len(c.Code) != 0 {
+		computer := NewCompileTimeSlotComputer(c.Code)
 		for i := 0; i < len(c.FunctionShield); i++ {
-			c.FunctionShield[i].InitSlot()
+			computer.Populate(&c.FunctionShield[i])
 		}
-		for i := 0; i < len(c.FunctionAllow); i++ {
-			c.FunctionAllow[i].InitSlot()
+	}
+	return c
+}
+
+//【*】Selector 函数选择器，JSON 中以十六进制字符串表示
+type Selector [4]byte
+
+// MarshalText implements encoding.TextMarshaler.
+func (s Selector) MarshalText() ([]byte, error) {
+	return hexutil.Bytes(s[:]).MarshalText()
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (s *Selector) UnmarshalText(input []byte) error {
+	return hexutil.UnmarshalFixedText("Selector", input, s[:])
+}
+
+//【*】appliesTo 规则是否针对合约 c：没有指定 contractAddress 的规则适用于任何合约
+func (r *FunctionRule) appliesTo(c *Contract) bool {
+	return r.ContractAddress == (common.Address{}) || (c.self != nil && r.ContractAddress == c.Address())
+}
+
+//【*】selector 是否是规则的 Functionname 或 Selectors 之一
+func (r *FunctionRule) matches(selector []byte) bool {
+	if fn, _ := hex.DecodeString(r.Functionname); bytes.Equal(selector, fn) {
+		return true
+	}
+	for _, s := range r.Selectors {
+		if bytes.Equal(selector, s[:]) {
+			return true
 		}
 	}
+	return false
+}
+
+//【*】WithShieldInherited 让子调用帧直接沿用父帧的规则，而不是重新 NewRule。
+// 两者共享同一组 Variable，子帧识别到的 mapping / Dynamic slot 对父帧同样可见，
+// 这与 DELEGATECALL 共享存储的语义一致。整条规则都被继承，
+// 函数级别的限制（如 MaxDelegatecallDepth）在被委托的代码中同样生效。
+func (c *Contract) WithShieldInherited(parent *Contract) *Contract {
+	c.FunctionRule = parent.FunctionRule
 	return c
 }
 
+//【*】resetDynamicState 丢弃执行中识别到的 slot（mapping 的各层、Dynamic 数组的元素），保留规则本身的配置。
+// 值为 Dynamic 的 mapping 在识别时才确定 DynamicStart，一并清除
+func (v *Variable) resetDynamicState() {
+	v.Lock()
+	defer v.Unlock()
+
+	v.MapValue = nil
+	if v.IfMapping && v.MappingValueType == "Dynamic" {
+		v.IfDynamic = false
+		v.DynamicStart.Clear()
+	}
+	for i := range v.StructFields {
+		v.StructFields[i].resetDynamicState()
+	}
+	v.InitSlot()
+}
+
+//【*】OnSelfDestruct 合约自毁后清除 registry 中该地址规则识别到的 slot：
+// 同一区块内在同一地址重新部署的合约从空的 slot 集合开始识别，不沿用上一次部署的存储布局
+func (c *Contract) OnSelfDestruct(registry *RuleRegistry) {
+	registry.ResetDynamicState(c.Address())
+}
+
+//【*】Clone 深拷贝变量：slot 集合、MapValue 各层与结构体字段、切片都复制一份，拷贝与原变量互不影响。
+// 同一份规则被多个 EVM 并发执行时，各自在拷贝上识别 slot。接收者是指针，避免复制锁；
+//新增字段时需要同时在这里复制
+func (v *Variable) Clone() Variable {
+	v.RLock()
+	defer v.RUnlock()
+
+	var slot *SlotSet
+	if v.Slot != nil {
+		slot = NewSlotSet(v.Slot.Slots()...)
+	}
+	var mapValue []*Variable
+	if v.MapValue != nil {
+		mapValue = make([]*Variable, len(v.MapValue))
+		for i, deep := range v.MapValue {
+			clone := deep.Clone()
+			mapValue[i] = &clone
+		}
+	}
+	var stateMachine *StateMachine
+	if v.StateMachine != nil {
+		stateMachine = &StateMachine{States: append([]string(nil), v.StateMachine.States...)}
+		if v.StateMachine.Transitions != nil {
+			stateMachine.Transitions = make(map[string][]string, len(v.StateMachine.Transitions))
+			for from, to := range v.StateMachine.Transitions {
+				stateMachine.Transitions[from] = append([]string(nil), to...)
+			}
+		}
+	}
+	return Variable{
+		Name:                v.Name,
+		Slot:                slot,
+		StartSlot:           v.StartSlot,
+		SlotRanges:          append([]SlotRange(nil), v.SlotRanges...),
+		IfPackage:           v.IfPackage,
+		PackageSize:         v.PackageSize,
+		ExpectedABIType:     v.ExpectedABIType,
+		OriginalValue:       v.OriginalValue,
+		PackageStart:        v.PackageStart,
+		IfEnum:              v.IfEnum,
+		ValidEnumValues:     append([]uint8(nil), v.ValidEnumValues...),
+		IfDynamic:           v.IfDynamic,
+		DynamicStart:        v.DynamicStart,
+		IfDynamicUpdate:     v.IfDynamicUpdate,
+		MaxDynamicSlots:     v.MaxDynamicSlots,
+		IfFixedArray:        v.IfFixedArray,
+		FixedArrayLen:       v.FixedArrayLen,
+		IfStruct:            v.IfStruct,
+		StructFields:        cloneVariables(v.StructFields),
+		IfMapping:           v.IfMapping,
+		MappingStart:        v.MappingStart,
+		MappingValueType:    v.MappingValueType,
+		Deep:                v.Deep,
+		MapValue:            mapValue,
+		HashLayout:          v.HashLayout,
+		MapEntryTTLBlocks:   v.MapEntryTTLBlocks,
+		discoverBlockNumber: v.discoverBlockNumber,
+		IfUnderflowProtect:  v.IfUnderflowProtect,
+		IntendedDecrement:   v.IntendedDecrement,
+		IfBigValueProtect:   v.IfBigValueProtect,
+		BigValueThreshold:   v.BigValueThreshold,
+		IfProtectDelete:     v.IfProtectDelete,
+		IfProtectUpdate:     v.IfProtectUpdate,
+		IfMonotonicIncrease: v.IfMonotonicIncrease,
+		OnlyDecrease:        v.OnlyDecrease,
+		MaxDeltaPercent:     v.MaxDeltaPercent,
+		ConservedBalance:    v.ConservedBalance,
+		ConservedSupply:     v.ConservedSupply,
+		IfERC721Owner:       v.IfERC721Owner,
+		OwnerBalanceSlot:    v.OwnerBalanceSlot,
+		RequiredCallPath:    append([]common.Address(nil), v.RequiredCallPath...),
+		StateMachine:        stateMachine,
+		EnforcementDelay:    v.EnforcementDelay,
+		MaxWritesPerBlock:   v.MaxWritesPerBlock,
+		ActiveHoursUTC:      v.ActiveHoursUTC,
+		PostConditionFuncs:  append([]func(uint256.Int, StateDB, common.Address) bool(nil), v.PostConditionFuncs...),
+	}
+}
+
+//【*】cloneVariables 逐个 Clone，nil 保持为 nil
+func cloneVariables(vars []Variable) []Variable {
+	if vars == nil {
+		return nil
+	}
+	clones := make([]Variable, len(vars))
+	for i := range vars {
+		clones[i] = vars[i].Clone()
+	}
+	return clones
+}
+
+//【*】Merge 把 other 合并进 v：并入 other 的 slot 集合，追加 v 中还没有的 MapValue 下一层。
+// 两者的 IfPackage、IfDynamic、IfMapping 必须一致，否则同一个 slot 会按两种布局解释，返回错误。
+// 合并后的 slot 按 v 的规则检查。参数是指针，避免复制锁
+func (v *Variable) Merge(other *Variable) error {
+	if v == other {
+		return nil
+	}
+	if err := v.checkMergeable(other); err != nil {
+		return err
+	}
+	v.Lock()
+	defer v.Unlock()
+	other.RLock()
+	defer other.RUnlock()
+
+	if v.Slot == nil {
+		v.Slot = NewSlotSet()
+	}
+	if other.Slot != nil {
+		for _, slot := range other.Slot.Slots() {
+			v.Slot.Add(slot)
+		}
+	}
+	for _, deep := range other.MapValue {
+		exist := false
+		for _, known := range v.MapValue {
+			if known.MappingStart == deep.MappingStart {
+				exist = true
+				break
+			}
+		}
+		if !exist {
+			clone := deep.Clone()
+			v.MapValue = append(v.MapValue, &clone)
+		}
+	}
+	return nil
+}
+
+//【*】checkMergeable 两个变量的布局标志是否一致
+func (v *Variable) checkMergeable(other *Variable) error {
+	switch {
+	case v.IfPackage != other.IfPackage:
+		return fmt.Errorf("cannot merge variables at slot %s: IfPackage %v and %v", v.StartSlot.Hex(), v.IfPackage, other.IfPackage)
+	case v.IfDynamic != other.IfDynamic:
+		return fmt.Errorf("cannot merge variables at slot %s: IfDynamic %v and %v", v.StartSlot.Hex(), v.IfDynamic, other.IfDynamic)
+	case v.IfMapping != other.IfMapping:
+		return fmt.Errorf("cannot merge variables at slot %s: IfMapping %v and %v", v.StartSlot.Hex(), v.IfMapping, other.IfMapping)
+	}
+	return nil
+}
+
+//【*】sameChecks 除名字与已识别的 slot 外，两个变量的配置是否完全相同。
+// 只比较 JSON 中的字段，用于从规则文件读取的变量
+func (v *Variable) sameChecks(other *Variable) bool {
+	encode := func(v *Variable) []byte {
+		clone := v.Clone()
+		clone.Name, clone.Slot, clone.MapValue = "", nil, nil
+		enc, _ := json.Marshal(&clone)
+		return enc
+	}
+	return bytes.Equal(encode(v), encode(other))
+}
+
+//【*】mergeSameStartSlot 合并 StartSlot 相同且检查相同的变量，一个 slot 只查找一次。
+// StartSlot 相同但检查不同的变量保持分开，各自的检查都生效；布局标志冲突时返回错误
+func mergeSameStartSlot(vars []Variable) ([]Variable, error) {
+	kept := make([]int, 0, len(vars))
+next:
+	for i := range vars {
+		for _, k := range kept {
+			if vars[k].StartSlot != vars[i].StartSlot {
+				continue
+			}
+			if err := vars[k].checkMergeable(&vars[i]); err != nil {
+				return nil, err
+			}
+			if vars[k].sameChecks(&vars[i]) {
+				if err := vars[k].Merge(&vars[i]); err != nil {
+					return nil, err
+				}
+				continue next
+			}
+		}
+		kept = append(kept, i)
+	}
+	if len(kept) == len(vars) {
+		return vars, nil
+	}
+	merged := make([]Variable, len(kept))
+	for n, k := range kept {
+		merged[n] = vars[k].Clone()
+	}
+	return merged, nil
+}
+
+//【*】ClearShield 清空屏蔽列表，用于执行中途放宽规则（如迁移函数）。
+// 清空前把各变量的 slot 集合恢复为 InitSlot 后的状态：DELEGATECALL 帧与调用方共享这些变量，
+// 调用方识别到的 mapping / Dynamic slot 同样被清除；清空列表本身只影响当前帧
+func (c *Contract) ClearShield() {
+	for i := range c.FunctionShield {
+		c.FunctionShield[i].InitSlot()
+	}
+	c.FunctionShield = c.FunctionShield[:0]
+}
+
+//【*】ClearAllow 清空白名单，同 ClearShield
+func (c *Contract) ClearAllow() {
+	for i := range c.FunctionAllow {
+		c.FunctionAllow[i].InitSlot()
+	}
+	c.FunctionAllow = c.FunctionAllow[:0]
+}
+
+//【*】ReloadRule 清空屏蔽列表与白名单后重新读取规则文件
+func (c *Contract) ReloadRule() (*Contract, error) {
+	c.ClearShield()
+	c.ClearAllow()
+	return c.NewRule()
+}
+
+//【*】contains 变量的 slot 集合或 slot 区间是否包含 loc
+func (v *Variable) contains(loc uint256.Int) bool {
+	return v.Slot.Contains(loc) || rangesContain(v.SlotRanges, &loc)
+}
+
 func (v *Variable) InitSlot() *Variable {
-	v.Slot = mapset.NewSet(v.StartSlot)
+	v.Slot = NewSlotSet(v.StartSlot)
+	v.SlotRanges = mergeSlotRanges(v.SlotRanges)
+	//定长数组：预先加入所有元素的 slot
+	if v.IfFixedArray {
+		var slot uint256.Int
+		for i := 1; i < v.FixedArrayLen; i++ {
+			v.Slot.Add(*slot.AddUint64(&v.StartSlot, uint64(i)))
+		}
+	}
+	//结构体：字段依次占用后续的 slot，本变量的 slot 集合包含所有字段
+	if v.IfStruct {
+		for i := range v.StructFields {
+			field := &v.StructFields[i]
+			field.StartSlot.AddUint64(&v.StartSlot, uint64(i))
+			if field.IfMapping {
+				field.MappingStart = field.StartSlot
+			}
+			field.InitSlot()
+			v.Slot.Add(field.StartSlot)
+		}
+	}
 	if v.Deep != 0 {
 		for i := 0; i < len(v.MapValue); i++ {
 			v.MapValue[i].InitSlot()
@@ -156,28 +812,176 @@ func (v *Variable) InitSlot() *Variable {
 	return v
 }
 
-func (c *Contract) Write() {
+//【*】Write 把规则写回 NewRule 读取规则的文件。不新建合约自己的 ./rules/<地址>.json：
+//它会优先于 ./rule.json 被读取，使回退文件中同一合约的其他函数规则失效
+func (c *Contract) Write() error {
+	//没有绑定任何函数规则（如 calldata 不足 4 字节），或规则不是从文件加载的（如继承自调用方）时不写
+	if c.matchedSelector == "" || c.rulePath == "" {
+		return nil
+	}
+	//持锁写入，并发的写入方不会交错；先写临时文件再重命名，崩溃时不会留下写了一半的规则文件
+	return c.WriteWithFlock(c.rulePath)
+}
+
+//【*】useShieldGas 扣除屏蔽检查的 gas。审计模式只观察，不改变 gas 消耗（以及退款、状态根），不扣除
+func (c *Contract) useShieldGas(gas uint64, interpreter *EVMInterpreter) bool {
+	return interpreter.cfg.ShieldMode == ShieldModeAudit || c.UseGas(gas)
+}
 
-	data, err := json.MarshalIndent(c, "", "	")
-	if err != nil {
-		panic(err)
+//【*】屏蔽逻辑,SSTORE时调用，检查次数、屏蔽次数与耗时记录到 GlobalStats。
+//同时返回检查应消耗的 gas：与 slot 集合的大小成正比，防止用膨胀的规则表免费消耗节点资源
+func (v *Variable) Shield(loc uint256.Int, val uint256.Int, interpreter *EVMInterpreter, scope *ScopeContext) (bool, uint64, error) {
+	start := time.Now()
+	write, err := v.shield(loc, val, interpreter, scope)
+	GlobalStats.recordCheck(err == nil && !write, time.Since(start))
+	return write, v.shieldGas(), err
+}
+
+//【*】shieldGas 检查 v 的 gas：每个 slot 记录 shieldSlotGas，包括嵌套 mapping 的各层与结构体字段
+func (v *Variable) shieldGas() uint64 {
+	v.RLock()
+	defer v.RUnlock()
+
+	gas := uint64(v.Slot.Cardinality()) * shieldSlotGas
+	for _, deep := range v.MapValue {
+		gas += deep.shieldGas()
 	}
-	err = ioutil.WriteFile("rule.json", data, 0777)
-	if err != nil {
-		panic(err)
+	for i := range v.StructFields {
+		gas += v.StructFields[i].shieldGas()
 	}
-
+	return gas
 }
 
-//【*】屏蔽逻辑,SSTORE时调用
-func (v *Variable) Shield(loc uint256.Int, val uint256.Int, interpreter *EVMInterpreter, scope *ScopeContext) bool {
+//【*】shield 是 Shield 的实现，嵌套 mapping 的下一层直接调用它，只在最外层计数
+func (v *Variable) shield(loc uint256.Int, val uint256.Int, interpreter *EVMInterpreter, scope *ScopeContext) (bool, error) {
+	//Dynamic 变量先在写锁下更新 slot 集合，再在读锁下判断
+	if v.IfDynamic && !v.IfPackage && !v.IfMapping {
+		if _, err := v.DynamicUpdate(interpreter, scope); err != nil {
+			return false, err
+		}
+	}
+	v.RLock()
+	defer v.RUnlock()
 
 	write := true
+	//规则未在当前链上启用
+	if !scope.Contract.chainIDActive(interpreter) {
+		return write, nil
+	}
+	//不在生效时段内
+	if !v.activeAt(interpreter.evm.Context.Time) {
+		return write, nil
+	}
+	//DELEGATECALL 嵌套过深：调用上下文可能被混淆，屏蔽受保护 slot 的写入
+	if scope.Contract.MaxDelegatecallDepth != 0 && interpreter.delegateDepth > scope.Contract.MaxDelegatecallDepth && v.contains(loc) {
+		return false, nil
+	}
+	//重入：受保护的合约在调用栈中出现了两次
+	if scope.Contract.reentered() && v.contains(loc) {
+		return false, nil
+	}
+	//区块 gas 上限过低：屏蔽受保护 slot 的写入
+	if scope.Contract.lowGasLimit && v.contains(loc) {
+		return false, nil
+	}
+	//依赖区块时间的写入：时间在窗口外时屏蔽，不受其他放行条件影响
+	if !scope.Contract.timestampAllows(loc, interpreter) {
+		return false, nil
+	}
+	//依赖 coinbase 的写入：出块者不受信任时屏蔽
+	if !scope.Contract.coinbaseAllows(loc, interpreter) {
+		return false, nil
+	}
+	//依赖 basefee 的写入：basefee 在区间外时屏蔽
+	if !scope.Contract.basefeeAllows(loc, interpreter) {
+		return false, nil
+	}
+	//经由受信任的合约调用链写入
+	if len(v.RequiredCallPath) != 0 && v.callPathMatches(interpreter) {
+		return write, nil
+	}
+	//状态机：按状态转移表判断，而不是整体屏蔽
+	if v.StateMachine != nil && v.contains(loc) {
+		return v.StateMachine.allowed(v.currentValue(loc, interpreter, scope), &val), nil
+	}
+	//每区块写入次数限制：不整体屏蔽，超过次数后屏蔽
+	if v.MaxWritesPerBlock != 0 && v.contains(loc) {
+		return v.writeBudgetAllows(loc, interpreter, scope), nil
+	}
+	//时间锁：不整体屏蔽，修改后的若干区块内锁定新值
+	if v.EnforcementDelay != 0 && v.contains(loc) {
+		return v.timelockAllows(loc, val, interpreter, scope), nil
+	}
+	//ERC-721 所有权：防止不扣减原所有者余额就复制所有权
+	if v.IfERC721Owner && v.contains(loc) {
+		return v.ownershipTransferBacked(v.currentValue(loc, interpreter, scope), interpreter, scope), nil
+	}
+	//余额守恒：不整体屏蔽，只检查记入余额的数量是否超过扣除与增发的数量
+	if (v.ConservedBalance || v.ConservedSupply) && v.contains(loc) {
+		return scope.Contract.conserveBalance(v.ConservedSupply, loc, val, v.currentValue(loc, interpreter, scope), interpreter, scope), nil
+	}
+	//变化幅度与方向限制：可与单调递增组合使用
+	if (v.MaxDeltaPercent != 0 || v.OnlyDecrease) && v.contains(loc) {
+		current := v.currentValue(loc, interpreter, scope)
+		if v.MaxDeltaPercent != 0 && !withinDeltaPercent(current, &val, v.MaxDeltaPercent) {
+			return false, nil
+		}
+		if v.OnlyDecrease && val.Gt(current) {
+			return false, nil
+		}
+		if !v.IfMonotonicIncrease {
+			return true, nil
+		}
+	}
+	//单调递增：不允许把计数器改回用过的值，防止重放
+	if v.IfMonotonicIncrease && v.contains(loc) {
+		return val.Gt(v.currentValue(loc, interpreter, scope)), nil
+	}
+	//删除与更新分开屏蔽：写入 0 即删除 slot 并获得退款，语义与更新不同
+	if (v.IfProtectDelete || v.IfProtectUpdate) && v.contains(loc) {
+		if val.IsZero() {
+			return !v.IfProtectDelete, nil
+		}
+		return !v.IfProtectUpdate, nil
+	}
+	//大值保护：余额等变量写入 MaxUint256 附近的值，后续 pre-0.8 的减法会下溢
+	if v.IfBigValueProtect && v.contains(loc) {
+		maxSafeValue := new(uint256.Int).Sub(new(uint256.Int).SetAllOne(), &v.BigValueThreshold)
+		return !val.Gt(maxSafeValue), nil
+	}
+	//下溢保护：声明为递减的变量，新值大于当前值说明 pre-0.8 的减法发生了下溢
+	if v.IfUnderflowProtect && v.IntendedDecrement && v.contains(loc) {
+		return !val.Gt(v.currentValue(loc, interpreter, scope)), nil
+	}
+	//enum：只检查写入的枚举值是否合法
+	if v.IfEnum && v.contains(loc) {
+		word := val.Bytes32()
+		for _, valid := range v.ValidEnumValues {
+			if word[v.PackageStart] == valid {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	//结构体：由各字段的规则决定，任一字段屏蔽则屏蔽
+	if v.IfStruct {
+		for i := 0; i < len(v.StructFields) && write; i++ {
+			var err error
+			if write, err = v.StructFields[i].shield(loc, val, interpreter, scope); err != nil {
+				return false, err
+			}
+		}
+		return write, nil
+	}
 	//如果是打包情况下
 	if v.IfPackage {
+		//未经 ValidateRule 校验（如在代码中构造）的规则也不能越过 slot 的 32 字节
+		if !v.packageInSlot() {
+			return false, errPackageOutsideSlot
+		}
 
 		//只有一个slot
-		if v.Slot.Contains(loc) {
+		if v.contains(loc) {
 			//将不是val的位置改为 0
 			//在SSLOAD时已将获取到的value的其他选定位置改为 0
 			valueothers := val.Bytes32()
@@ -185,17 +989,17 @@ func (v *Variable) Shield(loc uint256.Int, val uint256.Int, interpreter *EVMInte
 			for i := 0; i < v.PackageStart; i++ {
 
 				valueothers[i] = 0
-				v.OriginalValue[i] = 0
+				valueoriginal[i] = 0
 			}
 			for i := v.PackageStart + v.PackageSize; i < len(valueothers); i++ {
 				valueothers[i] = 0
-				v.OriginalValue[i] = 0
+				valueoriginal[i] = 0
 			}
 			res := bytes.Equal(valueothers[:], valueoriginal[:])
 			if !res {
 
 				write = false
-				return write
+				return write, nil
 
 			}
 
@@ -203,33 +1007,207 @@ func (v *Variable) Shield(loc uint256.Int, val uint256.Int, interpreter *EVMInte
 
 		//mapping类型：遍历slot[]集合。如果是嵌套，递归
 	} else if v.IfMapping {
-		if v.Slot.Contains(loc) {
+		if v.contains(loc) {
 			write = false
-			return write
+			return write, nil
 		}
 		if v.Deep != 0 {
-			for _, mapv := range v.MapValue {
-				write = mapv.Shield(loc, val, interpreter, scope)
-
+			for i := 0; i < len(v.MapValue) && write; i++ {
+				var err error
+				if write, err = v.MapValue[i].shield(loc, val, interpreter, scope); err != nil {
+					return false, err
+				}
 			}
 		}
 
 		//不是打包情况下，直接遍历整个slot集合
 	} else if v.IfDynamic {
-		//在此之前先更新Dynamic的slot集合
-		v.DynamicUpdate(interpreter, scope)
-
-		if v.Slot.Contains(loc) {
+		//slot 集合已在函数开始时更新
+		if v.contains(loc) {
 			write = false
-			return write
+			return write, nil
 		}
 	} else {
-		if v.Slot.Contains(loc) {
+		if v.contains(loc) {
 			write = false
-			return write
+			return write, nil
+		}
+	}
+	return write, nil
+}
+
+//【*】checkPostConditions 写入完成后检查变量的不变量，失败时报告但不撤销写入（gas 已经消耗）
+func (v *Variable) checkPostConditions(loc uint256.Int, val uint256.Int, interpreter *EVMInterpreter, scope *ScopeContext) {
+	if len(v.PostConditionFuncs) == 0 || !v.Slot.Contains(loc) {
+		return
+	}
+	for i, cond := range v.PostConditionFuncs {
+		if !cond(val, interpreter.evm.StateDB, scope.Contract.Address()) {
+			interpreter.emitViolation(scope, ShieldViolation{
+				Slot:   loc,
+				Value:  val,
+				Reason: fmt.Sprintf("post-condition %d of variable %q failed", i, v.Name),
+			})
+		}
+	}
+}
+
+//【*】当前链是否在规则的 ChainIDFilter 中
+func (c *Contract) chainIDActive(interpreter *EVMInterpreter) bool {
+	if len(c.ChainIDFilter) == 0 {
+		return true
+	}
+	chainID := interpreter.evm.ChainConfig().ChainID
+	for _, id := range c.ChainIDFilter {
+		if chainID.IsUint64() && chainID.Uint64() == id {
+			return true
+		}
+	}
+	return false
+}
+
+//【*】activeAt 区块时间 now 的 UTC 小时是否位于 ActiveHoursUTC 时段内
+func (v *Variable) activeAt(now *big.Int) bool {
+	start, end := v.ActiveHoursUTC[0], v.ActiveHoursUTC[1]
+	if start == end || now == nil || !now.IsUint64() {
+		return true
+	}
+	hour := uint8(now.Uint64() % 86400 / 3600)
+	if start < end {
+		return hour >= start && hour < end
+	}
+	return hour >= start || hour < end
+}
+
+//【*】本帧读取过 TIMESTAMP 时，写入 TimestampSensitiveSlots 要求区块时间在允许的窗口内
+func (c *Contract) timestampAllows(loc uint256.Int, interpreter *EVMInterpreter) bool {
+	if !c.timestampUsed {
+		return true
+	}
+	for _, slot := range c.TimestampSensitiveSlots {
+		if slot.Eq(&loc) {
+			now := interpreter.evm.Context.Time
+			return now.IsUint64() && now.Uint64() >= c.TimestampWindowStart && now.Uint64() <= c.TimestampWindowEnd
+		}
+	}
+	return true
+}
+
+//【*】valueAllowed 设置了 ExpectZeroValue 的函数只允许不附带 ETH 的调用写入
+func (c *Contract) valueAllowed() bool {
+	return !c.ExpectZeroValue || c.value == nil || c.value.Sign() == 0
+}
+
+//【*】callerAllowed 设置了 RequireOriginEqualsCaller 的函数只允许交易发起者直接调用时写入
+func (c *Contract) callerAllowed(interpreter *EVMInterpreter) bool {
+	return !c.RequireOriginEqualsCaller || interpreter.evm.TxContext.Origin == c.CallerAddress
+}
+
+//【*】本帧读取过 COINBASE 时，写入 CoinbaseSensitiveSlots 要求区块的出块者在 TrustedMiners 中
+func (c *Contract) coinbaseAllows(loc uint256.Int, interpreter *EVMInterpreter) bool {
+	if !c.coinbaseUsed {
+		return true
+	}
+	for _, slot := range c.CoinbaseSensitiveSlots {
+		if slot.Eq(&loc) {
+			coinbase := interpreter.evm.Context.Coinbase
+			for _, miner := range c.TrustedMiners {
+				if miner == coinbase {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return true
+}
+
+//【*】本帧读取过 BASEFEE 时，写入 BasefeeSensitiveSlots 要求区块的 basefee 在 [MinBasefee, MaxBasefee] 内
+func (c *Contract) basefeeAllows(loc uint256.Int, interpreter *EVMInterpreter) bool {
+	if !c.basefeeUsed {
+		return true
+	}
+	for _, slot := range c.BasefeeSensitiveSlots {
+		if slot.Eq(&loc) {
+			baseFee, _ := uint256.FromBig(interpreter.evm.Context.BaseFee)
+			return !baseFee.Lt(&c.MinBasefee) && (c.MaxBasefee.IsZero() || !baseFee.Gt(&c.MaxBasefee))
+		}
+	}
+	return true
+}
+
+//【*】checkBlockGasLimit 在 GASLIMIT 时调用：区块 gas 上限过低可能是攻击在为受害交易耗尽 gas 做准备
+func (c *Contract) checkBlockGasLimit(interpreter *EVMInterpreter, scope *ScopeContext) {
+	gasLimit := interpreter.evm.Context.GasLimit
+	if c.MinBlockGasLimit == 0 || gasLimit >= c.MinBlockGasLimit {
+		return
+	}
+	c.lowGasLimit = true
+	interpreter.emitViolation(scope, ShieldViolation{
+		Reason: fmt.Sprintf("block gas limit %d below MinBlockGasLimit %d", gasLimit, c.MinBlockGasLimit),
+	})
+}
+
+//【*】memoryWithinLimit 内存扩展后检查 MaxMemoryExpansion：内存的 gas 随大小二次增长，限制受保护合约被用来放大 gas 消耗
+func (c *Contract) memoryWithinLimit(mem *Memory) error {
+	if c != nil && c.MaxMemoryExpansion != 0 && uint64(mem.Len()) > c.MaxMemoryExpansion {
+		return ErrMemoryExpansionLimit
+	}
+	return nil
+}
+
+//【*】executesOwnCode 当前帧执行的是否是本合约地址自身的代码（或创建时的 initcode），
+// 而不是 DELEGATECALL / CALLCODE 借用的其他合约的代码
+func (c *Contract) executesOwnCode() bool {
+	return c.CodeAddr == nil || *c.CodeAddr == c.Address()
+}
+
+//【*】当前调用栈的顶端 N 帧是否正好是 RequiredCallPath
+func (v *Variable) callPathMatches(interpreter *EVMInterpreter) bool {
+	stack := interpreter.callStack
+	if len(stack) < len(v.RequiredCallPath) {
+		return false
+	}
+	stack = stack[len(stack)-len(v.RequiredCallPath):]
+	for i, addr := range v.RequiredCallPath {
+		if stack[i] != addr {
+			return false
 		}
 	}
-	return write
+	return true
+}
+
+//【*】读取 slot 当前存储的值
+func (v *Variable) currentValue(loc uint256.Int, interpreter *EVMInterpreter, scope *ScopeContext) *uint256.Int {
+	current := interpreter.evm.StateDB.GetState(scope.Contract.Address(), loc.Bytes32())
+	return new(uint256.Int).SetBytes(current.Bytes())
+}
+
+//【*】mapping 的 hash 布局
+const (
+	HashLayoutSolidity = "solidity" //keccak256(key ++ slot)
+	HashLayoutVyper    = "vyper"    //keccak256(slot ++ key)
+)
+
+//【*】mappingSlot 按变量的 HashLayout 从 SHA3 的输入中取出 mapping 的 slot，
+// 并按该布局用 slot 与 key 重新拼出原像，验证其 hash 与 hash 一致
+func (v *Variable) mappingSlot(preimage []byte, hash uint256.Int) (uint256.Int, bool) {
+	var slot uint256.Int
+	if len(preimage) < 32 {
+		return slot, false
+	}
+	var rebuilt []byte
+	if v.HashLayout == HashLayoutVyper {
+		key := preimage[32:]
+		slot.SetBytes(preimage[:32])
+		rebuilt = append(common.CopyBytes(preimage[:32]), key...)
+	} else {
+		key := preimage[:len(preimage)-32]
+		slot.SetBytes(preimage[len(preimage)-32:])
+		rebuilt = append(common.CopyBytes(key), preimage[len(preimage)-32:]...)
+	}
+	computed := crypto.Keccak256Hash(rebuilt)
+	return slot, hash.Eq(new(uint256.Int).SetBytes(computed[:]))
 }
 
 //【*】SHA3识别
@@ -237,6 +1215,26 @@ func (v *Variable) Shield(loc uint256.Int, val uint256.Int, interpreter *EVMInte
 //给定slot，寻找是否为要标记的mapping 变量
 //记录hash
 func (v *Variable) IdentifyMap(slot uint256.Int, hash uint256.Int, interpreter *EVMInterpreter, scope *ScopeContext) *Variable {
+	return v.identifyMap(slot, hash, interpreter, scope, nil)
+}
+
+//【*】visited 记录本次识别已经进入过的变量：MapValue 可能（因错误或恶意的规则）形成环或共享子节点，
+//再次遇到时直接返回，避免无限递归、重复加锁导致的死锁以及指数级的遍历。只有递归前才需要记录，首次递归时分配
+func (v *Variable) identifyMap(slot uint256.Int, hash uint256.Int, interpreter *EVMInterpreter, scope *ScopeContext, visited map[*Variable]struct{}) *Variable {
+	if _, ok := visited[v]; ok {
+		return v
+	}
+	v.Lock()
+	defer v.Unlock()
+
+	//结构体中的 mapping 字段
+	if v.IfStruct {
+		for i := range v.StructFields {
+			v.StructFields[i].identifyMap(slot, hash, interpreter, scope, visited)
+		}
+		return v
+	}
+
 	exist := false
 	//只在mapping类型里找。
 	if v.IfMapping {
@@ -257,29 +1255,50 @@ func (v *Variable) IdentifyMap(slot uint256.Int, hash uint256.Int, interpreter *
 						break
 					}
 				}
-				//如果不存在则添加
+				//如果不存在则添加，添加前清理过期的记录
 				if !exist {
-					var deepvariable Variable
+					number := v.pruneMapValue(interpreter)
+
+					deepvariable := new(Variable)
 					deepvariable.Deep = v.Deep - 1
 					deepvariable.MappingStart = hash
 					deepvariable.IfMapping = true
 
-					deepvariable.Slot = mapset.NewSet(hash)
+					deepvariable.Slot = NewSlotSet(hash)
 
 					deepvariable.MappingValueType = v.MappingValueType
+					deepvariable.HashLayout = v.HashLayout
+					deepvariable.IfUnderflowProtect = v.IfUnderflowProtect
+					deepvariable.IntendedDecrement = v.IntendedDecrement
+					deepvariable.IfBigValueProtect = v.IfBigValueProtect
+					deepvariable.BigValueThreshold = v.BigValueThreshold
+					deepvariable.IfProtectDelete = v.IfProtectDelete
+					deepvariable.IfProtectUpdate = v.IfProtectUpdate
+					deepvariable.IfMonotonicIncrease = v.IfMonotonicIncrease
+					deepvariable.OnlyDecrease = v.OnlyDecrease
+					deepvariable.MaxDeltaPercent = v.MaxDeltaPercent
+					deepvariable.ConservedBalance = v.ConservedBalance
+					deepvariable.MapEntryTTLBlocks = v.MapEntryTTLBlocks
+					deepvariable.discoverBlockNumber = number
 					v.MapValue = append(v.MapValue, deepvariable)
+					//中间层的 hash 同时记录在本层：本层的 slot 集合包含变量在各嵌套层的所有位置
+					v.Slot.Add(hash)
+					GlobalStats.addMappingUpdate()
 					return v
 				}
 
 			}
 
 			//如果不是嵌套mapping,或者已经到最后一层：存储 mapping 的 Value 对应的 hash
+			//hash 的原像（key ++ slot）已由 KECCAK256 在 EnablePreimageRecording 时记录，
+			//这里只知道 slot，不能把它当作原像再记录一次
 			if v.Deep == 0 {
 				v.Slot.Add(hash)
+				GlobalStats.addMappingUpdate()
 				if v.MappingValueType == "Dynamic" {
 					v.DynamicStart = hash
 					v.IfDynamic = true
-					v.DynamicUpdate(interpreter, scope)
+					v.dynamicUpdate(interpreter, scope)
 					//获取数组、string长度，计算所有slot
 					//添加到 slot集合中
 					//调用动态变量的情况下，更新列表的算法
@@ -292,8 +1311,12 @@ func (v *Variable) IdentifyMap(slot uint256.Int, hash uint256.Int, interpreter *
 
 			if count != 0 {
 				count--
+				if visited == nil {
+					visited = make(map[*Variable]struct{})
+				}
+				visited[v] = struct{}{}
 				for i := 0; i < len(v.MapValue); i++ {
-					v.MapValue[i].IdentifyMap(slot, hash, interpreter, scope)
+					v.MapValue[i].identifyMap(slot, hash, interpreter, scope, visited)
 					// fmt.Println(v.MapValue[i])
 
 				}
@@ -304,10 +1327,55 @@ func (v *Variable) IdentifyMap(slot uint256.Int, hash uint256.Int, interpreter *
 	return v
 }
 
-//【*】 动态类型的对象成员更新
-func (v *Variable) DynamicUpdate(interpreter *EVMInterpreter, scope *ScopeContext) *Variable {
+//【*】withinDeltaPercent 判断 current -> next 的变化量是否不超过 current 的 percent%
+func withinDeltaPercent(current, next *uint256.Int, percent uint64) bool {
+	if current.IsZero() {
+		return true
+	}
+	delta := new(big.Int).Sub(next.ToBig(), current.ToBig())
+	delta.Abs(delta).Mul(delta, big.NewInt(100))
+	limit := new(big.Int).Mul(current.ToBig(), new(big.Int).SetUint64(percent))
+	return delta.Cmp(limit) <= 0
+}
+
+//【*】pruneMapValue 删除发现时间早于 MapEntryTTLBlocks 个区块的下一层记录，返回当前区块号。
+// 被删除的记录在 SHA3 再次计算到时会重新发现。调用方需持有写锁
+func (v *Variable) pruneMapValue(interpreter *EVMInterpreter) uint64 {
+	//编译期预计算时没有区块上下文
+	if interpreter == nil {
+		return 0
+	}
+	number := interpreter.evm.Context.BlockNumber.Uint64()
+	if v.MapEntryTTLBlocks == 0 {
+		return number
+	}
+	live := v.MapValue[:0]
+	for _, deep := range v.MapValue {
+		if deep.discoverBlockNumber+v.MapEntryTTLBlocks >= number {
+			live = append(live, deep)
+		} else {
+			v.Slot.Remove(deep.MappingStart)
+		}
+	}
+	for i := len(live); i < len(v.MapValue); i++ {
+		v.MapValue[i] = nil
+	}
+	v.MapValue = live
+	return number
+}
+
+//【*】 动态类型的对象成员更新。读取状态出错或执行被中断时 slot 集合不完整，返回错误
+func (v *Variable) DynamicUpdate(interpreter *EVMInterpreter, scope *ScopeContext) (*Variable, error) {
+	v.Lock()
+	defer v.Unlock()
+
+	return v.dynamicUpdate(interpreter, scope)
+}
 
+//【*】dynamicUpdate 是 DynamicUpdate 的无锁版本，调用方需持有写锁
+func (v *Variable) dynamicUpdate(interpreter *EVMInterpreter, scope *ScopeContext) (*Variable, error) {
 	if v.IfDynamic {
+		GlobalStats.addDynamicUpdate()
 
 		if interpreter.hasher == nil {
 			interpreter.hasher = crypto.NewKeccakState()
@@ -324,29 +1392,88 @@ func (v *Variable) DynamicUpdate(interpreter *EVMInterpreter, scope *ScopeContex
 
 		hash := common.BytesToHash(interpreter.hasherBuf[:]).Bytes()
 
-		v.GetDynamicSlot(hash, interpreter, scope)
-
+		//预先加载可能访问到的 slot，GetDynamicSlot 逐个读取时直接命中缓存
+		if prefetcher, ok := evm.StateDB.(TriePrefetcher); ok {
+			v.PrefetchDynamicSlots(scope.Contract.Address(), prefetcher, hash)
+		}
+		if _, err := v.GetDynamicSlot(hash, interpreter, scope); err != nil {
+			return v, err
+		}
+		//state.StateDB 记录读取 trie 时遇到的第一个错误
+		if db, ok := evm.StateDB.(interface{ Error() error }); ok && db.Error() != nil {
+			return v, fmt.Errorf("%w: %v", ErrIncompleteDynamicSlots, db.Error())
+		}
 	}
-	return v
+	return v, nil
 }
 
-//【*】
-func (v *Variable) GetDynamicSlot(first []byte, interpreter *EVMInterpreter, scope *ScopeContext) *Variable {
-	var uintTemp uint256.Int
-	uintTemp.SetBytes(first)
-	val := interpreter.evm.StateDB.GetState(scope.Contract.Address(), common.BytesToHash(first)).Bytes()
+//【*】PrefetchDynamicSlots 预取从 first 开始的 slot：已知的长度再加上一个预读窗口
+func (v *Variable) PrefetchDynamicSlots(addr common.Address, prefetcher TriePrefetcher, first []byte) {
+	count := v.Slot.Cardinality() + dynamicPrefetchWindow
+	slots := make([]common.Hash, count)
 
-	if val != nil {
-		v.Slot.Add(uintTemp)
-		uintTemp.Add(&uintTemp, uint256.NewInt(1))
-		first = uintTemp.Bytes()
+	var slot uint256.Int
+	slot.SetBytes(first)
+	for i := range slots {
+		slots[i] = slot.Bytes32()
+		slot.AddUint64(&slot, 1)
+	}
+	prefetcher.PrefetchStorage(addr, slots)
+}
 
-		return v.GetDynamicSlot(first, interpreter, scope)
+//【*】GetDynamicSlot 从 first 开始逐个读取 slot 并加入集合，直到读到 0 值。
+// 最多读取 MaxDynamicSlots 个，超过时返回错误，防止恶意合约造成无限循环
+func (v *Variable) GetDynamicSlot(first []byte, interpreter *EVMInterpreter, scope *ScopeContext) (*Variable, error) {
+	limit := v.MaxDynamicSlots
+	if limit == 0 {
+		limit = defaultMaxDynamicSlots
+	}
+	var slot uint256.Int
+	slot.SetBytes(first)
+	for count := 0; ; count++ {
+		if interpreter.evm.StateDB.GetState(scope.Contract.Address(), slot.Bytes32()) == (common.Hash{}) {
+			return v, nil
+		}
+		if count >= limit {
+			return v, fmt.Errorf("%w: more than %d slots", ErrIncompleteDynamicSlots, limit)
+		}
+		//执行被中断时停止读取
+		if interpreter.evm.Cancelled() {
+			return v, ErrIncompleteDynamicSlots
+		}
+		v.Slot.Add(slot)
+		slot.AddUint64(&slot, 1)
+	}
+}
 
-	} else {
-		return v
+//【*】AllowCheck 白名单检查：FunctionAllow 不为空时，只允许写入其中某个变量的 slot。
+// 在 Shield 放行之后调用，黑名单与白名单可以组合使用
+func (c *Contract) AllowCheck(loc uint256.Int) bool {
+	if len(c.FunctionAllow) == 0 {
+		return true
 	}
+	for i := 0; i < len(c.FunctionAllow); i++ {
+		if c.FunctionAllow[i].allows(loc) {
+			return true
+		}
+	}
+	return false
+}
 
+//【*】allows 变量（包括嵌套 mapping 的下一层）是否包含该 slot
+func (v *Variable) allows(loc uint256.Int) bool {
+	v.RLock()
+	defer v.RUnlock()
+
+	if v.Slot.Contains(loc) {
+		return true
+	}
+	for i := 0; i < len(v.MapValue); i++ {
+		if v.MapValue[i].allows(loc) {
+			return true
+		}
+	}
+	return false
 }
 
 //【*】FunctionAllow 正常运行时更新 mapping 、Dynamic
@@ -429,6 +1556,10 @@ func (c *Contract) AsDelegate() *Contract {
 	parent := c.caller.(*Contract)
 	c.CallerAddress = parent.CallerAddress
 	c.value = parent.value
+	//【*】委托调用沿用调用方已加载的规则，存储与规则都属于调用方
+	if parent.matchedSelector != "" {
+		c.WithShieldInherited(parent)
+	}
 
 	return c
 }
@@ -471,10 +1602,57 @@ func (c *Contract) Value() *big.Int {
 
 // SetCallCode sets the code of the contract and address of the backing data
 // object
-func (c *Contract) SetCallCode(addr *common.Address, hash common.Hash, code []byte) {
+//
+//【*】代码中包含规则禁止的字节序列（如 PUSH20 <攻击者地址>）时报告违规，enforce 模式下拒绝设置，返回 ErrForbiddenBytecodePattern；
+//PUSH32 压入规则禁止的常量时同样报告，enforce 模式下返回 ErrForbiddenConstantValue
+func (c *Contract) SetCallCode(addr *common.Address, hash common.Hash, code []byte, interpreter *EVMInterpreter) error {
+	for i, pattern := range c.ForbiddenBytecodePatterns {
+		if len(pattern) != 0 && bytes.Index(code, pattern) >= 0 {
+			if c.blockCode(fmt.Sprintf("code contains ForbiddenBytecodePatterns[%d]", i), interpreter) {
+				return ErrForbiddenBytecodePattern
+			}
+			break
+		}
+	}
+	if i, found := c.pushesForbiddenConstant(code); found && c.blockCode(fmt.Sprintf("code pushes ForbiddenConstantValues[%d]", i), interpreter) {
+		return ErrForbiddenConstantValue
+	}
 	c.Code = code
 	c.CodeHash = hash
 	c.CodeAddr = addr
+	return nil
+}
+
+//【*】blockCode 报告规则禁止的代码，返回是否拒绝：审计模式只报告
+func (c *Contract) blockCode(reason string, interpreter *EVMInterpreter) bool {
+	enforce := interpreter.cfg.ShieldMode == ShieldModeEnforce
+	interpreter.emitViolation(&ScopeContext{Contract: c}, ShieldViolation{Reason: reason, Blocked: enforce})
+	return enforce
+}
+
+//【*】按指令遍历代码（跳过 push 数据，避免把数据误认为操作码），检查是否有 PUSH32 压入禁止的常量，返回第一个被压入的常量的下标
+func (c *Contract) pushesForbiddenConstant(code []byte) (int, bool) {
+	if len(c.ForbiddenConstantValues) == 0 {
+		return 0, false
+	}
+	for pc := 0; pc < len(code); pc++ {
+		op := OpCode(code[pc])
+		if !op.IsPush() {
+			continue
+		}
+		size := int(op - PUSH1 + 1)
+		if op == PUSH32 {
+			var value uint256.Int
+			value.SetBytes(getData(code, uint64(pc+1), 32))
+			for i := range c.ForbiddenConstantValues {
+				if value.Eq(&c.ForbiddenConstantValues[i]) {
+					return i, true
+				}
+			}
+		}
+		pc += size
+	}
+	return 0, false
 }
 
 // SetCodeOptionalHash can be used to provide code, but it's optional to provide hash.
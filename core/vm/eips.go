@@ -173,6 +173,8 @@ func enable3198(jt *JumpTable) {
 func opBaseFee(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
 	baseFee, _ := uint256.FromBig(interpreter.evm.Context.BaseFee)
 	scope.Stack.push(baseFee)
+	//【*】记录本帧使用了区块 basefee
+	scope.Contract.basefeeUsed = true
 	return nil, nil
 }
 
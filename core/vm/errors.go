@@ -36,6 +36,11 @@ var (
 	ErrGasUintOverflow          = errors.New("gas uint64 overflow")
 	ErrInvalidCode              = errors.New("invalid code: must not begin with 0xef")
 	ErrNonceUintOverflow        = errors.New("nonce uint64 overflow")
+	ErrForbiddenBytecodePattern = errors.New("code contains a forbidden bytecode pattern")
+	ErrIncompleteDynamicSlots   = errors.New("dynamic variable slot set is incomplete")
+	ErrForbiddenConstantValue   = errors.New("code pushes a forbidden constant value")
+	ErrPostStateRootMismatch    = errors.New("post-state root mismatch")
+	ErrMemoryExpansionLimit     = errors.New("memory expansion exceeds the shield limit")
 
 	// errStopToken is an internal token indicating interpreter loop termination,
 	// never returned to outside callers.
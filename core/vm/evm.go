@@ -22,7 +22,9 @@ import (
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/params"
 	"github.com/holiman/uint256"
 )
@@ -84,6 +86,8 @@ type TxContext struct {
 	// Message information
 	Origin   common.Address // Provides information for ORIGIN
 	GasPrice *big.Int       // Provides information for GASPRICE
+
+	AccessList types.AccessList // 【*】EIP-2930 access list declared by the transaction
 }
 
 // EVM is the Ethereum Virtual Machine base object and provides
@@ -161,6 +165,24 @@ func (evm *EVM) Interpreter() *EVMInterpreter {
 	return evm.interpreter
 }
 
+//【*】loadRule 在执行前加载规则。规则文件配置错误时屏蔽无法生效，记录错误，调用方中止执行而不是在没有屏蔽的情况下继续。
+//规则按 calldata 的函数选择器匹配，而 Input 要到 Run 中才设置，这里先设置
+func loadRule(contract *Contract, input []byte) error {
+	contract.Input = input
+	if _, err := contract.NewRule(); err != nil {
+		log.Error("Failed to load shield rule", "contract", contract.Address(), "err", err)
+		return err
+	}
+	return nil
+}
+
+//【*】writeRule 在调用结束后写回规则。执行结果已经确定，写入失败只记录，不影响执行
+func writeRule(contract *Contract) {
+	if err := contract.Write(); err != nil {
+		log.Error("Failed to write shield rule", "contract", contract.Address(), "err", err)
+	}
+}
+
 // Call executes the contract associated with the addr with the given input as
 // parameters. It also handles any necessary value transfer required and takes
 // the necessary steps to create accounts and reverses the state in case of an
@@ -175,7 +197,7 @@ func (evm *EVM) Call(caller ContractRef, addr common.Address, input []byte, gas
 		return nil, gas, ErrInsufficientBalance
 	}
 	snapshot := evm.StateDB.Snapshot()
-	p, isPrecompile := evm.precompile(addr)
+	p, isPrecompile := evm.shieldedPrecompile(caller, addr)
 
 	if !evm.StateDB.Exist(addr) {
 		if !isPrecompile && evm.chainRules.IsEIP158 && value.Sign() == 0 {
@@ -224,13 +246,15 @@ func (evm *EVM) Call(caller ContractRef, addr common.Address, input []byte, gas
 			// If the account has no code, we can abort here
 			// The depth-check is already done, and precompiles handled above
 			contract := NewContract(caller, AccountRef(addrCopy), value, gas)
-			//【*】加载Rule
-			contract.NewRule()
-			contract.SetCallCode(&addrCopy, evm.StateDB.GetCodeHash(addrCopy), code)
-			ret, err = evm.interpreter.Run(contract, input, false)
-			gas = contract.Gas
-			//【*】更新Rule
-			contract.Write()
+			if err = contract.SetCallCode(&addrCopy, evm.StateDB.GetCodeHash(addrCopy), code, evm.interpreter); err == nil {
+				//【*】加载Rule，规则文件配置错误时屏蔽失效，不执行
+				if err = loadRule(contract, input); err == nil {
+					ret, err = evm.interpreter.Run(contract, input, false)
+					gas = contract.Gas
+					//【*】更新Rule
+					writeRule(contract)
+				}
+			}
 
 		}
 	}
@@ -279,20 +303,22 @@ func (evm *EVM) CallCode(caller ContractRef, addr common.Address, input []byte,
 	}
 
 	// It is allowed to call precompiles, even via delegatecall
-	if p, isPrecompile := evm.precompile(addr); isPrecompile {
+	if p, isPrecompile := evm.shieldedPrecompile(caller, addr); isPrecompile {
 		ret, gas, err = RunPrecompiledContract(p, input, gas)
 	} else {
 		addrCopy := addr
 		// Initialise a new contract and set the code that is to be used by the EVM.
 		// The contract is a scoped environment for this execution context only.
 		contract := NewContract(caller, AccountRef(caller.Address()), value, gas)
-		//【*】
-		contract.NewRule()
-		contract.SetCallCode(&addrCopy, evm.StateDB.GetCodeHash(addrCopy), evm.StateDB.GetCode(addrCopy))
-		ret, err = evm.interpreter.Run(contract, input, false)
-		gas = contract.Gas
-		//【*】
-		contract.Write()
+		if err = contract.SetCallCode(&addrCopy, evm.StateDB.GetCodeHash(addrCopy), evm.StateDB.GetCode(addrCopy), evm.interpreter); err == nil {
+			//【*】
+			if err = loadRule(contract, input); err == nil {
+				ret, err = evm.interpreter.Run(contract, input, false)
+				gas = contract.Gas
+				//【*】
+				writeRule(contract)
+			}
+		}
 	}
 	if err != nil {
 		evm.StateDB.RevertToSnapshot(snapshot)
@@ -324,19 +350,26 @@ func (evm *EVM) DelegateCall(caller ContractRef, addr common.Address, input []by
 	}
 
 	// It is allowed to call precompiles, even via delegatecall
-	if p, isPrecompile := evm.precompile(addr); isPrecompile {
+	if p, isPrecompile := evm.shieldedPrecompile(caller, addr); isPrecompile {
 		ret, gas, err = RunPrecompiledContract(p, input, gas)
 	} else {
 		addrCopy := addr
 		// Initialise a new contract and make initialise the delegate values
+		//【*】AsDelegate 在设置代码之前继承调用方已加载的规则，
+		//使代理合约的 ForbiddenBytecodePatterns 作用于被委托的实现合约
 		contract := NewContract(caller, AccountRef(caller.Address()), nil, gas).AsDelegate()
-		//【*】
-		contract.NewRule()
-		contract.SetCallCode(&addrCopy, evm.StateDB.GetCodeHash(addrCopy), evm.StateDB.GetCode(addrCopy))
-		ret, err = evm.interpreter.Run(contract, input, false)
-		gas = contract.Gas
-		//【*】
-		contract.Write()
+		parent := caller.(*Contract)
+		if err = contract.SetCallCode(&addrCopy, evm.StateDB.GetCodeHash(addrCopy), evm.StateDB.GetCode(addrCopy), evm.interpreter); err == nil {
+			if parent.matchedSelector == "" {
+				err = loadRule(contract, input)
+			}
+			if err == nil {
+				ret, err = evm.interpreter.Run(contract, input, false)
+				gas = contract.Gas
+				//【*】
+				writeRule(contract)
+			}
+		}
 	}
 	if err != nil {
 		evm.StateDB.RevertToSnapshot(snapshot)
@@ -377,7 +410,7 @@ func (evm *EVM) StaticCall(caller ContractRef, addr common.Address, input []byte
 		}(gas)
 	}
 
-	if p, isPrecompile := evm.precompile(addr); isPrecompile {
+	if p, isPrecompile := evm.shieldedPrecompile(caller, addr); isPrecompile {
 		ret, gas, err = RunPrecompiledContract(p, input, gas)
 	} else {
 		// At this point, we use a copy of address. If we don't, the go compiler will
@@ -387,16 +420,18 @@ func (evm *EVM) StaticCall(caller ContractRef, addr common.Address, input []byte
 		// Initialise a new contract and set the code that is to be used by the EVM.
 		// The contract is a scoped environment for this execution context only.
 		contract := NewContract(caller, AccountRef(addrCopy), new(big.Int), gas)
-		//【*】
-		contract.NewRule()
-		contract.SetCallCode(&addrCopy, evm.StateDB.GetCodeHash(addrCopy), evm.StateDB.GetCode(addrCopy))
-		// When an error was returned by the EVM or when setting the creation code
-		// above we revert to the snapshot and consume any gas remaining. Additionally
-		// when we're in Homestead this also counts for code storage gas errors.
-		ret, err = evm.interpreter.Run(contract, input, true)
-		gas = contract.Gas
-		//【*】
-		contract.Write()
+		if err = contract.SetCallCode(&addrCopy, evm.StateDB.GetCodeHash(addrCopy), evm.StateDB.GetCode(addrCopy), evm.interpreter); err == nil {
+			//【*】
+			if err = loadRule(contract, input); err == nil {
+				// When an error was returned by the EVM or when setting the creation code
+				// above we revert to the snapshot and consume any gas remaining. Additionally
+				// when we're in Homestead this also counts for code storage gas errors.
+				ret, err = evm.interpreter.Run(contract, input, true)
+				gas = contract.Gas
+				//【*】
+				writeRule(contract)
+			}
+		}
 	}
 	if err != nil {
 		evm.StateDB.RevertToSnapshot(snapshot)
@@ -467,7 +502,14 @@ func (evm *EVM) create(caller ContractRef, codeAndHash *codeAndHash, gas uint64,
 
 	start := time.Now()
 
+	//【*】构造期间 EXTCODESIZE 返回 initcode 长度
+	if evm.Config.CorrectExtcodesizeInConstruction {
+		evm.interpreter.enterConstruction(address, len(contract.Code))
+	}
 	ret, err := evm.interpreter.Run(contract, nil, false)
+	if evm.Config.CorrectExtcodesizeInConstruction {
+		evm.interpreter.exitConstruction(address)
+	}
 
 	// Check whether the max code size has been exceeded, assign err if the case.
 	if err == nil && evm.chainRules.IsEIP158 && len(ret) > params.MaxCodeSize {
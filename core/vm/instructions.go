@@ -270,9 +270,22 @@ func opKeccak256(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) (
 
 	//【*】。。。。。。
 	hash.SetBytes(interpreter.hasherBuf[:])
-	for i := 0; i < len(scope.Contract.FunctionShield); i++ {
-		scope.Contract.FunctionShield[i].IdentifyMap(v2, hash, interpreter, scope)
-		scope.Contract.FunctionShield[i].IdentifyMap(v3, hash, interpreter, scope)
+	scope.Contract.recordPreimage(interpreter.hasherBuf, data)
+	scope.Contract.monitorHashInput(data, interpreter, scope)
+	scope.Contract.propagateTaint(data, &hash)
+	//【*】屏蔽与白名单中的 mapping 都需要识别
+	for _, variables := range [][]Variable{scope.Contract.FunctionShield, scope.Contract.FunctionAllow} {
+		for i := 0; i < len(variables); i++ {
+			//【*】Vyper 的 mapping slot 在输入的开头
+			if variables[i].HashLayout == HashLayoutVyper {
+				if slot, ok := variables[i].mappingSlot(data, hash); ok {
+					variables[i].IdentifyMap(slot, hash, interpreter, scope)
+				}
+				continue
+			}
+			variables[i].IdentifyMap(v2, hash, interpreter, scope)
+			variables[i].IdentifyMap(v3, hash, interpreter, scope)
+		}
 	}
 
 	// for _, variable := range scope.Contract.FunctionShield {
@@ -327,6 +340,10 @@ func opCallDataSize(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext
 }
 
 func opCallDataCopy(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
+	//【*】内存已按本指令扩展
+	if err := scope.Contract.memoryWithinLimit(scope.Memory); err != nil {
+		return nil, err
+	}
 	var (
 		memOffset  = scope.Stack.pop()
 		dataOffset = scope.Stack.pop()
@@ -350,6 +367,10 @@ func opReturnDataSize(pc *uint64, interpreter *EVMInterpreter, scope *ScopeConte
 }
 
 func opReturnDataCopy(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
+	//【*】内存已按本指令扩展
+	if err := scope.Contract.memoryWithinLimit(scope.Memory); err != nil {
+		return nil, err
+	}
 	var (
 		memOffset  = scope.Stack.pop()
 		dataOffset = scope.Stack.pop()
@@ -373,6 +394,13 @@ func opReturnDataCopy(pc *uint64, interpreter *EVMInterpreter, scope *ScopeConte
 
 func opExtCodeSize(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
 	slot := scope.Stack.peek()
+	//【*】构造中的合约还没有代码，返回 initcode 长度，避免被当作外部账户
+	if interpreter.cfg.CorrectExtcodesizeInConstruction {
+		if size, ok := interpreter.constructionCodeSize(slot.Bytes20()); ok {
+			slot.SetUint64(size)
+			return nil, nil
+		}
+	}
 	slot.SetUint64(uint64(interpreter.evm.StateDB.GetCodeSize(slot.Bytes20())))
 	return nil, nil
 }
@@ -394,7 +422,13 @@ func opCodeCopy(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([
 	if overflow {
 		uint64CodeOffset = 0xffffffffffffffff
 	}
-	codeCopy := getData(scope.Contract.Code, uint64CodeOffset, length.Uint64())
+	var codeCopy []byte
+	//【*】复制本合约自身代码时以零填充代替；审计模式下不改变执行
+	if scope.Contract.BlockCodecopyToMemory && scope.Contract.executesOwnCode() && interpreter.cfg.ShieldMode == ShieldModeEnforce {
+		codeCopy = make([]byte, length.Uint64())
+	} else {
+		codeCopy = getData(scope.Contract.Code, uint64CodeOffset, length.Uint64())
+	}
 	scope.Memory.Set(memOffset.Uint64(), length.Uint64(), codeCopy)
 
 	return nil, nil
@@ -413,7 +447,13 @@ func opExtCodeCopy(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext)
 		uint64CodeOffset = 0xffffffffffffffff
 	}
 	addr := common.Address(a.Bytes20())
-	codeCopy := getData(interpreter.evm.StateDB.GetCode(addr), uint64CodeOffset, length.Uint64())
+	var codeCopy []byte
+	//【*】受保护合约的字节码不允许被复制，以零填充代替；审计模式下不改变执行
+	if rule := interpreter.cfg.ShieldRegistry.Rule(addr); rule != nil && rule.BlockExtcodecopy && interpreter.cfg.ShieldMode == ShieldModeEnforce {
+		codeCopy = make([]byte, length.Uint64())
+	} else {
+		codeCopy = getData(interpreter.evm.StateDB.GetCode(addr), uint64CodeOffset, length.Uint64())
+	}
 	scope.Memory.Set(memOffset.Uint64(), length.Uint64(), codeCopy)
 
 	return nil, nil
@@ -478,6 +518,8 @@ func opBlockhash(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) (
 	}
 	if num64 >= lower && num64 < upper {
 		num.SetBytes(interpreter.evm.Context.GetHash(num64).Bytes())
+		//【*】
+		scope.Contract.taintBlockhash(num)
 	} else {
 		num.Clear()
 	}
@@ -486,12 +528,18 @@ func opBlockhash(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) (
 
 func opCoinbase(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
 	scope.Stack.push(new(uint256.Int).SetBytes(interpreter.evm.Context.Coinbase.Bytes()))
+	//【*】记录本帧使用了区块 coinbase
+	scope.Contract.coinbaseUsed = true
+	scope.Contract.snapshotEthBalances(interpreter)
+	scope.Contract.checkEthBalances(interpreter, scope)
 	return nil, nil
 }
 
 func opTimestamp(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
 	v, _ := uint256.FromBig(interpreter.evm.Context.Time)
 	scope.Stack.push(v)
+	//【*】记录本帧使用了区块时间
+	scope.Contract.timestampUsed = true
 	return nil, nil
 }
 
@@ -515,6 +563,8 @@ func opRandom(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]b
 
 func opGasLimit(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
 	scope.Stack.push(new(uint256.Int).SetUint64(interpreter.evm.Context.GasLimit))
+	//【*】
+	scope.Contract.checkBlockGasLimit(interpreter, scope)
 	return nil, nil
 }
 
@@ -531,6 +581,10 @@ func opMload(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]by
 }
 
 func opMstore(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
+	//【*】内存已按本指令扩展
+	if err := scope.Contract.memoryWithinLimit(scope.Memory); err != nil {
+		return nil, err
+	}
 	// pop value of the stack
 	mStart, val := scope.Stack.pop(), scope.Stack.pop()
 	scope.Memory.Set32(mStart.Uint64(), &val)
@@ -538,6 +592,10 @@ func opMstore(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]b
 }
 
 func opMstore8(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
+	//【*】内存已按本指令扩展
+	if err := scope.Contract.memoryWithinLimit(scope.Memory); err != nil {
+		return nil, err
+	}
 	off, val := scope.Stack.pop(), scope.Stack.pop()
 	scope.Memory.store[off.Uint64()] = byte(val.Uint64())
 	return nil, nil
@@ -551,12 +609,17 @@ func opSload(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]by
 
 	//【*】打包情况下，记录
 	//因为mapping的 valuetype 不可能是打包变量
-	var value uint256.Int
+	var value, slot uint256.Int
 	value.SetBytes(val.Bytes())
+	slot.SetBytes(hash.Bytes())
+	//【*】读取本交易已经写过的 slot
+	interpreter.checkReadAfterWrite(scope, slot, value)
 	for i := 0; i < len(scope.Contract.FunctionShield); i++ {
 		if scope.Contract.FunctionShield[i].IfPackage {
-			if scope.Contract.FunctionShield[i].Slot.Contains(loc) {
+			if scope.Contract.FunctionShield[i].Slot.Contains(slot) {
+				scope.Contract.FunctionShield[i].Lock()
 				scope.Contract.FunctionShield[i].OriginalValue = value
+				scope.Contract.FunctionShield[i].Unlock()
 			}
 		}
 	}
@@ -571,20 +634,9 @@ func opSstore(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]b
 	loc := scope.Stack.pop()
 	val := scope.Stack.pop()
 
-	//【*】遍历每个要屏蔽的变量
-	var write bool
-
-	for _, variable := range scope.Contract.FunctionShield {
-		write = variable.Shield(loc, val, interpreter, scope)
-		if write == false {
-			break
-		}
-	}
-
-	if write {
-		interpreter.evm.StateDB.SetState(scope.Contract.Address(), loc.Bytes32(), val.Bytes32())
-	}
-	return nil, nil
+	//【*】写入只能经由 ShieldedContract，屏蔽检查不可绕过
+	sc := ShieldedContract{Contract: scope.Contract, registry: interpreter.cfg.ShieldRegistry}
+	return sc.sstore(loc, val, interpreter, scope)
 
 }
 
@@ -629,7 +681,12 @@ func opMsize(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]by
 }
 
 func opGas(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
-	scope.Stack.push(new(uint256.Int).SetUint64(scope.Contract.Gas))
+	gas := scope.Contract.Gas
+	//【*】只向合约报告规则设定的最低 gas，防止利用 gasleft() 检查绕过；审计模式下不改变执行
+	if floor := scope.Contract.MinGasFloor; floor != 0 && gas > floor && interpreter.cfg.ShieldMode == ShieldModeEnforce {
+		gas = floor
+	}
+	scope.Stack.push(new(uint256.Int).SetUint64(gas))
 	return nil, nil
 }
 
@@ -643,6 +700,13 @@ func opCreate(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]b
 		input        = scope.Memory.GetCopy(int64(offset.Uint64()), int64(size.Uint64()))
 		gas          = scope.Contract.Gas
 	)
+	//【*】initcode 过大时创建失败
+	if !scope.Contract.childCodeAllowed(uint64(len(input)), interpreter, scope) {
+		size.Clear()
+		scope.Stack.push(&size)
+		interpreter.returnData = nil
+		return nil, nil
+	}
 	if interpreter.evm.chainRules.IsEIP150 {
 		gas -= gas / 64
 	}
@@ -690,6 +754,13 @@ func opCreate2(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]
 		input        = scope.Memory.GetCopy(int64(offset.Uint64()), int64(size.Uint64()))
 		gas          = scope.Contract.Gas
 	)
+	//【*】initcode 过大时创建失败
+	if !scope.Contract.childCodeAllowed(uint64(len(input)), interpreter, scope) {
+		size.Clear()
+		scope.Stack.push(&size)
+		interpreter.returnData = nil
+		return nil, nil
+	}
 
 	// Apply EIP150
 	gas -= gas / 64
@@ -742,9 +813,15 @@ func opCall(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byt
 	if !value.IsZero() {
 		gas += params.CallStipend
 		bigVal = value.ToBig()
+
+		//【*】收款地址不在白名单中时改为转入 SafeVault
+		toAddr = scope.Contract.ethRecipient(toAddr, interpreter, scope)
 	}
 
+	//【*】
+	scope.Contract.snapshotEthBalances(interpreter)
 	ret, returnGas, err := interpreter.evm.Call(scope.Contract, toAddr, args, gas, bigVal)
+	scope.Contract.checkEthBalances(interpreter, scope)
 
 	if err != nil {
 		temp.Clear()
@@ -808,7 +885,10 @@ func opDelegateCall(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext
 	// Get arguments from the memory.
 	args := scope.Memory.GetPtr(int64(inOffset.Uint64()), int64(inSize.Uint64()))
 
+	//【*】记录调用栈中 DELEGATECALL 的层数
+	interpreter.delegateDepth++
 	ret, returnGas, err := interpreter.evm.DelegateCall(scope.Contract, toAddr, args, gas)
+	interpreter.delegateDepth--
 	if err != nil {
 		temp.Clear()
 	} else {
@@ -863,6 +943,9 @@ func opRevert(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]b
 	offset, size := scope.Stack.pop(), scope.Stack.pop()
 	ret := scope.Memory.GetPtr(int64(offset.Uint64()), int64(size.Uint64()))
 
+	//【*】解码受保护函数的 revert 原因
+	scope.Contract.analyzeRevert(ret, interpreter, scope)
+
 	interpreter.returnData = ret
 	return ret, ErrExecutionReverted
 }
@@ -879,12 +962,17 @@ func opSelfdestruct(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext
 	if interpreter.readOnly {
 		return nil, ErrWriteProtection
 	}
-	beneficiary := scope.Stack.pop()
+	stackBeneficiary := scope.Stack.pop()
+	//【*】受益人不在允许列表中时改为转给允许的地址
+	beneficiary := scope.Contract.selfDestructBeneficiary(stackBeneficiary.Bytes20(), interpreter, scope)
+	scope.Contract.snapshotEthBalances(interpreter)
 	balance := interpreter.evm.StateDB.GetBalance(scope.Contract.Address())
-	interpreter.evm.StateDB.AddBalance(beneficiary.Bytes20(), balance)
+	interpreter.evm.StateDB.AddBalance(beneficiary, balance)
 	interpreter.evm.StateDB.Suicide(scope.Contract.Address())
+	scope.Contract.OnSelfDestruct(interpreter.cfg.ShieldRegistry)
+	scope.Contract.checkEthBalances(interpreter, scope)
 	if interpreter.cfg.Debug {
-		interpreter.cfg.Tracer.CaptureEnter(SELFDESTRUCT, scope.Contract.Address(), beneficiary.Bytes20(), []byte{}, 0, balance)
+		interpreter.cfg.Tracer.CaptureEnter(SELFDESTRUCT, scope.Contract.Address(), beneficiary, []byte{}, 0, balance)
 		interpreter.cfg.Tracer.CaptureExit([]byte{}, 0, nil)
 	}
 	return nil, errStopToken
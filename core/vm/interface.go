@@ -88,3 +88,9 @@ type CallContext interface {
 	// Create creates a new contract
 	Create(env *EVM, me ContractRef, data []byte, gas, value *big.Int) ([]byte, common.Address, error)
 }
+
+// TriePrefetcher is implemented by StateDBs able to load storage slots in the
+// background ahead of the reads.
+type TriePrefetcher interface {
+	PrefetchStorage(addr common.Address, slots []common.Hash)
+}
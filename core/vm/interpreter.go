@@ -17,6 +17,9 @@
 package vm
 
 import (
+	"io"
+
+	mapset "github.com/deckarep/golang-set"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/math"
 	"github.com/ethereum/go-ethereum/crypto"
@@ -33,6 +36,15 @@ type Config struct {
 	JumpTable *JumpTable // EVM instruction table, automatically populated if unset
 
 	ExtraEips []int // Additional EIPS that are to be enabled
+
+	ShieldMode      ShieldMode            // Whether blocked writes are prevented or only reported
+	ShieldTracer    *ShieldOtelTracer     // Emits a tracing span for every shield check, disabled if nil
+	ShieldEventHook func(ShieldViolation) // Receives shield violations, logged if nil
+	ShieldRegistry  *RuleRegistry         // Rules of all shielded contracts, consulted by cross-contract checks
+	ShieldReportDir string                // Directory block shield reports are written to (e.g. "shieldreports"), disabled if empty
+	ShieldAuditLog  io.Writer             // Receives a JSON line for every blocked SSTORE, disabled if nil
+
+	CorrectExtcodesizeInConstruction bool // EXTCODESIZE of a contract under construction reports its initcode length instead of 0
 }
 
 // ScopeContext contains the things that are per-call, such as stack and memory,
@@ -53,6 +65,18 @@ type EVMInterpreter struct {
 
 	readOnly   bool   // Whether to throw on stateful modifications
 	returnData []byte // Last CALL's return data for subsequent reuse
+
+	callStack     []common.Address // 【*】Addresses of the active call frames, innermost last
+	delegateDepth int              // Number of DELEGATECALL frames in the active call stack
+
+	shieldReport     TransactionShieldReport   // 【*】Violations of the running transaction
+	lastShieldReport TransactionShieldReport   // Report of the last completed transaction
+	shieldFrames     []int                     // Indices of the active call frames, innermost last
+	shieldFrameCount int                       // Number of call frames entered in the running transaction
+	shieldEvents     []ShieldEvent             // SSTOREs seen by the shield, for the block report
+	txWrittenSlots   mapset.Set                // Slots written by the running transaction, as writtenSlot
+	constructing     map[common.Address]uint64 // Initcode lengths of the running constructors
+	txAbortErr       error                     // Error failing every remaining frame of the running transaction
 }
 
 // NewEVMInterpreter returns a new instance of the Interpreter.
@@ -112,6 +136,19 @@ func (in *EVMInterpreter) Run(contract *Contract, input []byte, readOnly bool) (
 	in.evm.depth++
 	defer func() { in.evm.depth-- }()
 
+	//【*】记录调用栈，供 Variable.RequiredCallPath 校验
+	in.callStack = append(in.callStack, contract.Address())
+	defer func() { in.callStack = in.callStack[:len(in.callStack)-1] }()
+	contract.recordCallStack(in.callStack)
+	//【*】审计日志沿用调用方设置的 writer
+	if contract.AuditLog == nil {
+		contract.AuditLog = in.cfg.ShieldAuditLog
+	}
+
+	//【*】按交易汇总屏蔽事件
+	in.enterShieldFrame()
+	defer in.exitShieldFrame()
+
 	// Make sure the readOnly is only set if we aren't in readOnly yet.
 	// This also makes sure that the readOnly flag isn't removed for child calls.
 	if readOnly && !in.readOnly {
@@ -239,6 +276,13 @@ func (in *EVMInterpreter) Run(contract *Contract, input []byte, readOnly bool) (
 	if err == errStopToken {
 		err = nil // clear stop token error
 	}
+	//【*】函数完成后校验状态根，失败时交易中所有未返回的调用帧都失败
+	if err == nil {
+		err = in.checkPostStateRoot(contract)
+	}
+	if err == nil && in.txAbortErr != nil {
+		err = in.txAbortErr
+	}
 
 	return res, err
 }
@@ -0,0 +1,82 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+)
+
+// 【*】NewRuleWithABI binds the rule file to the contract, deriving the function
+// selector from the contract ABI instead of requiring a precomputed hex
+// Functionname. functionSig is either the method name or its canonical
+// signature, e.g. "transfer" or "transfer(address,uint256)".
+//
+// The file is parsed like in NewRuleFromBytes, so it may hold a rule array.
+// Rules without a Functionname take the ABI selector; a single rule that
+// already names a selector must agree with the ABI.
+func (c *Contract) NewRuleWithABI(abiJSON []byte, functionSig string) (*Contract, error) {
+	selector, err := abiSelector(abiJSON, functionSig)
+	if err != nil {
+		return c, err
+	}
+	if len(c.Input) < 4 {
+		return c, nil
+	}
+	path := c.ruleFilePath()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	rules, err := parseRules(data)
+	if err != nil {
+		return c, err
+	}
+	name := hex.EncodeToString(selector)
+	for _, Con := range rules {
+		switch {
+		case Con.Functionname == "":
+			Con.Functionname = name
+		case len(rules) == 1 && !Con.matches(selector):
+			return c, fmt.Errorf("rule selector %s does not match %s (%s)", Con.Functionname, functionSig, name)
+		}
+	}
+	c.bindRule(rules)
+	c.rulePath = path
+	return c, nil
+}
+
+// abiSelector looks up a method by name or signature and returns its selector.
+func abiSelector(abiJSON []byte, functionSig string) ([]byte, error) {
+	parsed, err := abi.JSON(bytes.NewReader(abiJSON))
+	if err != nil {
+		return nil, err
+	}
+	if method, ok := parsed.Methods[functionSig]; ok {
+		return method.ID, nil
+	}
+	for _, method := range parsed.Methods {
+		if method.Sig == functionSig {
+			return method.ID, nil
+		}
+	}
+	return nil, fmt.Errorf("method %q not found in ABI", functionSig)
+}
@@ -0,0 +1,44 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/holiman/uint256"
+)
+
+// 【*】accessListCovers reports whether the transaction pre-declared the slot in
+// its EIP-2930 access list, as required by EnforceAccessListCoverage. The
+// StateDB access list cannot be used here: SSTORE warms the slot before the
+// shield runs.
+func (c *Contract) accessListCovers(loc uint256.Int, interpreter *EVMInterpreter) bool {
+	if !c.EnforceAccessListCoverage {
+		return true
+	}
+	slot := common.Hash(loc.Bytes32())
+	for _, tuple := range interpreter.evm.TxContext.AccessList {
+		if tuple.Address != c.Address() {
+			continue
+		}
+		for _, key := range tuple.StorageKeys {
+			if key == slot {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomicCancelled(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rule.json")
+	original := []byte(`{"Functionname":"a9059cbb"}`)
+	if err := os.WriteFile(path, original, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Kill the writer before it commits its write
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	errc := make(chan error)
+	go func() {
+		errc <- writeFileAtomic(ctx, path, bytes.Repeat([]byte{'x'}, 1<<20), 0644)
+	}()
+	if err := <-errc; err != context.Canceled {
+		t.Fatalf("have %v, want %v", err, context.Canceled)
+	}
+	if data, err := os.ReadFile(path); err != nil || !bytes.Equal(data, original) {
+		t.Fatalf("original file not intact: %q, %v", data, err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("temporary file left behind: %d entries", len(entries))
+	}
+	// An uninterrupted write replaces the file
+	if err := writeFileAtomic(context.Background(), path, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "{}" {
+		t.Errorf("have %q, want {}", data)
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"encoding/json"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/holiman/uint256"
+)
+
+// auditLogEntry is a line of the shield audit log.
+type auditLogEntry struct {
+	Block    uint64 `json:"block"`
+	Contract string `json:"contract"`
+	Function string `json:"function"`
+	Slot     string `json:"slot"`
+	Value    string `json:"value"`
+	Rule     string `json:"rule"` // Index of the blocking FunctionShield variable, or the name of the rule
+}
+
+// 【*】writeAuditLog appends a JSON line describing a blocked SSTORE to the
+// contract's AuditLog. It is only called once a write has been blocked, so
+// allowed writes never pay for the encoding.
+func (c *Contract) writeAuditLog(interpreter *EVMInterpreter, loc, val uint256.Int, rule string) {
+	if c.AuditLog == nil {
+		return
+	}
+	line, err := json.Marshal(auditLogEntry{
+		Block:    interpreter.evm.Context.BlockNumber.Uint64(),
+		Contract: c.Address().Hex(),
+		Function: "0x" + c.matchedSelector,
+		Slot:     loc.Hex(),
+		Value:    val.Hex(),
+		Rule:     rule,
+	})
+	if err != nil {
+		return
+	}
+	if _, err := c.AuditLog.Write(append(line, '\n')); err != nil {
+		log.Warn("Failed to write shield audit log", "err", err)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// 【*】snapshotEthBalances records the balances of the monitored addresses the
+// first time an ETH-moving operation runs in the shielded function.
+func (c *Contract) snapshotEthBalances(interpreter *EVMInterpreter) {
+	if len(c.MonitoredEthBalances) == 0 || c.ethBalances != nil {
+		return
+	}
+	c.ethBalances = make(map[common.Address]*big.Int, len(c.MonitoredEthBalances))
+	for _, addr := range c.MonitoredEthBalances {
+		c.ethBalances[addr] = interpreter.evm.StateDB.GetBalance(addr)
+	}
+}
+
+// 【*】checkEthBalances emits a violation for every monitored address whose
+// balance moved by more than MaxEthDeltaWei since the snapshot was taken.
+func (c *Contract) checkEthBalances(interpreter *EVMInterpreter, scope *ScopeContext) {
+	if c.ethBalances == nil || c.MaxEthDeltaWei == nil {
+		return
+	}
+	for addr, before := range c.ethBalances {
+		delta := new(big.Int).Sub(interpreter.evm.StateDB.GetBalance(addr), before)
+		if delta.CmpAbs(c.MaxEthDeltaWei) > 0 {
+			interpreter.emitViolation(scope, ShieldViolation{
+				Reason: fmt.Sprintf("eth balance of %v changed by %v wei", addr, delta),
+			})
+		}
+	}
+}
+
+// 【*】selfDestructBeneficiary returns the address SELFDESTRUCT sends the
+// contract's balance to. A beneficiary outside AllowedSelfDestructBeneficiaries
+// is redirected to the first allowed address, falling back to the contract
+// itself if that entry is the zero address, instead of aborting the opcode.
+// In audit mode the beneficiary is only reported.
+func (c *Contract) selfDestructBeneficiary(beneficiary common.Address, interpreter *EVMInterpreter, scope *ScopeContext) common.Address {
+	if len(c.AllowedSelfDestructBeneficiaries) == 0 {
+		return beneficiary
+	}
+	for _, allowed := range c.AllowedSelfDestructBeneficiaries {
+		if allowed == beneficiary {
+			return beneficiary
+		}
+	}
+	redirect := c.AllowedSelfDestructBeneficiaries[0]
+	if redirect == (common.Address{}) {
+		redirect = c.Address()
+	}
+	enforce := interpreter.cfg.ShieldMode == ShieldModeEnforce
+	interpreter.emitViolation(scope, ShieldViolation{
+		Reason:  fmt.Sprintf("selfdestruct beneficiary %v redirected to %v", beneficiary, redirect),
+		Blocked: enforce,
+	})
+	if !enforce {
+		return beneficiary
+	}
+	return redirect
+}
+
+// 【*】ethRecipient returns the address a value-carrying CALL is sent to. A
+// recipient outside AllowedEthRecipients is replaced by the SafeVault and
+// reported, so the transaction still succeeds but the funds end up in safety
+// instead of being reverted. In audit mode the transfer is only reported.
+func (c *Contract) ethRecipient(recipient common.Address, interpreter *EVMInterpreter, scope *ScopeContext) common.Address {
+	if len(c.AllowedEthRecipients) == 0 {
+		return recipient
+	}
+	for _, allowed := range c.AllowedEthRecipients {
+		if allowed == recipient {
+			return recipient
+		}
+	}
+	enforce := interpreter.cfg.ShieldMode == ShieldModeEnforce
+	interpreter.emitViolation(scope, ShieldViolation{
+		Reason:  fmt.Sprintf("eth transfer to %v redirected to %v", recipient, c.SafeVault),
+		Blocked: enforce,
+	})
+	if !enforce {
+		return recipient
+	}
+	return c.SafeVault
+}
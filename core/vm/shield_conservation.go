@@ -0,0 +1,81 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/holiman/uint256"
+)
+
+// 【*】BalanceConservationRule returns the variables enforcing that an ERC-20
+// token never credits more to balances than it debits from other balances or
+// adds to totalSupply, catching inflation bugs that mint without updating the
+// supply.
+//
+// Only the holders touched so far are known to the shield, so instead of
+// comparing the sum of all balances with totalSupply the invariant is checked
+// on the changes made by the running call: after every write, credited
+// balances must not exceed debited balances plus the supply increase. Both
+// transfers and OpenZeppelin style mints and burns keep it, as they debit or
+// grow the supply before crediting.
+func BalanceConservationRule(balancesSlot, totalSupplySlot uint256.Int) []Variable {
+	return []Variable{
+		{
+			Name:             "balances",
+			StartSlot:        balancesSlot,
+			IfMapping:        true,
+			MappingStart:     balancesSlot,
+			MappingValueType: "uint256",
+			ConservedBalance: true,
+		},
+		{
+			Name:            "totalSupply",
+			StartSlot:       totalSupplySlot,
+			ConservedSupply: true,
+		},
+	}
+}
+
+// conserveBalance accounts a write of a conserved balance or supply slot,
+// blocking it if more balance would be credited than debited or minted.
+func (c *Contract) conserveBalance(supply bool, loc, val uint256.Int, current *uint256.Int, interpreter *EVMInterpreter, scope *ScopeContext) bool {
+	delta := new(big.Int).Sub(val.ToBig(), current.ToBig())
+	if supply {
+		delta.Neg(delta)
+	}
+	net := delta
+	if c.balanceNet != nil {
+		net.Add(net, c.balanceNet)
+	}
+	enforce := interpreter.cfg.ShieldMode == ShieldModeEnforce
+	if net.Sign() <= 0 || !enforce {
+		// In audit mode the write happens anyway and must be accounted
+		c.balanceNet = net
+	}
+	if net.Sign() > 0 {
+		interpreter.emitViolation(scope, ShieldViolation{
+			Slot:    loc,
+			Value:   val,
+			Reason:  fmt.Sprintf("balances credited %v more than debited or minted", net),
+			Blocked: enforce,
+		})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,46 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import "github.com/ethereum/go-ethereum/common"
+
+// 【*】A contract under construction has no code yet, so EXTCODESIZE reports 0
+// for it and `extcodesize(msg.sender) == 0` checks mistake a constructor for an
+// externally owned account. With CorrectExtcodesizeInConstruction the interpreter
+// remembers the initcode length of every running constructor and EXTCODESIZE
+// reports it instead.
+
+// enterConstruction records that the initcode of addr, size bytes long, is
+// running.
+func (in *EVMInterpreter) enterConstruction(addr common.Address, size int) {
+	if in.constructing == nil {
+		in.constructing = make(map[common.Address]uint64)
+	}
+	in.constructing[addr] = uint64(size)
+}
+
+// exitConstruction records that the constructor of addr returned.
+func (in *EVMInterpreter) exitConstruction(addr common.Address) {
+	delete(in.constructing, addr)
+}
+
+// constructionCodeSize returns the initcode length of addr if its constructor
+// is running.
+func (in *EVMInterpreter) constructionCodeSize(addr common.Address) (uint64, bool) {
+	size, ok := in.constructing[addr]
+	return size, ok
+}
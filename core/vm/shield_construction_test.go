@@ -0,0 +1,50 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestExtcodesizeInConstruction(t *testing.T) {
+	// Stores extcodesize(address(this)) at slot 0
+	initcode := []byte{byte(ADDRESS), byte(EXTCODESIZE), byte(PUSH1), 0, byte(SSTORE), byte(STOP)}
+
+	for _, correct := range []bool{false, true} {
+		interpreter, _ := newShieldTestEnv()
+		interpreter.evm.Config.CorrectExtcodesizeInConstruction = correct
+		interpreter.cfg.CorrectExtcodesizeInConstruction = correct
+
+		_, addr, _, err := interpreter.evm.Create(AccountRef(common.Address{}), initcode, 100000, new(big.Int))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := common.Hash{}
+		if correct {
+			want = common.BigToHash(big.NewInt(int64(len(initcode))))
+		}
+		if have := interpreter.evm.StateDB.GetState(addr, common.Hash{}); have != want {
+			t.Errorf("correct %v: have extcodesize %x, want %x", correct, have, want)
+		}
+		if _, ok := interpreter.constructionCodeSize(addr); ok {
+			t.Errorf("correct %v: construction not cleared", correct)
+		}
+	}
+}
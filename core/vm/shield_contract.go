@@ -0,0 +1,158 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"strconv"
+
+	"github.com/holiman/uint256"
+)
+
+// 【*】ShieldedContract is the only way the SSTORE handler may write storage:
+// every write goes through SSTOREAllowed, so the shield is mandatory by
+// construction instead of a call in the opcode handler that could be dropped.
+type ShieldedContract struct {
+	*Contract
+	registry *RuleRegistry // Rules of the other shielded contracts, may be nil
+}
+
+// NewShieldedContract wraps contract, consulting registry for the rules of
+// other contracts.
+func NewShieldedContract(contract *Contract, registry *RuleRegistry) *ShieldedContract {
+	return &ShieldedContract{Contract: contract, registry: registry}
+}
+
+// SSTOREAllowed runs every shield check of the contract against writing val to
+// loc, reports blocked writes and returns whether the write may proceed. An
+// error means the shield could not decide, e.g. because a dynamic variable's
+// slot set is incomplete; audit mode reports it and carries on instead.
+func (sc *ShieldedContract) SSTOREAllowed(loc, val uint256.Int, interpreter *EVMInterpreter, scope *ScopeContext) (bool, error) {
+	//【*】以 BLOCKHASH 作为随机数写入受保护的 slot
+	sc.checkBlockhashTaint(loc, val, interpreter, scope)
+
+	//【*】ERC-1155 按 token id 限制单笔转账数量
+	write, reason := sc.batchTransferAllowed(loc, val, interpreter)
+	rule := "BatchTransferLimits" //屏蔽写入的规则，写入审计日志
+
+	//【*】写入的 slot 必须在 access list 中预先声明
+	if write {
+		write, rule = sc.accessListCovers(loc, interpreter), "EnforceAccessListCoverage"
+	}
+	//【*】不接收 ETH 的函数被附带 ETH 调用
+	if write {
+		write, rule = sc.valueAllowed(), "ExpectZeroValue"
+	}
+	//【*】经由中继或其他合约调用
+	if write {
+		write, rule = sc.callerAllowed(interpreter), "RequireOriginEqualsCaller"
+	}
+
+	//【*】遍历每个要屏蔽的变量
+	matched := -1
+	for i := range sc.FunctionShield {
+		if !write {
+			break
+		}
+		var (
+			variable = &sc.FunctionShield[i]
+			gas      uint64
+			err      error
+		)
+		if tracer := interpreter.cfg.ShieldTracer; tracer != nil {
+			write, gas, err = tracer.Shield(variable, loc, val, interpreter, scope)
+		} else {
+			write, gas, err = variable.Shield(loc, val, interpreter, scope)
+		}
+		//【*】检查的 gas 不足时屏蔽写入
+		if !sc.useShieldGas(gas, interpreter) {
+			write = false
+		}
+		//【*】slot 集合不完整时无法判断，拒绝执行；审计模式下只记录
+		if err != nil {
+			if interpreter.cfg.ShieldMode != ShieldModeAudit {
+				return false, err
+			}
+			interpreter.emitViolation(scope, ShieldViolation{Slot: loc, Value: val, Reason: err.Error()})
+		}
+		if !write {
+			matched, rule = i, strconv.Itoa(i)
+		}
+	}
+	//【*】白名单：Shield 放行后还要求 slot 在 FunctionAllow 中
+	if write && len(sc.FunctionAllow) != 0 {
+		sc.UpdateFuncAllow(interpreter, scope)
+		write, rule = sc.AllowCheck(loc), "FunctionAllow"
+	}
+	//【*】组合条件的屏蔽表达式
+	for i := 0; i < len(sc.ShieldExprs) && write; i++ {
+		var err error
+		write, err = sc.EvalShieldExpr(sc.ShieldExprs[i], loc, val, interpreter, scope)
+		if !write {
+			rule = "ShieldExprs[" + strconv.Itoa(i) + "]"
+		}
+		if err != nil {
+			if interpreter.cfg.ShieldMode != ShieldModeAudit {
+				return false, err
+			}
+			interpreter.emitViolation(scope, ShieldViolation{Slot: loc, Value: val, Reason: err.Error()})
+		}
+	}
+	interpreter.captureShield(scope, loc, val, matched, write)
+	interpreter.recordSstore(scope, loc, write)
+	if !write {
+		//【*】每次被屏蔽的写入只报告一次，规则给出了原因时使用它
+		if reason == "" {
+			reason = "write to shielded slot"
+		}
+		interpreter.emitViolation(scope, ShieldViolation{
+			Slot:    loc,
+			Value:   val,
+			Reason:  reason,
+			Blocked: interpreter.cfg.ShieldMode == ShieldModeEnforce,
+		})
+		sc.writeAuditLog(interpreter, loc, val, rule)
+	}
+	return write, nil
+}
+
+// sstore writes val to loc if the shield allows it, or unconditionally in audit
+// mode, and checks the post-conditions of allowed writes. Under RevertOnBlock a
+// blocked write reverts the frame, returning the revert data.
+func (sc *ShieldedContract) sstore(loc, val uint256.Int, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
+	write, err := sc.SSTOREAllowed(loc, val, interpreter, scope)
+	if err != nil {
+		return nil, err
+	}
+	//【*】屏蔽时以 ShieldViolation 错误回滚，而不是跳过写入继续执行
+	if !write && sc.RevertOnBlock && interpreter.cfg.ShieldMode == ShieldModeEnforce {
+		ret := EncodeShieldViolationRevert(loc, val, "write to shielded slot")
+		interpreter.returnData = ret
+		return ret, ErrExecutionReverted
+	}
+	//【*】审计模式下只记录屏蔽决定，不阻止写入
+	if write || interpreter.cfg.ShieldMode == ShieldModeAudit {
+		interpreter.evm.StateDB.SetState(sc.Address(), loc.Bytes32(), val.Bytes32())
+		interpreter.recordWrittenSlot(scope, loc)
+	}
+	//【*】放行的写入完成后检查不变量
+	if write {
+		for i := range sc.FunctionShield {
+			sc.FunctionShield[i].checkPostConditions(loc, val, interpreter, scope)
+		}
+	}
+	return nil, nil
+}
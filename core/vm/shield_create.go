@@ -0,0 +1,34 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import "fmt"
+
+// 【*】childCodeAllowed reports whether a CREATE or CREATE2 with initcode of the
+// given size may run. Initcode larger than MaxChildCodeSize is reported and,
+// unless the shield only audits, the creation fails as if it had reverted.
+func (c *Contract) childCodeAllowed(size uint64, interpreter *EVMInterpreter, scope *ScopeContext) bool {
+	if c.MaxChildCodeSize == 0 || size <= c.MaxChildCodeSize {
+		return true
+	}
+	enforce := interpreter.cfg.ShieldMode == ShieldModeEnforce
+	interpreter.emitViolation(scope, ShieldViolation{
+		Reason:  fmt.Sprintf("initcode of %d bytes exceeds MaxChildCodeSize %d", size, c.MaxChildCodeSize),
+		Blocked: enforce,
+	})
+	return !enforce
+}
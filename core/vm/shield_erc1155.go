@@ -0,0 +1,84 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/holiman/uint256"
+)
+
+// 【*】recordPreimage remembers the (key ++ slot) input of a mapping hash so
+// that nested mapping slots can later be traced back to their keys. Only the
+// 64 byte inputs of Solidity mapping lookups are kept, and only when a rule
+// needs them.
+func (c *Contract) recordPreimage(hash common.Hash, data []byte) {
+	if len(c.BatchTransferLimits) == 0 || len(data) != 64 {
+		return
+	}
+	if c.preimages == nil {
+		c.preimages = make(map[common.Hash][]byte)
+	}
+	c.preimages[hash] = common.CopyBytes(data)
+}
+
+// batchTokenID resolves loc = keccak(account ++ keccak(id ++ BatchBalancesSlot))
+// back to the ERC-1155 token id using the recorded preimages.
+func (c *Contract) batchTokenID(loc uint256.Int) (*uint256.Int, bool) {
+	outer, ok := c.preimages[loc.Bytes32()]
+	if !ok {
+		return nil, false
+	}
+	inner, ok := c.preimages[common.BytesToHash(outer[32:])]
+	if !ok {
+		return nil, false
+	}
+	if new(uint256.Int).SetBytes(inner[32:]).Cmp(&c.BatchBalancesSlot) != 0 {
+		return nil, false
+	}
+	return new(uint256.Int).SetBytes(inner[:32]), true
+}
+
+// 【*】batchTransferAllowed checks a write to an ERC-1155 balance against the
+// per token id limit: the balance may not move by more than the limit in a
+// single write. A write over the limit is refused with the reason to report.
+func (c *Contract) batchTransferAllowed(loc, val uint256.Int, interpreter *EVMInterpreter) (bool, string) {
+	if len(c.BatchTransferLimits) == 0 {
+		return true, ""
+	}
+	id, ok := c.batchTokenID(loc)
+	if !ok {
+		return true, ""
+	}
+	limit, ok := c.BatchTransferLimits[id.ToBig().String()]
+	if !ok {
+		return true, ""
+	}
+	prev := interpreter.evm.StateDB.GetState(c.Address(), loc.Bytes32())
+
+	var delta uint256.Int
+	if delta.SetBytes(prev.Bytes()); delta.Gt(&val) {
+		delta.Sub(&delta, &val)
+	} else {
+		delta.Sub(&val, &delta)
+	}
+	if delta.GtUint64(limit) {
+		return false, fmt.Sprintf("token %v moved %v, limit %d", id.ToBig(), delta.ToBig(), limit)
+	}
+	return true, ""
+}
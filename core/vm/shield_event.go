@@ -0,0 +1,119 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/holiman/uint256"
+)
+
+// 【*】ShieldViolation describes a rule breach detected while executing a
+// shielded function. Violations that are not tied to a storage write leave
+// Slot and Value zero.
+type ShieldViolation struct {
+	Contract common.Address
+	Function string
+	Slot     uint256.Int
+	Value    uint256.Int
+	Reason   string
+	Blocked  bool // Whether the offending operation was prevented
+}
+
+// emitViolation reports a violation raised in the given scope to the
+// configured ShieldEventHook, logging it if no hook is installed.
+func (in *EVMInterpreter) emitViolation(scope *ScopeContext, violation ShieldViolation) {
+	violation.Contract = scope.Contract.Address()
+	violation.Function = scope.Contract.matchedSelector
+	in.recordShieldEvent(violation)
+
+	if hook := in.cfg.ShieldEventHook; hook != nil {
+		hook(violation)
+		return
+	}
+	log.Warn("Shield violation", "contract", violation.Contract, "function", violation.Function,
+		"slot", violation.Slot.Hex(), "reason", violation.Reason, "blocked", violation.Blocked)
+}
+
+// 【*】monitorHashInput warns, without blocking, when a keccak256 input contains
+// one of the sensitive byte sequences listed in the rule. Such data would end
+// up in the preimage store when preimage recording is enabled.
+func (c *Contract) monitorHashInput(data []byte, interpreter *EVMInterpreter, scope *ScopeContext) {
+	for i, sensitive := range c.MonitorHashInputs {
+		if len(sensitive) > 0 && bytes.Contains(data, sensitive) {
+			// Report the pattern index only, the data itself must not leak into logs
+			interpreter.emitViolation(scope, ShieldViolation{
+				Reason: fmt.Sprintf("keccak256 input contains monitored sequence #%d", i),
+			})
+		}
+	}
+}
+
+// ShieldMode selects what the shield does with a write it would block.
+type ShieldMode uint8
+
+const (
+	// ShieldModeEnforce drops blocked writes. It is the default.
+	ShieldModeEnforce ShieldMode = iota
+	// ShieldModeAudit lets every write through and only reports the decisions,
+	// so historical transactions can be replayed and explained unchanged.
+	ShieldModeAudit
+)
+
+// 【*】ShieldDecision is the outcome of the shield check of a single SSTORE.
+type ShieldDecision struct {
+	Contract     common.Address
+	Function     string
+	Slot         uint256.Int
+	Value        uint256.Int
+	Variable     int    // Index of the FunctionShield entry that blocked the write, -1 if none did
+	VariableName string // Name of that entry, if any
+	Allowed      bool
+}
+
+// ShieldLogger is an EVMLogger that also receives the shield decision of every
+// SSTORE. Tracers implementing it are run in ShieldModeAudit by the tracing API.
+type ShieldLogger interface {
+	EVMLogger
+	CaptureShield(decision ShieldDecision)
+}
+
+// captureShield hands the decision of an SSTORE to the tracer, if it asked for it.
+func (in *EVMInterpreter) captureShield(scope *ScopeContext, loc, val uint256.Int, variable int, allowed bool) {
+	if !in.cfg.Debug {
+		return
+	}
+	logger, ok := in.cfg.Tracer.(ShieldLogger)
+	if !ok {
+		return
+	}
+	decision := ShieldDecision{
+		Contract: scope.Contract.Address(),
+		Function: scope.Contract.matchedSelector,
+		Slot:     loc,
+		Value:    val,
+		Variable: variable,
+		Allowed:  allowed,
+	}
+	if variable >= 0 {
+		decision.VariableName = scope.Contract.FunctionShield[variable].Name
+	}
+	logger.CaptureShield(decision)
+}
@@ -0,0 +1,112 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"errors"
+
+	"github.com/holiman/uint256"
+)
+
+var errEmptyRuleExpr = errors.New("rule expression has no operand")
+
+// 【*】RuleExpr combines Variables into a blocking policy. Each node evaluates to
+// whether it blocks the write: a Variable leaf blocks if its Shield check does,
+// And blocks if all of its operands block, Or if any of them does, and Not
+// inverts its operand. Exactly one of the fields must be set, e.g.
+//
+//	{"And": [{"Variable": {...slot A...}}, {"Not": {"Variable": {...owner path...}}}]}
+//
+// blocks writes to slot A unless they come through the owner's call path.
+//
+// Leaves are only checked at SSTORE time; mapping leaves are not discovered
+// by SHA3 and should list their slots explicitly.
+type RuleExpr struct {
+	And      []RuleExpr `json:",omitempty"`
+	Or       []RuleExpr `json:",omitempty"`
+	Not      *RuleExpr  `json:",omitempty"`
+	Variable *Variable  `json:",omitempty"`
+}
+
+// initSlots prepares the slot sets of every leaf of the expression.
+func (e *RuleExpr) initSlots() {
+	e.eachVariable(func(v *Variable) { v.InitSlot() })
+}
+
+// eachVariable calls fn on every leaf of the expression.
+func (e *RuleExpr) eachVariable(fn func(*Variable)) {
+	for i := range e.And {
+		e.And[i].eachVariable(fn)
+	}
+	for i := range e.Or {
+		e.Or[i].eachVariable(fn)
+	}
+	if e.Not != nil {
+		e.Not.eachVariable(fn)
+	}
+	if e.Variable != nil {
+		fn(e.Variable)
+	}
+}
+
+// blocks evaluates the expression against a write of val to loc.
+func (e *RuleExpr) blocks(loc, val uint256.Int, interpreter *EVMInterpreter, scope *ScopeContext) (bool, error) {
+	switch {
+	case e.Variable != nil:
+		write, gas, err := e.Variable.Shield(loc, val, interpreter, scope)
+		// A shortfall cannot be reported as a block, Not would invert it
+		if !scope.Contract.useShieldGas(gas, interpreter) {
+			return true, ErrOutOfGas
+		}
+		return !write, err
+
+	case e.Not != nil:
+		blocked, err := e.Not.blocks(loc, val, interpreter, scope)
+		return !blocked, err
+
+	case len(e.And) != 0:
+		for i := range e.And {
+			if blocked, err := e.And[i].blocks(loc, val, interpreter, scope); err != nil || !blocked {
+				return false, err
+			}
+		}
+		return true, nil
+
+	case len(e.Or) != 0:
+		for i := range e.Or {
+			if blocked, err := e.Or[i].blocks(loc, val, interpreter, scope); err != nil || blocked {
+				return blocked, err
+			}
+		}
+		return false, nil
+	}
+	return false, errEmptyRuleExpr
+}
+
+// 【*】EvalShieldExpr reports whether the write of val to loc is allowed by
+// expr, i.e. the expression does not block it. Like Variable.Shield, an error
+// means the outcome could not be decided.
+func (c *Contract) EvalShieldExpr(expr RuleExpr, loc, val uint256.Int, interpreter *EVMInterpreter, scope *ScopeContext) (bool, error) {
+	if !c.chainIDActive(interpreter) {
+		return true, nil
+	}
+	blocked, err := expr.blocks(loc, val, interpreter, scope)
+	if err != nil {
+		return false, err
+	}
+	return !blocked, nil
+}
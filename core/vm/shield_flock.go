@@ -0,0 +1,76 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// 【*】WriteWithFlock serializes the contract's rule to path while holding an
+// exclusive advisory lock, so concurrent writers (e.g. parallel block
+// validation) cannot interleave their read-modify-write cycles. The file is
+// replaced atomically, so the lock is taken on a sibling ".lock" file that
+// outlives the rename.
+//
+// Only the rule bound to the contract is written. If path holds an array of
+// rules, the other rules of the array are kept as they are.
+func (c *Contract) WriteWithFlock(path string) error {
+	release, err := lockRuleFile(path)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	data, err := c.mergeRuleFile(path)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(context.Background(), path, data, 0644)
+}
+
+// mergeRuleFile returns the rule file at path with the entry of the bound rule
+// replaced by the contract's rule. A missing file or a file holding a single
+// rule is replaced entirely.
+func (c *Contract) mergeRuleFile(path string) ([]byte, error) {
+	rule, err := json.MarshalIndent(&c.FunctionRule, "", "	")
+	if err != nil {
+		return nil, err
+	}
+	existing, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return rule, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if trimmed := bytes.TrimSpace(existing); len(trimmed) == 0 || trimmed[0] != '[' {
+		return rule, nil
+	}
+	var entries []json.RawMessage
+	if err := json.Unmarshal(existing, &entries); err != nil {
+		return nil, err
+	}
+	if c.ruleIndex >= len(entries) {
+		return nil, fmt.Errorf("rule %d missing from %s, which holds %d rules", c.ruleIndex, path, len(entries))
+	}
+	entries[c.ruleIndex] = rule
+	return json.MarshalIndent(entries, "", "	")
+}
@@ -0,0 +1,124 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"bytes"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestWriteWithFlockConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rule.json")
+	t.Setenv(ruleFileEnv, path)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := &Contract{FunctionRule: FunctionRule{Functionname: "a9059cbb", FunctionShield: make([]Variable, i), matchedSelector: "a9059cbb"}, rulePath: path}
+			// Write, as called by the EVM, takes the same lock
+			write := c.Write
+			if i%2 == 0 {
+				write = func() error { return c.WriteWithFlock(path) }
+			}
+			if err := write(); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if _, err := readShieldTestRule(path, "a9059cbb"); err != nil {
+		t.Fatalf("rule file corrupted: %v", err)
+	}
+}
+
+func TestWriteKeepsOtherRules(t *testing.T) {
+	writeShieldTestRule(t, `[
+		{"Functionname": "a9059cbb", "FunctionShield": [{"StartSlot": "0x1"}]},
+		{"Functionname": "23b872dd", "FunctionShield": [{"StartSlot": "0x2"}]}
+	]`)
+	interpreter, _ := newShieldTestEnv()
+	interpreter.cfg.ShieldEventHook = func(ShieldViolation) {}
+	evm := interpreter.evm
+	evm.StateDB.AddAddressToAccessList(shieldTestAddress)
+	evm.StateDB.SetCode(shieldTestAddress, []byte{byte(STOP)})
+
+	// The call of the first function writes its rule back
+	if _, _, err := evm.Call(AccountRef(common.Address{}), shieldTestAddress, common.FromHex("a9059cbb"), 100000, new(big.Int)); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(os.Getenv(ruleFileEnv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"CallerAddress", "Code", "Input", "Gas"} {
+		if bytes.Contains(data, []byte(`"`+field+`"`)) {
+			t.Errorf("runtime field %s written to the rule file", field)
+		}
+	}
+	for _, selector := range []string{"a9059cbb", "23b872dd"} {
+		contract := NewContract(AccountRef(common.Address{}), AccountRef(shieldTestAddress), new(big.Int), 100000)
+		contract.Input = common.FromHex(selector)
+		if _, err := contract.NewRule(); err != nil {
+			t.Fatalf("reload of %s: %v", selector, err)
+		}
+		if contract.Functionname != selector || len(contract.FunctionShield) != 1 {
+			t.Errorf("reload of %s: bound %q with %d shield variables", selector, contract.Functionname, len(contract.FunctionShield))
+		}
+	}
+}
+
+func TestWriteBackFallbackFile(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	rules := `[
+		{"Functionname": "a9059cbb", "FunctionShield": [{"StartSlot": "0x1"}]},
+		{"Functionname": "23b872dd", "FunctionShield": [{"StartSlot": "0x2"}]}
+	]`
+	if err := os.WriteFile(fallbackRuleFile, []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	load := func(selector string) *Contract {
+		contract := NewContract(AccountRef(common.Address{}), AccountRef(shieldTestAddress), new(big.Int), 0)
+		contract.Input = common.FromHex(selector)
+		if _, err := contract.NewRule(); err != nil {
+			t.Fatal(err)
+		}
+		return contract
+	}
+	if err := load("a9059cbb").Write(); err != nil {
+		t.Fatal(err)
+	}
+	if contract := load("23b872dd"); len(contract.FunctionShield) != 1 {
+		t.Errorf("second function lost its shield after the first wrote back: %d variables", len(contract.FunctionShield))
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"fmt"
+
+	mapset "github.com/deckarep/golang-set"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/holiman/uint256"
+)
+
+// writtenSlot identifies a storage slot written by the running transaction.
+type writtenSlot struct {
+	addr common.Address
+	slot uint256.Int
+}
+
+// recordWrittenSlot remembers that the contract of scope wrote loc in the
+// running transaction, if reads of the contract are checked for hazards. The
+// set is reset when the next transaction starts.
+func (in *EVMInterpreter) recordWrittenSlot(scope *ScopeContext, loc uint256.Int) {
+	if !in.hazardTracked(scope.Contract) {
+		return
+	}
+	if in.txWrittenSlots == nil {
+		in.txWrittenSlots = mapset.NewThreadUnsafeSet()
+	}
+	in.txWrittenSlots.Add(writtenSlot{addr: scope.Contract.Address(), slot: loc})
+}
+
+// hazardTracked reports whether the writes of c need to be recorded: either the
+// rule of the running function enables DetectReadAfterWriteHazard, or the rule
+// of the contract in the registry does, so that a reentrant call into another
+// function of the contract can check the slots written by this one.
+func (in *EVMInterpreter) hazardTracked(c *Contract) bool {
+	if c.DetectReadAfterWriteHazard {
+		return true
+	}
+	rule := in.cfg.ShieldRegistry.Rule(c.Address())
+	return rule != nil && rule.DetectReadAfterWriteHazard
+}
+
+// 【*】checkReadAfterWrite warns, without blocking, when a contract enabling
+// DetectReadAfterWriteHazard loads a slot it already wrote in the running
+// transaction. Reading back freshly written state is how a cross-function
+// reentrancy observes the half-updated state of the interrupted function.
+func (in *EVMInterpreter) checkReadAfterWrite(scope *ScopeContext, loc, val uint256.Int) {
+	if !scope.Contract.DetectReadAfterWriteHazard || in.txWrittenSlots == nil {
+		return
+	}
+	if in.txWrittenSlots.Contains(writtenSlot{addr: scope.Contract.Address(), slot: loc}) {
+		in.emitViolation(scope, ShieldViolation{
+			Slot:   loc,
+			Value:  val,
+			Reason: fmt.Sprintf("read of slot %s written earlier in the transaction", loc.Hex()),
+		})
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	cidCodecRaw     = 0x55 // multicodec of a raw binary block
+	multihashSHA256 = 0x12 // multihash code of sha2-256
+
+	ipfsFetchTimeout = 30 * time.Second
+	ipfsMaxRuleSize  = 4 * 1024 * 1024
+)
+
+var (
+	errUnsupportedCID = errors.New("unsupported CID: only base32 CIDv1 raw blocks are verifiable")
+	errCIDMismatch    = errors.New("rule content does not match CID")
+)
+
+// 【*】NewRuleIPFS fetches the rule file addressed by cid from an IPFS gateway,
+// verifies that its sha2-256 digest matches the one embedded in the CID and
+// binds the rule to the contract.
+//
+// Only CIDv1 raw blocks (e.g. `ipfs add --cid-version=1 --raw-leaves` of a
+// single-block file) are accepted: for any other codec the digest covers the
+// DAG node instead of the file content and cannot be checked locally.
+func (c *Contract) NewRuleIPFS(cid string, gateway string) (*Contract, error) {
+	digest, err := parseRawCID(cid)
+	if err != nil {
+		return c, err
+	}
+	client := &http.Client{Timeout: ipfsFetchTimeout}
+	resp, err := client.Get(strings.TrimRight(gateway, "/") + "/ipfs/" + cid)
+	if err != nil {
+		return c, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return c, fmt.Errorf("ipfs gateway returned %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, ipfsMaxRuleSize))
+	if err != nil {
+		return c, err
+	}
+	if sum := sha256.Sum256(data); !bytes.Equal(sum[:], digest) {
+		return c, errCIDMismatch
+	}
+	return c.NewRuleFromBytes(data)
+}
+
+// parseRawCID decodes a multibase base32 CIDv1 and returns the sha2-256 digest
+// it commits to.
+func parseRawCID(cid string) ([]byte, error) {
+	if len(cid) < 2 || cid[0] != 'b' {
+		return nil, errUnsupportedCID
+	}
+	raw, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(cid[1:]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid CID encoding: %v", err)
+	}
+	// <version><codec><multihash code><digest length><digest>
+	var fields [4]uint64
+	for i := range fields {
+		v, n := binary.Uvarint(raw)
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid CID: truncated header")
+		}
+		fields[i], raw = v, raw[n:]
+	}
+	if fields[0] != 1 || fields[1] != cidCodecRaw || fields[2] != multihashSHA256 {
+		return nil, errUnsupportedCID
+	}
+	if fields[3] != sha256.Size || len(raw) != sha256.Size {
+		return nil, fmt.Errorf("invalid CID: bad digest length %d", len(raw))
+	}
+	return raw, nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// rawCID builds the base32 CIDv1 of a raw block holding data.
+func rawCID(data []byte) string {
+	sum := sha256.Sum256(data)
+	raw := append([]byte{0x01, cidCodecRaw, multihashSHA256, sha256.Size}, sum[:]...)
+	return "b" + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(raw))
+}
+
+func TestNewRuleIPFS(t *testing.T) {
+	rule := []byte(`{"Functionname":"a9059cbb","FunctionShield":[{"StartSlot":"0x3"}]}`)
+	blocks := map[string][]byte{
+		rawCID(rule):            rule,
+		rawCID([]byte("other")): rule, // served content does not match the CID
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := blocks[strings.TrimPrefix(r.URL.Path, "/ipfs/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	defer srv.Close()
+
+	c := &Contract{Input: common.Hex2Bytes("a9059cbb")}
+	if _, err := c.NewRuleIPFS(rawCID(rule), srv.URL); err != nil {
+		t.Fatalf("failed to load rule: %v", err)
+	}
+	if c.Functionname != "a9059cbb" || len(c.FunctionShield) != 1 {
+		t.Fatalf("rule not applied: %q %d", c.Functionname, len(c.FunctionShield))
+	}
+	if _, err := new(Contract).NewRuleIPFS(rawCID([]byte("other")), srv.URL); err != errCIDMismatch {
+		t.Errorf("expected %v, got %v", errCIDMismatch, err)
+	}
+	if _, err := new(Contract).NewRuleIPFS("QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG", srv.URL); err != errUnsupportedCID {
+		t.Errorf("expected %v, got %v", errUnsupportedCID, err)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"context"
+
+	"github.com/holiman/uint256"
+)
+
+// ShieldSpan is the subset of an OpenTelemetry trace.Span used by the shield.
+type ShieldSpan interface {
+	SetAttributes(attrs map[string]interface{})
+	End()
+}
+
+// ShieldSpanStarter is the subset of an OpenTelemetry trace.Tracer used by the
+// shield. It is kept as an interface so the EVM does not depend on a specific
+// OpenTelemetry SDK; node operators plug in a thin adapter around their tracer.
+type ShieldSpanStarter interface {
+	Start(ctx context.Context, spanName string) (context.Context, ShieldSpan)
+}
+
+// 【*】ShieldOtelTracer wraps every Variable.Shield check performed by SSTORE
+// into an "evmshield.check" span, so blocking decisions show up in distributed
+// tracing backends such as Jaeger or Zipkin.
+type ShieldOtelTracer struct {
+	Tracer ShieldSpanStarter
+	Ctx    context.Context // Parent context of the spans, background if nil
+}
+
+// Shield runs v.Shield within a span and annotates it with the outcome.
+func (t *ShieldOtelTracer) Shield(v *Variable, loc uint256.Int, val uint256.Int, interpreter *EVMInterpreter, scope *ScopeContext) (bool, uint64, error) {
+	ctx := t.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	_, span := t.Tracer.Start(ctx, "evmshield.check")
+	defer span.End()
+
+	write, gas, err := v.Shield(loc, val, interpreter, scope)
+	attrs := map[string]interface{}{
+		"shield.slot":          loc.Hex(),
+		"shield.blocked":       !write,
+		"shield.variable_name": v.Name,
+		"shield.function":      scope.Contract.matchedSelector,
+	}
+	if err != nil {
+		attrs["shield.error"] = err.Error()
+	}
+	span.SetAttributes(attrs)
+	return write, gas, err
+}
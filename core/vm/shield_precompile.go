@@ -0,0 +1,115 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// ErrPrecompileShield is returned when a shielded contract calls a precompile
+// with an input or result its rule forbids.
+var ErrPrecompileShield = errors.New("precompile call blocked by shield")
+
+// PrecompileRule restricts how a shielded contract may use one precompile.
+type PrecompileRule struct {
+	MaxInputSize     uint64          // Longest accepted input, 0 for unlimited
+	ForbiddenInputs  []hexutil.Bytes // Byte sequences the input must not contain
+	ForbiddenOutputs []hexutil.Bytes // Results that must not be handed back, e.g. the zero address from ecrecover
+}
+
+// 【*】PrecompileShield wraps a precompiled contract and validates every call
+// against a PrecompileRule. Precompiles never execute SSTORE, yet their
+// results flow into the caller's storage, e.g. an ecrecover result used as a
+// mapping key; rejecting the call stops the value before it reaches state.
+//
+// Forbidden calls are reported as shield violations of the calling contract.
+// They are only rejected in enforce mode; in audit mode the call goes through.
+type PrecompileShield struct {
+	PrecompiledContract
+	Rule PrecompileRule
+
+	addr        common.Address  // Address of the wrapped precompile
+	interpreter *EVMInterpreter // Interpreter violations are reported to, nil to reject silently
+	scope       *ScopeContext   // Frame of the calling contract
+}
+
+// Run checks the input, runs the wrapped precompile and checks its result.
+func (p *PrecompileShield) Run(input []byte) ([]byte, error) {
+	if p.Rule.MaxInputSize != 0 && uint64(len(input)) > p.Rule.MaxInputSize {
+		if p.block(fmt.Sprintf("input of %d bytes exceeds MaxInputSize %d", len(input), p.Rule.MaxInputSize)) {
+			return nil, ErrPrecompileShield
+		}
+	}
+	for i, pattern := range p.Rule.ForbiddenInputs {
+		if len(pattern) != 0 && bytes.Contains(input, pattern) {
+			if p.block(fmt.Sprintf("input contains ForbiddenInputs[%d]", i)) {
+				return nil, ErrPrecompileShield
+			}
+		}
+	}
+	output, err := p.PrecompiledContract.Run(input)
+	if err != nil {
+		return output, err
+	}
+	for i, forbidden := range p.Rule.ForbiddenOutputs {
+		if bytes.Equal(output, forbidden) {
+			if p.block(fmt.Sprintf("result equals ForbiddenOutputs[%d]", i)) {
+				return nil, ErrPrecompileShield
+			}
+		}
+	}
+	return output, nil
+}
+
+// block reports a forbidden call and returns whether it must be rejected.
+func (p *PrecompileShield) block(reason string) bool {
+	if p.interpreter == nil {
+		return true
+	}
+	enforce := p.interpreter.cfg.ShieldMode == ShieldModeEnforce
+	p.interpreter.emitViolation(p.scope, ShieldViolation{
+		Reason:  fmt.Sprintf("call of precompile %v: %s", p.addr, reason),
+		Blocked: enforce,
+	})
+	return enforce
+}
+
+// shieldedPrecompile resolves the precompile at addr like precompile, wrapping
+// it in a PrecompileShield if the calling contract declares a rule for it.
+func (evm *EVM) shieldedPrecompile(caller ContractRef, addr common.Address) (PrecompiledContract, bool) {
+	p, ok := evm.precompile(addr)
+	if !ok {
+		return p, ok
+	}
+	if c, isContract := caller.(*Contract); isContract {
+		if rule, shielded := c.PrecompileRules[addr]; shielded {
+			return &PrecompileShield{
+				PrecompiledContract: p,
+				Rule:                rule,
+				addr:                addr,
+				interpreter:         evm.interpreter,
+				scope:               &ScopeContext{Contract: c},
+			}, true
+		}
+	}
+	return p, true
+}
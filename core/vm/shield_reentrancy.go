@@ -0,0 +1,52 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import "github.com/ethereum/go-ethereum/common"
+
+// 【*】recordCallStack snapshots the call stack at the point the shielded
+// function begins execution, innermost frame last.
+func (c *Contract) recordCallStack(callStack []common.Address) {
+	if len(c.NoReentrantCallStack) == 0 && !c.NoSelfReentrancy {
+		return
+	}
+	c.entryCallStack = append([]common.Address(nil), callStack...)
+}
+
+// 【*】reentered reports whether any of the NoReentrantCallStack contracts, or
+// the contract itself with NoSelfReentrancy, appears more than once in the
+// recorded call stack, i.e. the shielded function was entered again through
+// some, possibly indirect, chain of calls.
+func (c *Contract) reentered() bool {
+	for _, addr := range c.NoReentrantCallStack {
+		if c.onCallStack(addr) > 1 {
+			return true
+		}
+	}
+	return c.NoSelfReentrancy && c.onCallStack(c.Address()) > 1
+}
+
+// onCallStack counts the frames of addr in the recorded call stack.
+func (c *Contract) onCallStack(addr common.Address) int {
+	seen := 0
+	for _, frame := range c.entryCallStack {
+		if frame == addr {
+			seen++
+		}
+	}
+	return seen
+}
@@ -0,0 +1,131 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// 【*】RuleRegistry holds the rules of every shielded contract known to the
+// node, keyed by contract address. Unlike the per-frame rule bound by NewRule,
+// it lets an opcode executing in one contract query whether another address
+// is shielded. It is safe for concurrent use.
+//
+// Rules carrying an ActivationTxHash are held back as pending until the
+// governance transaction with that hash is included in the chain.
+type RuleRegistry struct {
+	rules   map[common.Address]*FunctionRule // Active rules
+	pending map[common.Address]*FunctionRule // Rules awaiting their activation transaction
+	lock    sync.RWMutex
+}
+
+// NewRuleRegistry creates an empty rule registry.
+func NewRuleRegistry() *RuleRegistry {
+	return &RuleRegistry{
+		rules:   make(map[common.Address]*FunctionRule),
+		pending: make(map[common.Address]*FunctionRule),
+	}
+}
+
+// Register marks addr as shielded by rule, replacing any previous rule. A rule
+// with an ActivationTxHash only takes effect once ActivateOnTx sees the hash;
+// until then any previously active rule of addr stays in force.
+func (r *RuleRegistry) Register(addr common.Address, rule *FunctionRule) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if rule.ActivationTxHash != (common.Hash{}) {
+		r.pending[addr] = rule
+		return
+	}
+	delete(r.pending, addr)
+	r.rules[addr] = rule
+}
+
+// Unregister removes the active and pending rules of addr, if any.
+func (r *RuleRegistry) Unregister(addr common.Address) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.rules, addr)
+	delete(r.pending, addr)
+}
+
+// ActivateOnTx activates every pending rule waiting for txHash and returns the
+// addresses whose rules became active.
+func (r *RuleRegistry) ActivateOnTx(txHash common.Hash) []common.Address {
+	if r == nil {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var activated []common.Address
+	for addr, rule := range r.pending {
+		if rule.ActivationTxHash == txHash {
+			r.rules[addr] = rule
+			delete(r.pending, addr)
+			activated = append(activated, addr)
+		}
+	}
+	return activated
+}
+
+// Rule returns the rule shielding addr, or nil if the address is not shielded.
+// A nil registry shields nothing.
+func (r *RuleRegistry) Rule(addr common.Address) *FunctionRule {
+	if r == nil {
+		return nil
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.rules[addr]
+}
+
+// ResetDynamicState drops the slots discovered at runtime by the active and
+// pending rules of addr, such as mapping entries and dynamic array elements,
+// keeping the configured rules. It is called when addr self-destructs, so a
+// contract redeployed at the address does not inherit them.
+func (r *RuleRegistry) ResetDynamicState(addr common.Address) {
+	if r == nil {
+		return
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for _, rule := range []*FunctionRule{r.rules[addr], r.pending[addr]} {
+		if rule != nil {
+			rule.resetDynamicState()
+		}
+	}
+}
+
+// resetDynamicState drops the discovered slots of every variable of the rule.
+func (r *FunctionRule) resetDynamicState() {
+	for i := range r.FunctionShield {
+		r.FunctionShield[i].resetDynamicState()
+	}
+	for i := range r.FunctionAllow {
+		r.FunctionAllow[i].resetDynamicState()
+	}
+	for i := range r.ShieldExprs {
+		r.ShieldExprs[i].eachVariable((*Variable).resetDynamicState)
+	}
+}
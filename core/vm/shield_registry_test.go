@@ -0,0 +1,78 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/holiman/uint256"
+)
+
+func TestRuleRegistryActivateOnTx(t *testing.T) {
+	var (
+		registry = NewRuleRegistry()
+		addr     = common.HexToAddress("0x01")
+		vote     = common.HexToHash("0xbeef")
+		current  = &FunctionRule{Functionname: "a9059cbb"}
+		proposed = &FunctionRule{Functionname: "a9059cbb", ActivationTxHash: vote}
+	)
+	registry.Register(addr, current)
+	registry.Register(addr, proposed)
+	if registry.Rule(addr) != current {
+		t.Fatal("pending rule took effect before its activation transaction")
+	}
+	if activated := registry.ActivateOnTx(common.HexToHash("0xdead")); len(activated) != 0 {
+		t.Fatalf("unrelated transaction activated %v", activated)
+	}
+	if activated := registry.ActivateOnTx(vote); len(activated) != 1 || activated[0] != addr {
+		t.Fatalf("activation mismatch: %v", activated)
+	}
+	if registry.Rule(addr) != proposed {
+		t.Error("rule not active after its activation transaction")
+	}
+}
+
+func TestRuleRegistryResetOnSelfDestruct(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	rule := &FunctionRule{
+		Functionname: "a9059cbb",
+		FunctionShield: []Variable{
+			{StartSlot: *uint256.NewInt(1)},
+			{IfMapping: true, MappingStart: *uint256.NewInt(2), StartSlot: *uint256.NewInt(2), Deep: 1},
+		},
+	}
+	for i := range rule.FunctionShield {
+		rule.FunctionShield[i].InitSlot()
+	}
+	balances := &rule.FunctionShield[1]
+	balances.IdentifyMap(*uint256.NewInt(2), *uint256.NewInt(0xaa), interpreter, scope)
+	balances.IdentifyMap(*uint256.NewInt(0xaa), *uint256.NewInt(0xbb), interpreter, scope)
+
+	interpreter.cfg.ShieldRegistry = NewRuleRegistry()
+	interpreter.cfg.ShieldRegistry.Register(shieldTestAddress, rule)
+	scope.Stack.push(new(uint256.Int))
+	if _, err := opSelfdestruct(new(uint64), interpreter, scope); err != errStopToken {
+		t.Fatal(err)
+	}
+	if len(balances.MapValue) != 0 || balances.Slot.Contains(*uint256.NewInt(0xaa)) {
+		t.Errorf("discovered mapping slots survived SELFDESTRUCT: %v", balances.Slot.Slots())
+	}
+	if !balances.Slot.Contains(*uint256.NewInt(2)) || !rule.FunctionShield[0].Slot.Contains(*uint256.NewInt(1)) {
+		t.Error("configured slots dropped by SELFDESTRUCT")
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/holiman/uint256"
+)
+
+// ContractShieldEvent groups the violations raised by one contract within one
+// call frame.
+type ContractShieldEvent struct {
+	Contract   common.Address
+	CallFrame  int // Index of the frame in the order frames were entered, 0 is the top call
+	Violations []ShieldViolation
+}
+
+// 【*】TransactionShieldReport aggregates the shield violations of a whole
+// transaction across every contract it reached, in the order they occurred.
+type TransactionShieldReport struct {
+	Events []ContractShieldEvent
+}
+
+// Blocked returns the number of operations the shield prevented.
+func (r *TransactionShieldReport) Blocked() int {
+	var blocked int
+	for _, event := range r.Events {
+		for _, violation := range event.Violations {
+			if violation.Blocked {
+				blocked++
+			}
+		}
+	}
+	return blocked
+}
+
+// GetLastTransactionShieldReport returns the report of the last transaction
+// whose top call frame completed.
+func (in *EVMInterpreter) GetLastTransactionShieldReport() TransactionShieldReport {
+	return in.lastShieldReport
+}
+
+// enterShieldFrame assigns an index to a new call frame, starting a new report
+// when the frame is the top call of a transaction.
+func (in *EVMInterpreter) enterShieldFrame() {
+	if len(in.shieldFrames) == 0 {
+		in.shieldReport = TransactionShieldReport{}
+		in.shieldFrameCount = 0
+		in.txWrittenSlots = nil
+		in.txAbortErr = nil
+	}
+	in.shieldFrames = append(in.shieldFrames, in.shieldFrameCount)
+	in.shieldFrameCount++
+}
+
+// exitShieldFrame leaves the current call frame, publishing the report once the
+// top call returns.
+func (in *EVMInterpreter) exitShieldFrame() {
+	in.shieldFrames = in.shieldFrames[:len(in.shieldFrames)-1]
+	if len(in.shieldFrames) == 0 {
+		in.lastShieldReport = in.shieldReport
+	}
+}
+
+// recordShieldEvent adds a violation to the report of the running transaction.
+func (in *EVMInterpreter) recordShieldEvent(violation ShieldViolation) {
+	if len(in.shieldFrames) == 0 {
+		return
+	}
+	frame := in.shieldFrames[len(in.shieldFrames)-1]
+	events := in.shieldReport.Events
+	for i := range events {
+		if events[i].Contract == violation.Contract && events[i].CallFrame == frame {
+			events[i].Violations = append(events[i].Violations, violation)
+			return
+		}
+	}
+	in.shieldReport.Events = append(events, ContractShieldEvent{
+		Contract:   violation.Contract,
+		CallFrame:  frame,
+		Violations: []ShieldViolation{violation},
+	})
+}
+
+// frameBlocked reports whether the shield prevented an operation of contract
+// within the current call frame.
+func (in *EVMInterpreter) frameBlocked(contract common.Address) bool {
+	if len(in.shieldFrames) == 0 {
+		return false
+	}
+	frame := in.shieldFrames[len(in.shieldFrames)-1]
+	for _, event := range in.shieldReport.Events {
+		if event.Contract != contract || event.CallFrame != frame {
+			continue
+		}
+		for _, violation := range event.Violations {
+			if violation.Blocked {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ShieldEvent is a single SSTORE seen by the shield.
+type ShieldEvent struct {
+	Contract common.Address
+	Slot     uint256.Int
+	Blocked  bool // Whether the shield decided to block the write
+}
+
+// TargetedSlot is a storage slot and the number of blocked writes to it.
+type TargetedSlot struct {
+	Contract common.Address `json:"contract"`
+	Slot     common.Hash    `json:"slot"`
+	Blocked  int            `json:"blocked"`
+}
+
+// 【*】BlockShieldReport summarizes the shield activity of a block.
+type BlockShieldReport struct {
+	BlockNumber       uint64        `json:"blockNumber"`
+	SstoreAttempts    int           `json:"sstoreAttempts"`
+	Blocked           int           `json:"blocked"`
+	AffectedContracts int           `json:"affectedContracts"`          // Contracts with at least one blocked write
+	MostTargetedSlot  *TargetedSlot `json:"mostTargetedSlot,omitempty"` // Slot with the most blocked writes, first reached on ties
+}
+
+// GenerateBlockShieldReport summarizes the SSTOREs of a block.
+func GenerateBlockShieldReport(blockNumber uint64, events []ShieldEvent) BlockShieldReport {
+	var (
+		report   = BlockShieldReport{BlockNumber: blockNumber, SstoreAttempts: len(events)}
+		affected = make(map[common.Address]struct{})
+		targeted = make(map[TargetedSlot]int)
+	)
+	for _, event := range events {
+		if !event.Blocked {
+			continue
+		}
+		report.Blocked++
+		affected[event.Contract] = struct{}{}
+
+		key := TargetedSlot{Contract: event.Contract, Slot: event.Slot.Bytes32()}
+		targeted[key]++
+		if report.MostTargetedSlot == nil || targeted[key] > report.MostTargetedSlot.Blocked {
+			key.Blocked = targeted[key]
+			report.MostTargetedSlot = &key
+		}
+	}
+	report.AffectedContracts = len(affected)
+	return report
+}
+
+// Write persists the report as <dir>/<blockNumber>.json. The file is replaced
+// atomically, so readers never see a partially written report.
+func (r *BlockShieldReport) Write(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(r, "", "	")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(context.Background(), filepath.Join(dir, fmt.Sprintf("%d.json", r.BlockNumber)), data, 0644)
+}
+
+// ShieldEvents returns the SSTOREs seen since the EVM was created, recorded
+// only if ShieldReportDir is configured.
+func (in *EVMInterpreter) ShieldEvents() []ShieldEvent {
+	return in.shieldEvents
+}
+
+// recordSstore adds an SSTORE to the events of the block report, if enabled.
+func (in *EVMInterpreter) recordSstore(scope *ScopeContext, loc uint256.Int, allowed bool) {
+	if in.cfg.ShieldReportDir == "" {
+		return
+	}
+	in.shieldEvents = append(in.shieldEvents, ShieldEvent{
+		Contract: scope.Contract.Address(),
+		Slot:     loc,
+		Blocked:  !allowed,
+	})
+}
@@ -0,0 +1,104 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/holiman/uint256"
+)
+
+// panicSelector is the selector of the Panic(uint256) error raised by solc.
+var panicSelector = crypto.Keccak256([]byte("Panic(uint256)"))[:4]
+
+// shieldViolationSelector is the selector of the ShieldViolation error blocked
+// writes revert with under RevertOnBlock.
+var shieldViolationSelector = crypto.Keccak256([]byte("ShieldViolation(bytes32,bytes32,string)"))[:4]
+
+// shieldViolationArgs are the arguments of the ShieldViolation error.
+var shieldViolationArgs = func() abi.Arguments {
+	bytes32, _ := abi.NewType("bytes32", "", nil)
+	str, _ := abi.NewType("string", "", nil)
+	return abi.Arguments{{Name: "slot", Type: bytes32}, {Name: "value", Type: bytes32}, {Name: "reason", Type: str}}
+}()
+
+// 【*】EncodeShieldViolationRevert encodes a blocked write as the revert data
+// of the Solidity custom error
+//
+//	error ShieldViolation(bytes32 slot, bytes32 value, string reason);
+//
+// so callers and tooling can decode it like any other custom error.
+func EncodeShieldViolationRevert(slot, value uint256.Int, reason string) []byte {
+	packed, err := shieldViolationArgs.Pack(slot.Bytes32(), value.Bytes32(), reason)
+	if err != nil {
+		panic(err) // the argument types are fixed
+	}
+	return append(append([]byte{}, shieldViolationSelector...), packed...)
+}
+
+// KnownAttackRevertReasons are revert reasons exploit attempts typically die
+// with when the protected contract's own checks stop them.
+var KnownAttackRevertReasons = []string{
+	"ERC20: transfer amount exceeds balance",
+	"ERC20: transfer amount exceeds allowance",
+	"ERC20: insufficient allowance",
+	"ERC20: burn amount exceeds balance",
+	"ReentrancyGuard: reentrant call",
+	"Ownable: caller is not the owner",
+	"SafeMath: subtraction overflow",
+}
+
+// decodeRevertData renders revert data as the Solidity error it encodes.
+func decodeRevertData(data []byte) (decoded string, reason string) {
+	if reason, err := abi.UnpackRevert(data); err == nil {
+		return fmt.Sprintf("Error(%q)", reason), reason
+	}
+	switch {
+	case len(data) == 36 && bytes.Equal(data[:4], panicSelector):
+		return fmt.Sprintf("Panic(%#x)", new(big.Int).SetBytes(data[4:])), ""
+	case len(data) >= 4:
+		return fmt.Sprintf("custom error %#x", data[:4]), ""
+	}
+	return "no revert data", ""
+}
+
+// 【*】analyzeRevert reports the reason a shielded function reverted with and
+// whether it looks like an attack failing on the contract's own checks or on
+// an operation the shield blocked.
+func (c *Contract) analyzeRevert(data []byte, interpreter *EVMInterpreter, scope *ScopeContext) {
+	if !c.AnalyzeRevertData || c.matchedSelector == "" {
+		return
+	}
+	decoded, reason := decodeRevertData(data)
+	message := "reverted with " + decoded
+	for _, known := range KnownAttackRevertReasons {
+		if reason == known {
+			message += ", a known attack signature"
+			break
+		}
+	}
+	if interpreter.frameBlocked(c.Address()) {
+		message += ", after the shield blocked an operation"
+	} else {
+		message += ", without shield intervention"
+	}
+	interpreter.emitViolation(scope, ShieldViolation{Reason: message})
+}
@@ -0,0 +1,226 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"encoding/hex"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/holiman/uint256"
+)
+
+// Selectors of the ERC-4626 entry points.
+var (
+	erc4626Deposit  = Selector{0x6e, 0x55, 0x3f, 0x65} // deposit(uint256,address)
+	erc4626Mint     = Selector{0x94, 0xbf, 0x80, 0x4d} // mint(uint256,address)
+	erc4626Withdraw = Selector{0xb4, 0x60, 0xaf, 0x94} // withdraw(uint256,address,address)
+	erc4626Redeem   = Selector{0xba, 0x08, 0x76, 0x52} // redeem(uint256,address,address)
+)
+
+// erc4626MaxDeltaPercent bounds how much a single call may move the vault totals.
+const erc4626MaxDeltaPercent = 50
+
+// 【*】ERC4626VaultRule returns the rules protecting the share price of an
+// ERC-4626 vault: deposit and mint may only grow totalAssets and totalShares,
+// withdraw and redeem may only shrink them, and no call may move either total
+// by more than half of its current value.
+func ERC4626VaultRule(totalAssetsSlot, totalSharesSlot uint256.Int) []FunctionRule {
+	totals := func(increase bool) []Variable {
+		vars := make([]Variable, 0, 2)
+		for _, slot := range []uint256.Int{totalAssetsSlot, totalSharesSlot} {
+			vars = append(vars, Variable{
+				StartSlot:           slot,
+				MaxDeltaPercent:     erc4626MaxDeltaPercent,
+				IfMonotonicIncrease: increase,
+				OnlyDecrease:        !increase,
+			})
+		}
+		vars[0].Name, vars[1].Name = "totalAssets", "totalShares"
+		return vars
+	}
+	return []FunctionRule{
+		{
+			Functionname:   hex.EncodeToString(erc4626Deposit[:]),
+			Selectors:      []Selector{erc4626Mint},
+			FunctionShield: totals(true),
+		},
+		{
+			Functionname:   hex.EncodeToString(erc4626Withdraw[:]),
+			Selectors:      []Selector{erc4626Redeem},
+			FunctionShield: totals(false),
+		},
+	}
+}
+
+// 【*】PermitNonceRule returns a variable protecting the EIP-2612
+// nonces[owner] mapping: each nonce may only grow, so a used permit signature
+// cannot be replayed by resetting the nonce. The slots of the owners are
+// discovered as the mapping is accessed.
+func PermitNonceRule(noncesMappingSlot uint256.Int) Variable {
+	return Variable{
+		Name:                "nonces",
+		StartSlot:           noncesMappingSlot,
+		IfMapping:           true,
+		MappingStart:        noncesMappingSlot,
+		MappingValueType:    "uint256",
+		IfMonotonicIncrease: true,
+	}
+}
+
+// 【*】ERC721OwnershipRule returns a variable protecting the _owners[tokenId]
+// mapping of an ERC-721 token: a token may only change hands if the balance of
+// its previous owner was decremented earlier in the same transaction, which
+// rules out duplicating ownership. The _balances mapping is assumed to follow
+// _owners as in the OpenZeppelin layout; set OwnerBalanceSlot otherwise.
+func ERC721OwnershipRule(ownerOfSlot uint256.Int) Variable {
+	return Variable{
+		Name:             "owners",
+		StartSlot:        ownerOfSlot,
+		IfMapping:        true,
+		MappingStart:     ownerOfSlot,
+		MappingValueType: "address",
+		IfERC721Owner:    true,
+		OwnerBalanceSlot: *new(uint256.Int).AddUint64(&ownerOfSlot, 1),
+	}
+}
+
+// ownershipTransferBacked reports whether the balance of prevOwner has been
+// decremented in the running transaction. Minting, i.e. a zero previous owner,
+// is always backed.
+func (v *Variable) ownershipTransferBacked(prevOwner *uint256.Int, interpreter *EVMInterpreter, scope *ScopeContext) bool {
+	if prevOwner.IsZero() {
+		return true
+	}
+	var (
+		ownerKey   = prevOwner.Bytes32()
+		mappingKey = v.OwnerBalanceSlot.Bytes32()
+		slot       = crypto.Keccak256Hash(ownerKey[:], mappingKey[:])
+		db         = interpreter.evm.StateDB
+		before     = db.GetCommittedState(scope.Contract.Address(), slot)
+		now        = db.GetState(scope.Contract.Address(), slot)
+	)
+	return new(uint256.Int).SetBytes(now[:]).Lt(new(uint256.Int).SetBytes(before[:]))
+}
+
+// 【*】TWAPProtectionRule returns the variables guarding a Uniswap V2 style
+// TWAP oracle against single-block manipulation: the price accumulator may be
+// updated at most once per block, and the last observation timestamp may only
+// move forward.
+func TWAPProtectionRule(accumulatorSlot, lastBlockTimestampSlot uint256.Int) []Variable {
+	return []Variable{
+		{
+			Name:              "priceCumulativeLast",
+			StartSlot:         accumulatorSlot,
+			MaxWritesPerBlock: 1,
+		},
+		{
+			Name:                "blockTimestampLast",
+			StartSlot:           lastBlockTimestampSlot,
+			IfMonotonicIncrease: true,
+		},
+	}
+}
+
+// Selectors of the ERC-777 entry points moving balances. ERC-777 tokens keep
+// the ERC-20 transfer functions, which invoke the same hooks.
+var (
+	erc777Send         = Selector{0x9b, 0xd9, 0xbb, 0xc6} // send(address,uint256,bytes)
+	erc777OperatorSend = Selector{0x62, 0xad, 0x1b, 0x83} // operatorSend(address,address,uint256,bytes,bytes)
+	erc777Burn         = Selector{0xfe, 0x9d, 0x93, 0x03} // burn(uint256,bytes)
+	erc777OperatorBurn = Selector{0xfc, 0x67, 0x3c, 0x4f} // operatorBurn(address,uint256,bytes,bytes)
+	erc20Transfer      = Selector{0xa9, 0x05, 0x9c, 0xbb} // transfer(address,uint256)
+	erc20TransferFrom  = Selector{0x23, 0xb8, 0x72, 0xdd} // transferFrom(address,address,uint256)
+)
+
+// erc777BigValueThreshold caps the balances of ERC777ReentrancyRule at 2^255-1,
+// far above any real supply.
+var erc777BigValueThreshold = *new(uint256.Int).Lsh(uint256.NewInt(1), 255)
+
+// 【*】ERC777ReentrancyRule returns the rule protecting the _balances mapping
+// of an ERC-777 token against double spending through its tokensToSend and
+// tokensReceived hooks: once a balance moving function runs, a balance write
+// from a deeper frame of the same token, i.e. one reached from a hook, is
+// blocked. The balance slots of the accounts are discovered as the mapping is
+// accessed. Outside of reentrancy only balances that wrapped around are
+// rejected, so regular transfers pass.
+func ERC777ReentrancyRule(balancesSlot uint256.Int) FunctionRule {
+	return FunctionRule{
+		Functionname:     hex.EncodeToString(erc777Send[:]),
+		Selectors:        []Selector{erc777OperatorSend, erc777Burn, erc777OperatorBurn, erc20Transfer, erc20TransferFrom},
+		NoSelfReentrancy: true,
+		FunctionShield: []Variable{{
+			Name:              "balances",
+			StartSlot:         balancesSlot,
+			IfMapping:         true,
+			MappingStart:      balancesSlot,
+			IfBigValueProtect: true,
+			BigValueThreshold: erc777BigValueThreshold,
+		}},
+	}
+}
+
+// Bounds of the Curve pool rule: neither D nor a pool balance may move by more
+// than curveMaxDeltaPercent in one write, and the balances must keep covering
+// curveMinCoveragePercent of D.
+const (
+	curveMaxDeltaPercent    = 10
+	curveMinCoveragePercent = 90
+)
+
+// 【*】CurvePoolInvariantRule returns the variables guarding a Curve style
+// StableSwap pool against price manipulation: the stored D invariant and the
+// balances[numCoins] array may each move by at most a tenth per write, and
+// after any such write the sum of the balances must stay at or above 90% of D.
+// A failed sum check is reported, not reverted, like every post-condition.
+func CurvePoolInvariantRule(dSlot, balancesStartSlot uint256.Int, numCoins int) []Variable {
+	covered := func(newVal uint256.Int, db StateDB, addr common.Address) bool {
+		return curveBalancesCoverD(db, addr, dSlot, balancesStartSlot, numCoins)
+	}
+	return []Variable{
+		{
+			Name:               "D",
+			StartSlot:          dSlot,
+			MaxDeltaPercent:    curveMaxDeltaPercent,
+			PostConditionFuncs: []func(uint256.Int, StateDB, common.Address) bool{covered},
+		},
+		{
+			Name:               "balances",
+			StartSlot:          balancesStartSlot,
+			IfFixedArray:       true,
+			FixedArrayLen:      numCoins,
+			MaxDeltaPercent:    curveMaxDeltaPercent,
+			PostConditionFuncs: []func(uint256.Int, StateDB, common.Address) bool{covered},
+		},
+	}
+}
+
+// curveBalancesCoverD reports whether balances[0] + ... + balances[numCoins-1]
+// is at least curveMinCoveragePercent of D in the current state.
+func curveBalancesCoverD(db StateDB, addr common.Address, dSlot, balancesStartSlot uint256.Int, numCoins int) bool {
+	var sum, slot uint256.Int
+	for i := 0; i < numCoins; i++ {
+		balance := db.GetState(addr, slot.AddUint64(&balancesStartSlot, uint64(i)).Bytes32())
+		if _, overflow := sum.AddOverflow(&sum, new(uint256.Int).SetBytes(balance[:])); overflow {
+			return true
+		}
+	}
+	d := db.GetState(addr, dSlot.Bytes32())
+	min := new(uint256.Int).SetBytes(d[:])
+	min.Div(min, uint256.NewInt(100)).Mul(min, uint256.NewInt(curveMinCoveragePercent))
+	return !sum.Lt(min)
+}
@@ -0,0 +1,199 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/holiman/uint256"
+)
+
+// Limits keeping the bytecode scan cheap: constant keccak inputs produced by
+// solc are a handful of words written to scratch space.
+const (
+	constMemoryLimit   = 1024
+	constHashSizeLimit = 128
+)
+
+var (
+	slotComputerTable     JumpTable
+	slotComputerTableOnce sync.Once
+)
+
+// slotComputerJumpTable returns the instruction set used for the stack effects
+// of the analysis. It is built lazily: referencing the package level tables
+// directly would form an initialization cycle through the call opcodes.
+func slotComputerJumpTable() *JumpTable {
+	slotComputerTableOnce.Do(func() { slotComputerTable = newMergeInstructionSet() })
+	return &slotComputerTable
+}
+
+// 【*】CompileTimeSlotComputer constant-folds the keccak256 computations whose
+// inputs are fully known from the bytecode, e.g. the storage slot of
+// `m[5]` for a mapping m at slot 0. The resulting hashes can populate
+// Variable.Slot before execution instead of being discovered by IdentifyMap
+// at runtime.
+//
+// The analysis is a single linear pass tracking constant stack items and
+// memory words within a basic block. Anything not statically known is
+// treated as unknown, so the computer never produces a wrong slot, it only
+// misses some.
+type CompileTimeSlotComputer struct {
+	preimages map[common.Hash][]byte
+}
+
+// NewCompileTimeSlotComputer analyses code and records the outcome of every
+// constant keccak256 computation in it.
+func NewCompileTimeSlotComputer(code []byte) *CompileTimeSlotComputer {
+	s := &CompileTimeSlotComputer{preimages: make(map[common.Hash][]byte)}
+	s.analyse(code)
+	return s
+}
+
+// Preimages returns the constant hashes found in the code with their inputs.
+func (s *CompileTimeSlotComputer) Preimages() map[common.Hash][]byte {
+	return s.preimages
+}
+
+// Populate feeds every constant hash to the variable as if it had been
+// observed by the SHA3 opcode. Variables holding dynamic mapping values need
+// the state to be resolved and are left to runtime discovery.
+func (s *CompileTimeSlotComputer) Populate(v *Variable) {
+	if !v.IfMapping || v.MappingValueType == "Dynamic" {
+		return
+	}
+	for hash, preimage := range s.preimages {
+		var value uint256.Int
+		value.SetBytes(hash[:])
+		if slot, ok := v.mappingSlot(preimage, value); ok {
+			v.IdentifyMap(slot, value, nil, nil)
+		}
+	}
+}
+
+func (s *CompileTimeSlotComputer) analyse(code []byte) {
+	var (
+		stack  []*uint256.Int          // nil entries are unknown values
+		memory = make(map[uint64]byte) // known memory bytes
+		jt     = slotComputerJumpTable()
+	)
+	reset := func() {
+		stack = stack[:0]
+		memory = make(map[uint64]byte)
+	}
+	pop := func() *uint256.Int {
+		if len(stack) == 0 {
+			return nil
+		}
+		item := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return item
+	}
+	for pc := uint64(0); pc < uint64(len(code)); pc++ {
+		op := OpCode(code[pc])
+		switch {
+		case op.IsPush():
+			size := uint64(op - PUSH1 + 1)
+			stack = append(stack, new(uint256.Int).SetBytes(getData(code, pc+1, size)))
+			pc += size
+
+		case op >= DUP1 && op <= DUP16:
+			n := int(op - DUP1 + 1)
+			if len(stack) < n {
+				reset()
+				continue
+			}
+			stack = append(stack, stack[len(stack)-n])
+
+		case op >= SWAP1 && op <= SWAP16:
+			n := int(op - SWAP1 + 1)
+			if len(stack) <= n {
+				reset()
+				continue
+			}
+			top := len(stack) - 1
+			stack[top], stack[top-n] = stack[top-n], stack[top]
+
+		case op == MSTORE:
+			off, val := pop(), pop()
+			if off == nil || val == nil || !off.LtUint64(constMemoryLimit) {
+				memory = make(map[uint64]byte)
+				continue
+			}
+			word := val.Bytes32()
+			for i, b := range word {
+				memory[off.Uint64()+uint64(i)] = b
+			}
+
+		case op == KECCAK256:
+			off, size := pop(), pop()
+			stack = append(stack, s.hash(off, size, memory))
+
+		case blockBoundary(op):
+			reset()
+
+		default:
+			pops := jt[op].minStack
+			pushes := int(params.StackLimit) + pops - jt[op].maxStack
+			if len(stack) < pops {
+				reset()
+				continue
+			}
+			stack = stack[:len(stack)-pops]
+			for i := 0; i < pushes; i++ {
+				stack = append(stack, nil)
+			}
+			// Any other memory access may overwrite the tracked words
+			if jt[op].memorySize != nil {
+				memory = make(map[uint64]byte)
+			}
+		}
+	}
+}
+
+// blockBoundary reports whether op ends the straight-line code the analysis
+// can follow, or is not a valid instruction at all.
+func blockBoundary(op OpCode) bool {
+	switch op {
+	case JUMPDEST, JUMP, JUMPI, STOP, RETURN, REVERT, SELFDESTRUCT, INVALID:
+		return true
+	}
+	_, defined := opCodeToString[op]
+	return !defined
+}
+
+// hash folds a keccak256 over known memory, returning nil if any input byte
+// is unknown.
+func (s *CompileTimeSlotComputer) hash(off, size *uint256.Int, memory map[uint64]byte) *uint256.Int {
+	if off == nil || size == nil || !off.LtUint64(constMemoryLimit) || !size.LtUint64(constHashSizeLimit+1) || size.Uint64() < 32 {
+		return nil
+	}
+	data := make([]byte, size.Uint64())
+	for i := range data {
+		b, ok := memory[off.Uint64()+uint64(i)]
+		if !ok {
+			return nil
+		}
+		data[i] = b
+	}
+	hash := crypto.Keccak256Hash(data)
+	s.preimages[hash] = data
+	return new(uint256.Int).SetBytes(hash[:])
+}
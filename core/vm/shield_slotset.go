@@ -0,0 +1,150 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/holiman/uint256"
+)
+
+// 【*】SlotSet is a set of storage slots safe for concurrent use. The same rule
+// Variable may be checked by several EVMs at once (e.g. eth_call next to block
+// import), so Shield, IdentifyMap and DynamicUpdate must not race on it.
+type SlotSet struct {
+	slots sync.Map // uint256.Int -> struct{}
+	size  int64    // Number of slots, updated atomically
+}
+
+// NewSlotSet creates a set holding the given slots.
+func NewSlotSet(slots ...uint256.Int) *SlotSet {
+	s := new(SlotSet)
+	for _, slot := range slots {
+		s.Add(slot)
+	}
+	return s
+}
+
+// Add inserts slot into the set.
+func (s *SlotSet) Add(slot uint256.Int) {
+	if _, loaded := s.slots.LoadOrStore(slot, struct{}{}); !loaded {
+		atomic.AddInt64(&s.size, 1)
+	}
+}
+
+// Remove deletes slot from the set.
+func (s *SlotSet) Remove(slot uint256.Int) {
+	if _, loaded := s.slots.LoadAndDelete(slot); loaded {
+		atomic.AddInt64(&s.size, -1)
+	}
+}
+
+// Contains reports whether slot is in the set. A nil set is empty.
+func (s *SlotSet) Contains(slot uint256.Int) bool {
+	if s == nil {
+		return false
+	}
+	_, ok := s.slots.Load(slot)
+	return ok
+}
+
+// Cardinality returns the number of slots in the set.
+func (s *SlotSet) Cardinality() int {
+	if s == nil {
+		return 0
+	}
+	return int(atomic.LoadInt64(&s.size))
+}
+
+// Slots returns the slots of the set in ascending order.
+func (s *SlotSet) Slots() []uint256.Int {
+	if s == nil {
+		return nil
+	}
+	slots := make([]uint256.Int, 0, s.Cardinality())
+	s.slots.Range(func(key, _ interface{}) bool {
+		slots = append(slots, key.(uint256.Int))
+		return true
+	})
+	sort.Slice(slots, func(i, j int) bool { return slots[i].Lt(&slots[j]) })
+	return slots
+}
+
+// MarshalJSON encodes the set as an array of hex slots.
+func (s *SlotSet) MarshalJSON() ([]byte, error) {
+	slots := s.Slots()
+	hexes := make([]string, len(slots))
+	for i := range slots {
+		hexes[i] = slots[i].Hex()
+	}
+	return json.Marshal(hexes)
+}
+
+// UnmarshalJSON decodes an array of hex slots into the set.
+func (s *SlotSet) UnmarshalJSON(input []byte) error {
+	var slots []uint256.Int
+	if err := json.Unmarshal(input, &slots); err != nil {
+		return err
+	}
+	for _, slot := range slots {
+		s.Add(slot)
+	}
+	return nil
+}
+
+// 【*】SlotRange is an inclusive range of contiguous storage slots, e.g. the
+// elements of a fixed size array, protected as a single entry.
+type SlotRange struct {
+	Start uint256.Int
+	End   uint256.Int
+}
+
+// mergeSlotRanges sorts the ranges by start and merges overlapping or adjacent
+// ones, so that a binary search over the result finds any covering range.
+func mergeSlotRanges(ranges []SlotRange) []SlotRange {
+	if len(ranges) < 2 {
+		return ranges
+	}
+	sorted := make([]SlotRange, len(ranges))
+	copy(sorted, ranges)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start.Lt(&sorted[j].Start) })
+
+	merged := sorted[:1]
+	for _, r := range sorted[1:] {
+		last := &merged[len(merged)-1]
+		next, overflow := new(uint256.Int).AddOverflow(&last.End, uint256.NewInt(1))
+		if overflow || !r.Start.Gt(next) {
+			if r.End.Gt(&last.End) {
+				last.End = r.End
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// rangesContain reports whether loc falls into one of the sorted, disjoint
+// ranges, in O(log n).
+func rangesContain(ranges []SlotRange, loc *uint256.Int) bool {
+	// Index of the first range starting after loc
+	i := sort.Search(len(ranges), func(i int) bool { return ranges[i].Start.Gt(loc) })
+	return i > 0 && !loc.Gt(&ranges[i-1].End)
+}
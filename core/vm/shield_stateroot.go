@@ -0,0 +1,65 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// postStateRooter is implemented by StateDBs that can compute the state root in
+// the middle of a transaction without finalising the state, such as
+// state.StateDB.
+type postStateRooter interface {
+	PostStateRoot(deleteEmptyObjects bool) common.Hash
+}
+
+// 【*】checkPostStateRoot verifies the ExpectedPostStateRoot of the rule of a
+// completed frame. The root is the one the state would commit to at this
+// point, i.e. before the sender is refunded and the miner paid. Only the
+// outermost frame of the contract is checked: its nested frames, including the
+// DELEGATECALLs inheriting the rule, return before the function is complete.
+//
+// A mismatch fails the frame and, through txAbortErr, every frame still running
+// in the transaction, so the whole transaction reverts.
+func (in *EVMInterpreter) checkPostStateRoot(contract *Contract) error {
+	if contract.ExpectedPostStateRoot == (common.Hash{}) || in.frameDepth(contract.Address()) > 1 {
+		return nil
+	}
+	db, ok := in.evm.StateDB.(postStateRooter)
+	if !ok {
+		in.txAbortErr = fmt.Errorf("%w: state root not available from %T", ErrPostStateRootMismatch, in.evm.StateDB)
+		return in.txAbortErr
+	}
+	if root := db.PostStateRoot(in.evm.chainRules.IsEIP158); root != contract.ExpectedPostStateRoot {
+		in.txAbortErr = fmt.Errorf("%w: have %x, want %x", ErrPostStateRootMismatch, root, contract.ExpectedPostStateRoot)
+		return in.txAbortErr
+	}
+	return nil
+}
+
+// frameDepth counts the active frames of addr, including the running one.
+func (in *EVMInterpreter) frameDepth(addr common.Address) int {
+	depth := 0
+	for _, frame := range in.callStack {
+		if frame == addr {
+			depth++
+		}
+	}
+	return depth
+}
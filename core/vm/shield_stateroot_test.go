@@ -0,0 +1,72 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state"
+)
+
+func TestExpectedPostStateRoot(t *testing.T) {
+	interpreter, _ := newShieldTestEnv()
+	db := interpreter.evm.StateDB.(*state.StateDB)
+	db.AddAddressToAccessList(shieldTestAddress)
+	db.SetNonce(shieldTestAddress, 1) // not deleted as empty
+	// sstore(0, 1)
+	code := []byte{byte(PUSH1), 1, byte(PUSH1), 0, byte(SSTORE), byte(STOP)}
+
+	expected := db.Copy()
+	expected.SetState(shieldTestAddress, common.Hash{}, common.BigToHash(big.NewInt(1)))
+	root := expected.IntermediateRoot(true)
+
+	run := func(want common.Hash) error {
+		contract := NewContract(AccountRef(common.Address{}), AccountRef(shieldTestAddress), new(big.Int), 100000)
+		contract.Code = code
+		contract.ExpectedPostStateRoot = want
+		_, err := interpreter.Run(contract, nil, false)
+		return err
+	}
+	if err := run(root); err != nil {
+		t.Fatalf("matching root rejected: %v", err)
+	}
+	if err := run(common.HexToHash("0xbad")); !errors.Is(err, ErrPostStateRootMismatch) {
+		t.Fatalf("mismatching root: have %v, want %v", err, ErrPostStateRootMismatch)
+	}
+
+	// Nested frames of the contract, e.g. DELEGATECALLs inheriting the rule, are
+	// not checked against the root of the complete function
+	interpreter.callStack = append(interpreter.callStack, shieldTestAddress)
+	if err := run(common.HexToHash("0xbad")); err != nil {
+		t.Errorf("nested frame checked: %v", err)
+	}
+	interpreter.callStack = interpreter.callStack[:0]
+
+	// Within a transaction the mismatch also fails the frames still running
+	interpreter.enterShieldFrame()
+	run(common.HexToHash("0xbad"))
+	if err := run(common.Hash{}); !errors.Is(err, ErrPostStateRootMismatch) {
+		t.Errorf("enclosing transaction not failed: %v", err)
+	}
+	interpreter.exitShieldFrame()
+	if err := run(common.Hash{}); err != nil {
+		t.Errorf("mismatch leaked into the next transaction: %v", err)
+	}
+}
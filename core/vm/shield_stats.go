@@ -0,0 +1,96 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// 【*】ShieldStats counts the work done by the shield, letting operators confirm
+// it is active without reading the logs. All counters are updated atomically.
+type ShieldStats struct {
+	Checks         uint64 // Variable.Shield evaluations
+	Blocked        uint64 // Evaluations that blocked the write
+	MappingUpdates uint64 // Mapping entries discovered by IdentifyMap
+	DynamicUpdates uint64 // Recomputations of dynamic variable slot sets
+	TotalCheckNs   int64  // Time spent in Variable.Shield, in nanoseconds
+}
+
+// GlobalStats collects the statistics of every shield check in the process.
+// It may be replaced before execution starts, e.g. by a per-node instance, or
+// set to nil to disable the counting.
+var GlobalStats = new(ShieldStats)
+
+// Stats returns a snapshot of GlobalStats.
+func Stats() ShieldStats {
+	return GlobalStats.Snapshot()
+}
+
+// ResetStats zeroes the counters of GlobalStats.
+func ResetStats() {
+	GlobalStats.Reset()
+}
+
+// Snapshot returns a consistent copy of each counter.
+func (s *ShieldStats) Snapshot() ShieldStats {
+	if s == nil {
+		return ShieldStats{}
+	}
+	return ShieldStats{
+		Checks:         atomic.LoadUint64(&s.Checks),
+		Blocked:        atomic.LoadUint64(&s.Blocked),
+		MappingUpdates: atomic.LoadUint64(&s.MappingUpdates),
+		DynamicUpdates: atomic.LoadUint64(&s.DynamicUpdates),
+		TotalCheckNs:   atomic.LoadInt64(&s.TotalCheckNs),
+	}
+}
+
+// Reset zeroes every counter.
+func (s *ShieldStats) Reset() {
+	if s == nil {
+		return
+	}
+	atomic.StoreUint64(&s.Checks, 0)
+	atomic.StoreUint64(&s.Blocked, 0)
+	atomic.StoreUint64(&s.MappingUpdates, 0)
+	atomic.StoreUint64(&s.DynamicUpdates, 0)
+	atomic.StoreInt64(&s.TotalCheckNs, 0)
+}
+
+func (s *ShieldStats) recordCheck(blocked bool, elapsed time.Duration) {
+	if s == nil {
+		return
+	}
+	atomic.AddUint64(&s.Checks, 1)
+	if blocked {
+		atomic.AddUint64(&s.Blocked, 1)
+	}
+	atomic.AddInt64(&s.TotalCheckNs, int64(elapsed))
+}
+
+func (s *ShieldStats) addMappingUpdate() {
+	if s != nil {
+		atomic.AddUint64(&s.MappingUpdates, 1)
+	}
+}
+
+func (s *ShieldStats) addDynamicUpdate() {
+	if s != nil {
+		atomic.AddUint64(&s.DynamicUpdates, 1)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"github.com/holiman/uint256"
+)
+
+// The taint tracking below is deliberately shallow: values returned by
+// BLOCKHASH are tainted, as are keccak256 digests over memory containing a
+// tainted word (the usual `keccak256(abi.encodePacked(blockhash(n), ...))`
+// randomness idiom). Taint is not propagated through arithmetic.
+
+// 【*】taintBlockhash marks a value produced by BLOCKHASH.
+func (c *Contract) taintBlockhash(val *uint256.Int) {
+	if !c.BlockhashShield || val.IsZero() {
+		return
+	}
+	if c.tainted == nil {
+		c.tainted = make(map[uint256.Int]struct{})
+	}
+	c.tainted[*val] = struct{}{}
+}
+
+// propagateTaint taints hash if the hashed data embeds a tainted word.
+func (c *Contract) propagateTaint(data []byte, hash *uint256.Int) {
+	if len(c.tainted) == 0 {
+		return
+	}
+	var word uint256.Int
+	for i := 0; i+32 <= len(data); i++ {
+		if _, ok := c.tainted[*word.SetBytes(data[i : i+32])]; ok {
+			c.tainted[*hash] = struct{}{}
+			return
+		}
+	}
+}
+
+// 【*】checkBlockhashTaint warns when a BLOCKHASH derived value is written to, or
+// used as the key of, a shielded slot. The write itself is left to the regular
+// shield logic.
+func (c *Contract) checkBlockhashTaint(loc, val uint256.Int, interpreter *EVMInterpreter, scope *ScopeContext) {
+	if len(c.tainted) == 0 {
+		return
+	}
+	_, valTainted := c.tainted[val]
+	_, locTainted := c.tainted[loc]
+	if !valTainted && !locTainted {
+		return
+	}
+	for i := 0; i < len(c.FunctionShield); i++ {
+		if c.FunctionShield[i].Slot.Contains(loc) {
+			interpreter.emitViolation(scope, ShieldViolation{
+				Slot:   loc,
+				Value:  val,
+				Reason: "shielded slot written from blockhash derived value",
+			})
+			return
+		}
+	}
+}
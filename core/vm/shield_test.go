@@ -0,0 +1,2370 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/holiman/uint256"
+)
+
+var shieldTestAddress = common.BytesToAddress([]byte("shielded"))
+
+// newShieldTestEnv returns an interpreter backed by an empty in-memory state
+// and a scope executing the shielded test contract.
+func newShieldTestEnv() (*EVMInterpreter, *ScopeContext) {
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	statedb.CreateAccount(shieldTestAddress)
+
+	blockCtx := BlockContext{
+		BlockNumber: big.NewInt(1),
+		CanTransfer: func(db StateDB, addr common.Address, amount *big.Int) bool {
+			return db.GetBalance(addr).Cmp(amount) >= 0
+		},
+		Transfer: func(db StateDB, sender, recipient common.Address, amount *big.Int) {
+			db.SubBalance(sender, amount)
+			db.AddBalance(recipient, amount)
+		},
+	}
+	evm := NewEVM(blockCtx, TxContext{}, statedb, params.TestChainConfig, Config{})
+	contract := NewContract(AccountRef(common.Address{}), AccountRef(shieldTestAddress), new(big.Int), 1000000)
+	return evm.interpreter, &ScopeContext{Memory: NewMemory(), Stack: newstack(), Contract: contract}
+}
+
+func setShieldTestSlot(interpreter *EVMInterpreter, slot, value uint64) {
+	interpreter.evm.StateDB.SetState(shieldTestAddress, common.BigToHash(new(big.Int).SetUint64(slot)), common.BigToHash(new(big.Int).SetUint64(value)))
+}
+
+func TestShieldUnderflowProtect(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	setShieldTestSlot(interpreter, 1, 100)
+
+	v := Variable{StartSlot: *uint256.NewInt(1), IfUnderflowProtect: true, IntendedDecrement: true}
+	v.InitSlot()
+
+	if write, _, err := v.Shield(*uint256.NewInt(1), *uint256.NewInt(40), interpreter, scope); err != nil || !write {
+		t.Error("decrement was blocked")
+	}
+	if write, _, err := v.Shield(*uint256.NewInt(1), *new(uint256.Int).SetAllOne(), interpreter, scope); err != nil || write {
+		t.Error("underflowed value was not blocked")
+	}
+	// Without a declared decrement intent the variable is shielded as usual.
+	v.IntendedDecrement = false
+	if write, _, err := v.Shield(*uint256.NewInt(1), *uint256.NewInt(40), interpreter, scope); err != nil || write {
+		t.Error("write to shielded slot was not blocked")
+	}
+}
+
+func TestShieldChainIDFilter(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+
+	v := Variable{StartSlot: *uint256.NewInt(1)}
+	v.InitSlot()
+
+	scope.Contract.ChainIDFilter = []uint64{5}
+	if write, _, err := v.Shield(*uint256.NewInt(1), *uint256.NewInt(1), interpreter, scope); err != nil || !write {
+		t.Error("rule enforced on a filtered out chain")
+	}
+	scope.Contract.ChainIDFilter = []uint64{5, interpreter.evm.ChainConfig().ChainID.Uint64()}
+	if write, _, err := v.Shield(*uint256.NewInt(1), *uint256.NewInt(1), interpreter, scope); err != nil || write {
+		t.Error("rule not enforced on a listed chain")
+	}
+}
+
+func TestShieldStateMachine(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	setShieldTestSlot(interpreter, 2, 0) // Open
+
+	v := Variable{StartSlot: *uint256.NewInt(2), StateMachine: &StateMachine{
+		States:      []string{"Open", "Closed", "Paused"},
+		Transitions: map[string][]string{"Open": {"Paused"}, "Paused": {"Open", "Closed"}},
+	}}
+	v.InitSlot()
+
+	for _, tt := range []struct {
+		to    uint64
+		write bool
+	}{
+		{0, true},  // Open -> Open
+		{1, false}, // Open -> Closed
+		{2, true},  // Open -> Paused
+		{7, false}, // unknown state
+	} {
+		if write, _, err := v.Shield(*uint256.NewInt(2), *uint256.NewInt(tt.to), interpreter, scope); err != nil || write != tt.write {
+			t.Errorf("transition to %d: have %v, want %v", tt.to, write, tt.write)
+		}
+	}
+}
+
+func TestCompileTimeSlotComputer(t *testing.T) {
+	// mstore(0, 5) mstore(0x20, 0) sload(keccak256(0, 0x40)), i.e. m[5] of a mapping at slot 0
+	code := common.Hex2Bytes("600560005260006020526040600020545b6000356000526040600020")
+	computer := NewCompileTimeSlotComputer(code)
+
+	want := crypto.Keccak256Hash(common.LeftPadBytes([]byte{5}, 32), make([]byte, 32))
+	if len(computer.Preimages()) != 1 {
+		t.Fatalf("expected a single constant hash, got %d", len(computer.Preimages()))
+	}
+	if _, ok := computer.Preimages()[want]; !ok {
+		t.Fatalf("constant hash %x not found", want)
+	}
+	v := Variable{IfMapping: true}
+	v.InitSlot()
+	computer.Populate(&v)
+	if !v.Slot.Contains(*new(uint256.Int).SetBytes(want[:])) {
+		t.Error("mapping slot not populated")
+	}
+}
+
+func TestRuleSelectors(t *testing.T) {
+	var rule Contract
+	if err := json.Unmarshal([]byte(`{"Functionname":"a9059cbb","Selectors":["0x12345678"]}`), &rule); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		input string
+		match bool
+	}{
+		{"a9059cbb", true},
+		{"12345678ffff", true},
+		{"87654321", false},
+	} {
+		c := &Contract{Input: common.Hex2Bytes(tt.input)}
+		if c.bindRule([]*Contract{&rule}); (c.matchedSelector != "") != tt.match {
+			t.Errorf("input %s: have match %v, want %v", tt.input, !tt.match, tt.match)
+		}
+		// An alias does not replace the primary selector written back with the rule
+		if tt.match && (c.Functionname != "a9059cbb" || c.matchedSelector != tt.input[:8]) {
+			t.Errorf("input %s: have Functionname %s, matched %s", tt.input, c.Functionname, c.matchedSelector)
+		}
+	}
+}
+
+func TestShieldBlockExtcodecopy(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	interpreter.evm.StateDB.SetCode(shieldTestAddress, []byte{0x60, 0x01, 0x60, 0x02})
+
+	extcodecopy := func() []byte {
+		scope.Memory = NewMemory()
+		scope.Memory.Resize(32)
+		scope.Stack.push(uint256.NewInt(4))                                    // length
+		scope.Stack.push(uint256.NewInt(0))                                    // code offset
+		scope.Stack.push(uint256.NewInt(0))                                    // memory offset
+		scope.Stack.push(new(uint256.Int).SetBytes(shieldTestAddress.Bytes())) // address
+		opExtCodeCopy(new(uint64), interpreter, scope)
+		return scope.Memory.GetCopy(0, 4)
+	}
+	if code := extcodecopy(); !bytes.Equal(code, []byte{0x60, 0x01, 0x60, 0x02}) {
+		t.Fatalf("unshielded code copy mismatch: %x", code)
+	}
+	interpreter.cfg.ShieldRegistry = NewRuleRegistry()
+	interpreter.cfg.ShieldRegistry.Register(shieldTestAddress, &FunctionRule{BlockExtcodecopy: true})
+	if code := extcodecopy(); !bytes.Equal(code, make([]byte, 4)) {
+		t.Errorf("shielded code was copied: %x", code)
+	}
+	interpreter.cfg.ShieldMode = ShieldModeAudit
+	if code := extcodecopy(); !bytes.Equal(code, []byte{0x60, 0x01, 0x60, 0x02}) {
+		t.Errorf("audit mode: code copy mismatch: %x", code)
+	}
+}
+
+func TestPrecompileShield(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	evm := interpreter.evm
+	identity := common.BytesToAddress([]byte{4})
+
+	scope.Contract.PrecompileRules = map[common.Address]PrecompileRule{
+		identity: {MaxInputSize: 8, ForbiddenInputs: []hexutil.Bytes{{0xde, 0xad}}},
+	}
+	for _, tt := range []struct {
+		input string
+		err   error
+	}{
+		{"0102", nil},
+		{"01dead02", ErrPrecompileShield},
+		{"010203040506070809", ErrPrecompileShield},
+	} {
+		var violations []ShieldViolation
+		interpreter.cfg.ShieldEventHook = func(v ShieldViolation) { violations = append(violations, v) }
+		for _, mode := range []ShieldMode{ShieldModeEnforce, ShieldModeAudit} {
+			interpreter.cfg.ShieldMode = mode
+			want := tt.err
+			if mode == ShieldModeAudit {
+				want = nil // audit mode only reports
+			}
+			ret, _, err := evm.Call(scope.Contract, identity, common.Hex2Bytes(tt.input), 100000, new(big.Int))
+			if err != want {
+				t.Errorf("mode %d, input %s: have %v, want %v", mode, tt.input, err, want)
+			}
+			if err == nil && !bytes.Equal(ret, common.Hex2Bytes(tt.input)) {
+				t.Errorf("mode %d, input %s: result changed to %x", mode, tt.input, ret)
+			}
+		}
+		if tt.err == nil && len(violations) != 0 {
+			t.Errorf("input %s: allowed call reported: %+v", tt.input, violations)
+		}
+		if tt.err != nil && (len(violations) != 2 || !violations[0].Blocked || violations[1].Blocked || violations[0].Contract != shieldTestAddress) {
+			t.Errorf("input %s: unexpected violations %+v", tt.input, violations)
+		}
+	}
+}
+
+func TestShieldSelfDestructBeneficiary(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	var (
+		vault    = common.BytesToAddress([]byte("vault"))
+		attacker = common.BytesToAddress([]byte("attacker"))
+	)
+	interpreter.evm.StateDB.AddBalance(shieldTestAddress, big.NewInt(100))
+	scope.Contract.AllowedSelfDestructBeneficiaries = []common.Address{vault}
+
+	scope.Stack.push(new(uint256.Int).SetBytes(attacker.Bytes()))
+	opSelfdestruct(new(uint64), interpreter, scope)
+
+	if balance := interpreter.evm.StateDB.GetBalance(attacker); balance.Sign() != 0 {
+		t.Errorf("attacker received %v wei", balance)
+	}
+	if balance := interpreter.evm.StateDB.GetBalance(vault); balance.Cmp(big.NewInt(100)) != 0 {
+		t.Errorf("vault balance: have %v, want 100", balance)
+	}
+
+	// Audit mode reports the beneficiary but leaves it alone
+	var reported bool
+	interpreter.cfg.ShieldEventHook = func(ShieldViolation) { reported = true }
+	interpreter.cfg.ShieldMode = ShieldModeAudit
+	if have := scope.Contract.selfDestructBeneficiary(attacker, interpreter, scope); have != attacker || !reported {
+		t.Errorf("audit mode: beneficiary %v, reported %v", have, reported)
+	}
+}
+
+func TestShieldAllowedEthRecipients(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	var (
+		vault    = common.BytesToAddress([]byte("vault"))
+		treasury = common.BytesToAddress([]byte("treasury"))
+		attacker = common.BytesToAddress([]byte("attacker"))
+	)
+	interpreter.evm.StateDB.AddBalance(shieldTestAddress, big.NewInt(100))
+	scope.Contract.AllowedEthRecipients = []common.Address{treasury}
+	scope.Contract.SafeVault = vault
+
+	call := func(to common.Address, value uint64) {
+		// retSize, retOffset, inSize, inOffset, value, address, gas
+		for _, item := range []*uint256.Int{new(uint256.Int), new(uint256.Int), new(uint256.Int), new(uint256.Int), uint256.NewInt(value), new(uint256.Int).SetBytes(to.Bytes()), new(uint256.Int)} {
+			scope.Stack.push(item)
+		}
+		if _, err := opCall(new(uint64), interpreter, scope); err != nil {
+			t.Fatal(err)
+		}
+		scope.Stack.pop()
+	}
+	call(treasury, 30)
+	call(attacker, 70)
+
+	for addr, want := range map[common.Address]int64{treasury: 30, attacker: 0, vault: 70} {
+		if balance := interpreter.evm.StateDB.GetBalance(addr); balance.Cmp(big.NewInt(want)) != 0 {
+			t.Errorf("balance of %v: have %v, want %v", addr, balance, want)
+		}
+	}
+
+	// Audit mode reports the transfer but leaves the recipient alone
+	var reported bool
+	interpreter.cfg.ShieldEventHook = func(ShieldViolation) { reported = true }
+	interpreter.cfg.ShieldMode = ShieldModeAudit
+	interpreter.evm.StateDB.AddBalance(shieldTestAddress, big.NewInt(10))
+	call(attacker, 10)
+	if balance := interpreter.evm.StateDB.GetBalance(attacker); balance.Cmp(big.NewInt(10)) != 0 || !reported {
+		t.Errorf("audit mode: attacker balance %v, reported %v", balance, reported)
+	}
+}
+
+func TestMonitoredEthBalances(t *testing.T) {
+	recipient := common.BytesToAddress([]byte("recipient"))
+	for _, mode := range []ShieldMode{ShieldModeEnforce, ShieldModeAudit} {
+		for _, op := range []string{"CALL", "SELFDESTRUCT"} {
+			interpreter, scope := newShieldTestEnv()
+			interpreter.cfg.ShieldMode = mode
+			var violations []ShieldViolation
+			interpreter.cfg.ShieldEventHook = func(v ShieldViolation) { violations = append(violations, v) }
+			interpreter.evm.StateDB.AddBalance(shieldTestAddress, big.NewInt(100))
+			scope.Contract.MonitoredEthBalances = []common.Address{shieldTestAddress}
+			scope.Contract.MaxEthDeltaWei = big.NewInt(50)
+
+			send := func(value uint64) {
+				if op == "SELFDESTRUCT" {
+					scope.Stack.push(new(uint256.Int).SetBytes(recipient.Bytes()))
+					opSelfdestruct(new(uint64), interpreter, scope)
+					return
+				}
+				// retSize, retOffset, inSize, inOffset, value, address, gas
+				for _, item := range []*uint256.Int{new(uint256.Int), new(uint256.Int), new(uint256.Int), new(uint256.Int), uint256.NewInt(value), new(uint256.Int).SetBytes(recipient.Bytes()), new(uint256.Int)} {
+					scope.Stack.push(item)
+				}
+				if _, err := opCall(new(uint64), interpreter, scope); err != nil {
+					t.Fatal(err)
+				}
+				scope.Stack.pop()
+			}
+			if op == "CALL" {
+				// Within the delta
+				send(50)
+				if len(violations) != 0 {
+					t.Errorf("mode %d, %s: transfer within the delta reported: %+v", mode, op, violations)
+				}
+			}
+			// Over the delta, counted from the first transfer of the function
+			send(50)
+			if len(violations) != 1 || violations[0].Blocked {
+				t.Errorf("mode %d, %s: unexpected violations %+v", mode, op, violations)
+			}
+			// The balance is only monitored, the transfer goes through in both modes
+			if balance := interpreter.evm.StateDB.GetBalance(recipient); balance.Cmp(big.NewInt(100)) != 0 {
+				t.Errorf("mode %d, %s: recipient balance %v, want 100", mode, op, balance)
+			}
+		}
+	}
+}
+
+func TestShieldEnforcementDelay(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+
+	v := Variable{StartSlot: *uint256.NewInt(4), EnforcementDelay: 10}
+	v.InitSlot()
+
+	for _, tt := range []struct {
+		block uint64
+		value uint64
+		write bool
+	}{
+		{1, 5, true},   // first change is recorded
+		{1, 5, true},   // rewriting the pending value
+		{5, 6, false},  // changed again within the delay
+		{11, 6, true},  // delay elapsed, change recorded again
+		{12, 7, false}, // new delay started at block 11
+	} {
+		interpreter.evm.Context.BlockNumber = new(big.Int).SetUint64(tt.block)
+		if write, _, err := v.Shield(*uint256.NewInt(4), *uint256.NewInt(tt.value), interpreter, scope); err != nil || write != tt.write {
+			t.Errorf("block %d value %d: have %v, want %v", tt.block, tt.value, write, tt.write)
+		}
+	}
+	// A change reverted with its transaction does not start the delay
+	snapshot := interpreter.evm.StateDB.Snapshot()
+	interpreter.evm.Context.BlockNumber = big.NewInt(30)
+	v.Shield(*uint256.NewInt(4), *uint256.NewInt(8), interpreter, scope)
+	interpreter.evm.StateDB.RevertToSnapshot(snapshot)
+	if write, _, err := v.Shield(*uint256.NewInt(4), *uint256.NewInt(9), interpreter, scope); err != nil || !write {
+		t.Error("reverted change started the delay")
+	}
+}
+
+func TestShieldBigValueProtect(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+
+	v := Variable{StartSlot: *uint256.NewInt(5), IfBigValueProtect: true, BigValueThreshold: *uint256.NewInt(1000)}
+	v.InitSlot()
+
+	maxSafe := new(uint256.Int).Sub(new(uint256.Int).SetAllOne(), uint256.NewInt(1000))
+	for _, tt := range []struct {
+		value *uint256.Int
+		write bool
+	}{
+		{uint256.NewInt(42), true},
+		{maxSafe, true},
+		{new(uint256.Int).AddUint64(maxSafe, 1), false},
+		{new(uint256.Int).SubUint64(new(uint256.Int).SetAllOne(), 1), false},
+	} {
+		if write, _, err := v.Shield(*uint256.NewInt(5), *tt.value, interpreter, scope); err != nil || write != tt.write {
+			t.Errorf("value %s: have %v, want %v", tt.value.Hex(), write, tt.write)
+		}
+	}
+}
+
+func TestShieldProtectDeleteUpdate(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+
+	for _, tt := range []struct {
+		deleteProtect, updateProtect bool
+		value                        uint64
+		write                        bool
+	}{
+		{true, false, 0, false},
+		{true, false, 7, true},
+		{false, true, 0, true},
+		{false, true, 7, false},
+		{true, true, 0, false},
+		{true, true, 7, false},
+	} {
+		v := Variable{StartSlot: *uint256.NewInt(6), IfProtectDelete: tt.deleteProtect, IfProtectUpdate: tt.updateProtect}
+		v.InitSlot()
+		if write, _, err := v.Shield(*uint256.NewInt(6), *uint256.NewInt(tt.value), interpreter, scope); err != nil || write != tt.write {
+			t.Errorf("delete %v update %v value %d: have %v, want %v", tt.deleteProtect, tt.updateProtect, tt.value, write, tt.write)
+		}
+	}
+}
+
+func TestIdentifyMapCycle(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+
+	outer := &Variable{IfMapping: true, Deep: 2}
+	outer.InitSlot()
+	inner := &Variable{IfMapping: true, Deep: 1, MappingStart: *uint256.NewInt(0x10)}
+	inner.InitSlot()
+	// Both nodes point at each other and at themselves
+	outer.MapValue = []*Variable{inner, outer}
+	inner.MapValue = []*Variable{outer, inner}
+
+	done := make(chan struct{})
+	go func() {
+		outer.IdentifyMap(*uint256.NewInt(5), *uint256.NewInt(0xaa), interpreter, scope)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("IdentifyMap did not return on a cyclic MapValue graph")
+	}
+}
+
+func TestIdentifyMapEntryTTL(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+
+	v := Variable{IfMapping: true, Deep: 1, MapEntryTTLBlocks: 10}
+	v.InitSlot()
+
+	interpreter.evm.Context.BlockNumber = big.NewInt(1)
+	v.IdentifyMap(*uint256.NewInt(0), *uint256.NewInt(0xaa), interpreter, scope)
+	interpreter.evm.Context.BlockNumber = big.NewInt(11)
+	v.IdentifyMap(*uint256.NewInt(0), *uint256.NewInt(0xbb), interpreter, scope)
+	if len(v.MapValue) != 2 {
+		t.Fatalf("entry pruned before its TTL: %d entries", len(v.MapValue))
+	}
+	interpreter.evm.Context.BlockNumber = big.NewInt(12)
+	v.IdentifyMap(*uint256.NewInt(0), *uint256.NewInt(0xcc), interpreter, scope)
+	if len(v.MapValue) != 2 || v.MapValue[0].MappingStart.Uint64() != 0xbb || v.MapValue[1].MappingStart.Uint64() != 0xcc {
+		t.Errorf("stale entry not pruned: %d entries", len(v.MapValue))
+	}
+	if v.Slot.Contains(*uint256.NewInt(0xaa)) || !v.Slot.Contains(*uint256.NewInt(0xcc)) {
+		t.Errorf("slot set out of sync with the live entries: %v", v.Slot.Slots())
+	}
+}
+
+func TestIdentifyMapIntermediateHash(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+
+	// mapping(address => mapping(address => uint256)) at slot 0
+	v := Variable{IfMapping: true, Deep: 1}
+	v.InitSlot()
+	v.IdentifyMap(*uint256.NewInt(0), *uint256.NewInt(0xaa), interpreter, scope)
+	v.IdentifyMap(*uint256.NewInt(0xaa), *uint256.NewInt(0xbb), interpreter, scope)
+
+	if !v.Slot.Contains(*uint256.NewInt(0xaa)) {
+		t.Error("intermediate hash not recorded at the outer level")
+	}
+	if !v.MapValue[0].Slot.Contains(*uint256.NewInt(0xbb)) {
+		t.Error("value hash not recorded at the inner level")
+	}
+	for _, loc := range []uint64{0xaa, 0xbb} {
+		if write, _, err := v.Shield(*uint256.NewInt(loc), *uint256.NewInt(1), interpreter, scope); err != nil || write {
+			t.Errorf("write to %#x not blocked", loc)
+		}
+	}
+}
+
+func TestTransactionShieldReport(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	interpreter.cfg.ShieldEventHook = func(ShieldViolation) {}
+
+	callee := &ScopeContext{Contract: NewContract(scope.Contract, AccountRef(common.HexToAddress("0xca11ee")), new(big.Int), 0)}
+
+	interpreter.enterShieldFrame()
+	interpreter.emitViolation(scope, ShieldViolation{Reason: "outer", Blocked: true})
+	interpreter.enterShieldFrame()
+	interpreter.emitViolation(callee, ShieldViolation{Reason: "inner"})
+	interpreter.exitShieldFrame()
+	interpreter.emitViolation(scope, ShieldViolation{Reason: "outer again"})
+	if len(interpreter.GetLastTransactionShieldReport().Events) != 0 {
+		t.Fatal("report published before the transaction completed")
+	}
+	interpreter.exitShieldFrame()
+
+	report := interpreter.GetLastTransactionShieldReport()
+	if len(report.Events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(report.Events))
+	}
+	if e := report.Events[0]; e.Contract != shieldTestAddress || e.CallFrame != 0 || len(e.Violations) != 2 {
+		t.Errorf("outer event mismatch: %+v", e)
+	}
+	if e := report.Events[1]; e.Contract != callee.Contract.Address() || e.CallFrame != 1 || len(e.Violations) != 1 {
+		t.Errorf("inner event mismatch: %+v", e)
+	}
+	if blocked := report.Blocked(); blocked != 1 {
+		t.Errorf("blocked count: have %d, want 1", blocked)
+	}
+}
+
+func TestShieldMonotonicIncrease(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	setShieldTestSlot(interpreter, 7, 10)
+
+	v := Variable{StartSlot: *uint256.NewInt(7), IfMonotonicIncrease: true}
+	v.InitSlot()
+
+	for _, tt := range []struct {
+		value uint64
+		write bool
+	}{
+		{11, true},
+		{10, false},
+		{3, false},
+	} {
+		if write, _, err := v.Shield(*uint256.NewInt(7), *uint256.NewInt(tt.value), interpreter, scope); err != nil || write != tt.write {
+			t.Errorf("value %d: have %v, want %v", tt.value, write, tt.write)
+		}
+	}
+}
+
+func TestForbiddenBytecodePatterns(t *testing.T) {
+	interpreter, _ := newShieldTestEnv()
+	var violations []ShieldViolation
+	interpreter.cfg.ShieldEventHook = func(v ShieldViolation) { violations = append(violations, v) }
+
+	attacker := common.HexToAddress("0xbad")
+	proxy := NewContract(AccountRef(common.Address{}), AccountRef(shieldTestAddress), nil, 0)
+	proxy.matchedSelector = "a9059cbb"
+	proxy.ForbiddenBytecodePatterns = []hexutil.Bytes{append([]byte{byte(PUSH20)}, attacker.Bytes()...)}
+	impl := NewContract(proxy, AccountRef(shieldTestAddress), nil, 0).AsDelegate()
+
+	clean := common.FromHex("6001600055")
+	if err := impl.SetCallCode(&shieldTestAddress, crypto.Keccak256Hash(clean), clean, interpreter); err != nil || len(violations) != 0 {
+		t.Fatalf("clean code rejected: %v, %+v", err, violations)
+	}
+	malicious := append(append([]byte{byte(PUSH20)}, attacker.Bytes()...), byte(SELFDESTRUCT))
+	if err := impl.SetCallCode(&shieldTestAddress, crypto.Keccak256Hash(malicious), malicious, interpreter); err != ErrForbiddenBytecodePattern {
+		t.Errorf("have %v, want %v", err, ErrForbiddenBytecodePattern)
+	}
+	// Audit mode reports the code but runs it
+	interpreter.cfg.ShieldMode = ShieldModeAudit
+	if err := impl.SetCallCode(&shieldTestAddress, crypto.Keccak256Hash(malicious), malicious, interpreter); err != nil {
+		t.Errorf("audit mode: %v", err)
+	}
+	if len(violations) != 2 || !violations[0].Blocked || violations[1].Blocked {
+		t.Errorf("unexpected violations: %+v", violations)
+	}
+}
+
+func TestForbiddenConstantValues(t *testing.T) {
+	interpreter, _ := newShieldTestEnv()
+	var violations []ShieldViolation
+	interpreter.cfg.ShieldEventHook = func(v ShieldViolation) { violations = append(violations, v) }
+
+	magic := new(uint256.Int).SetBytes(common.FromHex("0xdeadbeefdeadbeefdeadbeefdeadbeefdeadbeefdeadbeefdeadbeefdeadbeef"))
+	proxy := NewContract(AccountRef(common.Address{}), AccountRef(shieldTestAddress), nil, 0)
+	proxy.matchedSelector = "a9059cbb"
+	proxy.ForbiddenConstantValues = []uint256.Int{*magic}
+	impl := NewContract(proxy, AccountRef(shieldTestAddress), nil, 0).AsDelegate()
+
+	word := magic.Bytes32()
+	// The constant hidden in the data of another push is not an instruction
+	hidden := append(append([]byte{byte(PUSH1), byte(PUSH32)}, word[:]...), byte(STOP))
+	if err := impl.SetCallCode(&shieldTestAddress, crypto.Keccak256Hash(hidden), hidden, interpreter); err != nil {
+		t.Fatalf("push data misread as PUSH32: %v", err)
+	}
+	malicious := append(append([]byte{byte(PUSH32)}, word[:]...), byte(SELFDESTRUCT))
+	if err := impl.SetCallCode(&shieldTestAddress, crypto.Keccak256Hash(malicious), malicious, interpreter); err != ErrForbiddenConstantValue {
+		t.Errorf("have %v, want %v", err, ErrForbiddenConstantValue)
+	}
+	// Audit mode reports the code but runs it
+	interpreter.cfg.ShieldMode = ShieldModeAudit
+	if err := impl.SetCallCode(&shieldTestAddress, crypto.Keccak256Hash(malicious), malicious, interpreter); err != nil {
+		t.Errorf("audit mode: %v", err)
+	}
+	if len(violations) != 2 || !violations[0].Blocked || violations[1].Blocked {
+		t.Errorf("unexpected violations: %+v", violations)
+	}
+}
+
+func TestERC4626VaultRule(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	setShieldTestSlot(interpreter, 8, 1000) // totalAssets
+
+	rules := ERC4626VaultRule(*uint256.NewInt(8), *uint256.NewInt(9))
+	for _, tt := range []struct {
+		rule  int
+		value uint64
+		write bool
+	}{
+		{0, 1200, true},  // deposit grows assets
+		{0, 1600, false}, // deposit moving assets by more than 50%
+		{0, 900, false},  // deposit shrinking assets
+		{1, 800, true},   // withdraw shrinks assets
+		{1, 1100, false}, // withdraw growing assets
+		{1, 400, false},  // withdraw moving assets by more than 50%
+	} {
+		v := &rules[tt.rule].FunctionShield[0]
+		v.InitSlot()
+		if write, _, err := v.Shield(*uint256.NewInt(8), *uint256.NewInt(tt.value), interpreter, scope); err != nil || write != tt.write {
+			t.Errorf("rule %d value %d: have %v, want %v", tt.rule, tt.value, write, tt.write)
+		}
+	}
+	if !rules[0].matches(erc4626Mint[:]) || !rules[1].matches(erc4626Redeem[:]) {
+		t.Error("rules do not cover mint and redeem")
+	}
+}
+
+func TestShieldTimestampSensitiveSlots(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	scope.Contract.TimestampSensitiveSlots = []uint256.Int{*uint256.NewInt(10)}
+	scope.Contract.TimestampWindowStart, scope.Contract.TimestampWindowEnd = 100, 200
+
+	v := Variable{StartSlot: *uint256.NewInt(11), IfProtectDelete: true}
+	v.InitSlot()
+
+	interpreter.evm.Context.Time = big.NewInt(300)
+	if write, _, err := v.Shield(*uint256.NewInt(10), *uint256.NewInt(1), interpreter, scope); err != nil || !write {
+		t.Error("write blocked although TIMESTAMP was not used")
+	}
+	opTimestamp(new(uint64), interpreter, scope)
+	if write, _, err := v.Shield(*uint256.NewInt(10), *uint256.NewInt(1), interpreter, scope); err != nil || write {
+		t.Error("timestamp dependent write outside the window not blocked")
+	}
+	interpreter.evm.Context.Time = big.NewInt(150)
+	if write, _, err := v.Shield(*uint256.NewInt(10), *uint256.NewInt(1), interpreter, scope); err != nil || !write {
+		t.Error("timestamp dependent write inside the window blocked")
+	}
+}
+
+func TestShieldCoinbaseSensitiveSlots(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	trusted := common.HexToAddress("0x7e57ed")
+	scope.Contract.CoinbaseSensitiveSlots = []uint256.Int{*uint256.NewInt(10)}
+	scope.Contract.TrustedMiners = []common.Address{trusted}
+
+	v := Variable{StartSlot: *uint256.NewInt(11), IfProtectDelete: true}
+	v.InitSlot()
+
+	interpreter.evm.Context.Coinbase = common.HexToAddress("0xbad")
+	if write, _, err := v.Shield(*uint256.NewInt(10), *uint256.NewInt(1), interpreter, scope); err != nil || !write {
+		t.Error("write blocked although COINBASE was not used")
+	}
+	opCoinbase(new(uint64), interpreter, scope)
+	if write, _, err := v.Shield(*uint256.NewInt(10), *uint256.NewInt(1), interpreter, scope); err != nil || write {
+		t.Error("coinbase dependent write by an untrusted miner not blocked")
+	}
+	interpreter.evm.Context.Coinbase = trusted
+	if write, _, err := v.Shield(*uint256.NewInt(10), *uint256.NewInt(1), interpreter, scope); err != nil || !write {
+		t.Error("coinbase dependent write by a trusted miner blocked")
+	}
+}
+
+func TestShieldBasefeeSensitiveSlots(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	scope.Contract.BasefeeSensitiveSlots = []uint256.Int{*uint256.NewInt(10)}
+	scope.Contract.MinBasefee, scope.Contract.MaxBasefee = *uint256.NewInt(100), *uint256.NewInt(200)
+
+	v := Variable{StartSlot: *uint256.NewInt(11), IfProtectDelete: true}
+	v.InitSlot()
+
+	interpreter.evm.Context.BaseFee = big.NewInt(1)
+	if write, _, err := v.Shield(*uint256.NewInt(10), *uint256.NewInt(1), interpreter, scope); err != nil || !write {
+		t.Error("write blocked although BASEFEE was not used")
+	}
+	opBaseFee(new(uint64), interpreter, scope)
+	for baseFee, want := range map[int64]bool{1: false, 100: true, 200: true, 201: false} {
+		interpreter.evm.Context.BaseFee = big.NewInt(baseFee)
+		if write, _, err := v.Shield(*uint256.NewInt(10), *uint256.NewInt(1), interpreter, scope); err != nil || write != want {
+			t.Errorf("basefee %d: have write %v, want %v", baseFee, write, want)
+		}
+	}
+	if write, _, err := v.Shield(*uint256.NewInt(12), *uint256.NewInt(1), interpreter, scope); err != nil || !write {
+		t.Error("write to an insensitive slot blocked")
+	}
+}
+
+func TestShieldActiveHoursUTC(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+
+	for _, tt := range []struct {
+		hours [2]uint8
+		hour  int64
+		block bool
+	}{
+		{[2]uint8{0, 0}, 3, true},
+		{[2]uint8{9, 17}, 9, true},
+		{[2]uint8{9, 17}, 16, true},
+		{[2]uint8{9, 17}, 17, false},
+		{[2]uint8{9, 17}, 3, false},
+		{[2]uint8{22, 6}, 23, true},
+		{[2]uint8{22, 6}, 5, true},
+		{[2]uint8{22, 6}, 12, false},
+	} {
+		v := Variable{StartSlot: *uint256.NewInt(1), ActiveHoursUTC: tt.hours}
+		v.InitSlot()
+		// Some day well after the epoch, at the given hour
+		interpreter.evm.Context.Time = big.NewInt(19000*86400 + tt.hour*3600 + 42)
+		if write, _, err := v.Shield(*uint256.NewInt(1), *uint256.NewInt(1), interpreter, scope); err != nil || write != !tt.block {
+			t.Errorf("hours %v at %d:00: have write %v, want %v", tt.hours, tt.hour, write, !tt.block)
+		}
+	}
+}
+
+func TestGenerateBlockShieldReport(t *testing.T) {
+	var (
+		a = common.HexToAddress("0xa")
+		b = common.HexToAddress("0xb")
+	)
+	report := GenerateBlockShieldReport(7, []ShieldEvent{
+		{Contract: a, Slot: *uint256.NewInt(1)},
+		{Contract: a, Slot: *uint256.NewInt(2), Blocked: true},
+		{Contract: b, Slot: *uint256.NewInt(3), Blocked: true},
+		{Contract: b, Slot: *uint256.NewInt(3), Blocked: true},
+	})
+	if report.BlockNumber != 7 || report.SstoreAttempts != 4 || report.Blocked != 3 || report.AffectedContracts != 2 {
+		t.Fatalf("report mismatch: %+v", report)
+	}
+	want := TargetedSlot{Contract: b, Slot: common.BigToHash(big.NewInt(3)), Blocked: 2}
+	if report.MostTargetedSlot == nil || *report.MostTargetedSlot != want {
+		t.Errorf("most targeted slot: have %+v, want %+v", report.MostTargetedSlot, want)
+	}
+}
+
+func TestPermitNonceRule(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+
+	v := PermitNonceRule(*uint256.NewInt(2))
+	v.InitSlot()
+
+	owner := common.LeftPadBytes(common.HexToAddress("0x0123").Bytes(), 32)
+	slot := crypto.Keccak256Hash(owner, common.LeftPadBytes([]byte{2}, 32))
+	v.IdentifyMap(*uint256.NewInt(2), *new(uint256.Int).SetBytes(slot[:]), interpreter, scope)
+	interpreter.evm.StateDB.SetState(shieldTestAddress, slot, common.BigToHash(big.NewInt(5)))
+
+	loc := *new(uint256.Int).SetBytes(slot[:])
+	if write, _, err := v.Shield(loc, *uint256.NewInt(6), interpreter, scope); err != nil || !write {
+		t.Error("nonce increment blocked")
+	}
+	if write, _, err := v.Shield(loc, *uint256.NewInt(0), interpreter, scope); err != nil || write {
+		t.Error("nonce reset not blocked")
+	}
+}
+
+func TestBalanceConservationRule(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	interpreter.cfg.ShieldEventHook = func(ShieldViolation) {}
+
+	vars := BalanceConservationRule(*uint256.NewInt(0), *uint256.NewInt(2))
+	balances, supply := &vars[0], &vars[1]
+	balances.InitSlot()
+	supply.InitSlot()
+
+	balanceSlot := func(holder byte) uint256.Int {
+		hash := crypto.Keccak256Hash(common.LeftPadBytes([]byte{holder}, 32), make([]byte, 32))
+		balances.IdentifyMap(*uint256.NewInt(0), *new(uint256.Int).SetBytes(hash[:]), interpreter, scope)
+		return *new(uint256.Int).SetBytes(hash[:])
+	}
+	write := func(v *Variable, loc uint256.Int, value uint64) bool {
+		allowed, _, err := v.Shield(loc, *uint256.NewInt(value), interpreter, scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed {
+			interpreter.evm.StateDB.SetState(shieldTestAddress, loc.Bytes32(), common.BigToHash(new(big.Int).SetUint64(value)))
+		}
+		return allowed
+	}
+	alice, bob := balanceSlot(1), balanceSlot(2)
+
+	// Mint 100 to alice, then transfer 40 to bob
+	if !write(supply, *uint256.NewInt(2), 100) || !write(balances, alice, 100) {
+		t.Fatal("mint blocked")
+	}
+	if !write(balances, alice, 60) || !write(balances, bob, 40) {
+		t.Fatal("transfer blocked")
+	}
+	// Crediting bob without debiting anyone inflates the supply
+	if write(balances, bob, 1040) {
+		t.Error("unbacked credit not blocked")
+	}
+}
+
+func TestERC721OwnershipRule(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	statedb := interpreter.evm.StateDB.(*state.StateDB)
+
+	v := ERC721OwnershipRule(*uint256.NewInt(2))
+	v.InitSlot()
+
+	var (
+		owner       = common.LeftPadBytes([]byte{0xaa}, 32)
+		tokenSlot   = crypto.Keccak256Hash(common.LeftPadBytes([]byte{7}, 32), common.LeftPadBytes([]byte{2}, 32))
+		balanceSlot = crypto.Keccak256Hash(owner, common.LeftPadBytes([]byte{3}, 32))
+		loc         = *new(uint256.Int).SetBytes(tokenSlot[:])
+		newOwner    = *uint256.NewInt(0xbb)
+	)
+	v.IdentifyMap(*uint256.NewInt(2), loc, interpreter, scope)
+
+	// Token 7 is owned by 0xaa holding a single token
+	statedb.SetNonce(shieldTestAddress, 1)
+	statedb.SetState(shieldTestAddress, tokenSlot, common.BytesToHash(owner))
+	statedb.SetState(shieldTestAddress, balanceSlot, common.BigToHash(big.NewInt(1)))
+	statedb.Finalise(true)
+
+	if write, _, err := v.Shield(loc, newOwner, interpreter, scope); err != nil || write {
+		t.Error("ownership change without debiting the previous owner not blocked")
+	}
+	statedb.SetState(shieldTestAddress, balanceSlot, common.Hash{})
+	if write, _, err := v.Shield(loc, newOwner, interpreter, scope); err != nil || !write {
+		t.Error("regular transfer blocked")
+	}
+}
+
+func TestShieldMaxDelegatecallDepth(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	scope.Contract.MaxDelegatecallDepth = 2
+
+	v := Variable{StartSlot: *uint256.NewInt(12), IfProtectDelete: true}
+	v.InitSlot()
+
+	interpreter.delegateDepth = 2
+	if write, _, err := v.Shield(*uint256.NewInt(12), *uint256.NewInt(1), interpreter, scope); err != nil || !write {
+		t.Error("write blocked within the delegatecall depth limit")
+	}
+	interpreter.delegateDepth = 3
+	if write, _, err := v.Shield(*uint256.NewInt(12), *uint256.NewInt(1), interpreter, scope); err != nil || write {
+		t.Error("write beyond the delegatecall depth limit not blocked")
+	}
+	if write, _, err := v.Shield(*uint256.NewInt(13), *uint256.NewInt(1), interpreter, scope); err != nil || !write {
+		t.Error("write to an unshielded slot blocked")
+	}
+}
+
+func TestIdentifyMapVyperLayout(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+
+	scope.Contract.FunctionShield = []Variable{{
+		IfMapping:    true,
+		StartSlot:    *uint256.NewInt(3),
+		MappingStart: *uint256.NewInt(3),
+		HashLayout:   HashLayoutVyper,
+	}}
+	shield := &scope.Contract.FunctionShield[0]
+	shield.InitSlot()
+
+	keccak := func(data []byte) uint256.Int {
+		scope.Memory = NewMemory()
+		scope.Memory.Resize(uint64(len(data)))
+		scope.Memory.Set(0, uint64(len(data)), data)
+		scope.Stack.push(uint256.NewInt(uint64(len(data))))
+		scope.Stack.push(uint256.NewInt(0))
+		opKeccak256(new(uint64), interpreter, scope)
+		return scope.Stack.pop()
+	}
+	var (
+		slot = common.LeftPadBytes([]byte{3}, 32)
+		key  = common.LeftPadBytes([]byte{0x42}, 32)
+	)
+	vyper := keccak(append(common.CopyBytes(slot), key...))
+	solidity := keccak(append(common.CopyBytes(key), slot...))
+	if !shield.Slot.Contains(vyper) {
+		t.Error("vyper mapping slot not identified")
+	}
+	if shield.Slot.Contains(solidity) {
+		t.Error("solidity layout hash accepted by a vyper variable")
+	}
+}
+
+func TestIdentifyMapPreimageRecording(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	interpreter.evm.Config.EnablePreimageRecording = true
+
+	scope.Contract.FunctionShield = []Variable{{IfMapping: true, MappingStart: *uint256.NewInt(3)}}
+	shield := &scope.Contract.FunctionShield[0]
+	shield.InitSlot()
+
+	preimage := append(common.LeftPadBytes([]byte{0x42}, 32), common.LeftPadBytes([]byte{3}, 32)...)
+	scope.Memory.Resize(64)
+	scope.Memory.Set(0, 64, preimage)
+	scope.Stack.push(uint256.NewInt(64))
+	scope.Stack.push(uint256.NewInt(0))
+	opKeccak256(new(uint64), interpreter, scope)
+	hash := scope.Stack.pop()
+
+	if !shield.Slot.Contains(hash) {
+		t.Fatal("mapping slot not identified")
+	}
+	recorded := interpreter.evm.StateDB.(*state.StateDB).Preimages()[hash.Bytes32()]
+	if !bytes.Equal(recorded, preimage) {
+		t.Errorf("have preimage %x, want %x", recorded, preimage)
+	}
+}
+
+func TestMonitorHashInputs(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	var violations []ShieldViolation
+	interpreter.cfg.ShieldEventHook = func(v ShieldViolation) { violations = append(violations, v) }
+	scope.Contract.MonitorHashInputs = []hexutil.Bytes{nil, common.FromHex("c0ffee")}
+
+	keccak := func(data []byte) {
+		scope.Memory = NewMemory()
+		scope.Memory.Resize(uint64(len(data)))
+		scope.Memory.Set(0, uint64(len(data)), data)
+		scope.Stack.push(uint256.NewInt(uint64(len(data))))
+		scope.Stack.push(uint256.NewInt(0))
+		opKeccak256(new(uint64), interpreter, scope)
+		scope.Stack.pop()
+	}
+	keccak(common.FromHex("0102030405"))
+	if len(violations) != 0 {
+		t.Fatalf("unrelated input reported: %+v", violations)
+	}
+	keccak(common.FromHex("01c0ffee02"))
+	if len(violations) != 1 || violations[0].Blocked || !strings.HasSuffix(violations[0].Reason, "#1") {
+		t.Fatalf("monitored input: unexpected violations %+v", violations)
+	}
+	// The report must not leak the hashed data
+	if strings.Contains(violations[0].Reason, "c0ffee") {
+		t.Errorf("input leaked into the report: %s", violations[0].Reason)
+	}
+}
+
+func TestBlockhashTaint(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	interpreter.evm.Context.BlockNumber = big.NewInt(10)
+	interpreter.evm.Context.GetHash = func(n uint64) common.Hash {
+		return crypto.Keccak256Hash(new(big.Int).SetUint64(n).Bytes())
+	}
+	var tainted int
+	interpreter.cfg.ShieldEventHook = func(v ShieldViolation) {
+		if v.Reason == "shielded slot written from blockhash derived value" {
+			tainted++
+		}
+	}
+	scope.Contract.BlockhashShield = true
+	scope.Contract.FunctionShield = []Variable{{StartSlot: *uint256.NewInt(1)}}
+	scope.Contract.FunctionShield[0].InitSlot()
+
+	sstore := func(val uint256.Int) {
+		scope.Stack.push(&val)
+		scope.Stack.push(uint256.NewInt(1))
+		if _, err := opSstore(new(uint64), interpreter, scope); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// blockhash(5)
+	scope.Stack.push(uint256.NewInt(5))
+	opBlockhash(new(uint64), interpreter, scope)
+	random := scope.Stack.pop()
+
+	sstore(*uint256.NewInt(7))
+	if tainted != 0 {
+		t.Fatal("clean value flagged")
+	}
+	sstore(random)
+	if tainted != 1 {
+		t.Fatal("blockhash written to a shielded slot not flagged")
+	}
+	// keccak256(abi.encodePacked(blockhash(5), 42))
+	word, salt := random.Bytes32(), common.LeftPadBytes([]byte{42}, 32)
+	data := append(word[:], salt...)
+	scope.Memory.Resize(64)
+	scope.Memory.Set(0, 64, data)
+	scope.Stack.push(uint256.NewInt(64))
+	scope.Stack.push(uint256.NewInt(0))
+	opKeccak256(new(uint64), interpreter, scope)
+	sstore(scope.Stack.pop())
+	if tainted != 2 {
+		t.Error("hash of a blockhash written to a shielded slot not flagged")
+	}
+}
+
+func TestMinGasFloor(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	scope.Contract.MinGasFloor = 100
+	for mode, want := range map[ShieldMode]uint64{ShieldModeEnforce: 100, ShieldModeAudit: scope.Contract.Gas} {
+		interpreter.cfg.ShieldMode = mode
+		opGas(new(uint64), interpreter, scope)
+		if have := scope.Stack.pop(); have.Uint64() != want {
+			t.Errorf("mode %d: have gas %d, want %d", mode, have.Uint64(), want)
+		}
+	}
+}
+
+func TestShieldBlockCodecopyToMemory(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	code := []byte{0x60, 0x01, 0x60, 0x02}
+
+	codecopy := func() []byte {
+		scope.Memory = NewMemory()
+		scope.Memory.Resize(32)
+		scope.Stack.push(uint256.NewInt(4)) // length
+		scope.Stack.push(uint256.NewInt(0)) // code offset
+		scope.Stack.push(uint256.NewInt(0)) // memory offset
+		opCodeCopy(new(uint64), interpreter, scope)
+		return scope.Memory.GetCopy(0, 4)
+	}
+	scope.Contract.BlockCodecopyToMemory = true
+	scope.Contract.SetCallCode(&shieldTestAddress, crypto.Keccak256Hash(code), code, interpreter)
+	if copied := codecopy(); !bytes.Equal(copied, make([]byte, 4)) {
+		t.Errorf("own code was copied: %x", copied)
+	}
+	interpreter.cfg.ShieldMode = ShieldModeAudit
+	if copied := codecopy(); !bytes.Equal(copied, code) {
+		t.Errorf("audit mode: code copy mismatch: %x", copied)
+	}
+	interpreter.cfg.ShieldMode = ShieldModeEnforce
+	// Code borrowed through DELEGATECALL is not the contract's own
+	library := common.HexToAddress("0x11b")
+	scope.Contract.SetCallCode(&library, crypto.Keccak256Hash(code), code, interpreter)
+	if copied := codecopy(); !bytes.Equal(copied, code) {
+		t.Errorf("delegated code copy mismatch: %x", copied)
+	}
+}
+
+func TestTWAPProtectionRule(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	setShieldTestSlot(interpreter, 15, 1000)
+
+	vars := TWAPProtectionRule(*uint256.NewInt(14), *uint256.NewInt(15))
+	accumulator, timestamp := &vars[0], &vars[1]
+	accumulator.InitSlot()
+	timestamp.InitSlot()
+
+	interpreter.evm.Context.BlockNumber = big.NewInt(100)
+	if write, _, err := accumulator.Shield(*uint256.NewInt(14), *uint256.NewInt(1), interpreter, scope); err != nil || !write {
+		t.Error("first accumulator update of the block blocked")
+	}
+	if write, _, err := accumulator.Shield(*uint256.NewInt(14), *uint256.NewInt(2), interpreter, scope); err != nil || write {
+		t.Error("second accumulator update of the block not blocked")
+	}
+	interpreter.evm.Context.BlockNumber = big.NewInt(101)
+	snapshot := interpreter.evm.StateDB.Snapshot()
+	if write, _, err := accumulator.Shield(*uint256.NewInt(14), *uint256.NewInt(3), interpreter, scope); err != nil || !write {
+		t.Error("accumulator update in the next block blocked")
+	}
+	// A reverted update does not count
+	interpreter.evm.StateDB.RevertToSnapshot(snapshot)
+	if write, _, err := accumulator.Shield(*uint256.NewInt(14), *uint256.NewInt(4), interpreter, scope); err != nil || !write {
+		t.Error("reverted accumulator update counted")
+	}
+	if write, _, err := timestamp.Shield(*uint256.NewInt(15), *uint256.NewInt(1000), interpreter, scope); err != nil || write {
+		t.Error("timestamp not moving forward accepted")
+	}
+	if write, _, err := timestamp.Shield(*uint256.NewInt(15), *uint256.NewInt(1012), interpreter, scope); err != nil || !write {
+		t.Error("timestamp moving forward blocked")
+	}
+}
+
+func TestCurvePoolInvariantRule(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	var failed int
+	interpreter.cfg.ShieldEventHook = func(ShieldViolation) { failed++ }
+	setShieldTestSlot(interpreter, 20, 2000) // D
+	setShieldTestSlot(interpreter, 21, 1000) // balances[0]
+	setShieldTestSlot(interpreter, 22, 1000) // balances[1]
+
+	scope.Contract.FunctionShield = CurvePoolInvariantRule(*uint256.NewInt(20), *uint256.NewInt(21), 2)
+	for i := range scope.Contract.FunctionShield {
+		scope.Contract.FunctionShield[i].InitSlot()
+	}
+	balances := &scope.Contract.FunctionShield[1]
+	if write, _, err := balances.Shield(*uint256.NewInt(22), *uint256.NewInt(500), interpreter, scope); err != nil || write {
+		t.Error("balance drop by half not blocked")
+	}
+	sstore := func(slot, value uint64) {
+		scope.Stack.push(uint256.NewInt(value))
+		scope.Stack.push(uint256.NewInt(slot))
+		if _, err := opSstore(new(uint64), interpreter, scope); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sstore(22, 950)
+	if failed != 0 {
+		t.Fatalf("sum invariant reported at 1950 of 2000")
+	}
+	sstore(21, 900)
+	sstore(22, 880)
+	if failed == 0 {
+		t.Error("balances below 90% of D not reported")
+	}
+}
+
+func TestNewRuleWithoutSelector(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	for _, input := range [][]byte{nil, {}, {0x01, 0x02}} {
+		contract := NewContract(AccountRef(common.Address{}), AccountRef(shieldTestAddress), new(big.Int), 0)
+		contract.Input = input
+		if got, err := contract.NewRule(); err != nil || got != contract || got.matchedSelector != "" {
+			t.Errorf("input %x: rule applied without a function selector", input)
+		}
+		if err := contract.Write(); err != nil {
+			t.Errorf("input %x: %v", input, err)
+		}
+		if _, err := os.Stat("rules"); !os.IsNotExist(err) {
+			t.Errorf("input %x: rule written without a function selector", input)
+		}
+	}
+}
+
+func TestShieldNoReentrantCallStack(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	scope.Contract.NoReentrantCallStack = []common.Address{shieldTestAddress}
+	v := Variable{StartSlot: *uint256.NewInt(3), IfMonotonicIncrease: true}
+	v.InitSlot()
+
+	attacker := common.HexToAddress("0xa77ac4e7")
+	scope.Contract.recordCallStack([]common.Address{attacker, shieldTestAddress})
+	if write, _, err := v.Shield(*uint256.NewInt(3), *uint256.NewInt(1), interpreter, scope); err != nil || !write {
+		t.Error("write from the first entry blocked")
+	}
+	// shielded -> attacker -> router -> shielded
+	scope.Contract.recordCallStack([]common.Address{shieldTestAddress, attacker, common.HexToAddress("0x1234"), shieldTestAddress})
+	if write, _, err := v.Shield(*uint256.NewInt(3), *uint256.NewInt(1), interpreter, scope); err != nil || write {
+		t.Error("write from an indirect reentrant call not blocked")
+	}
+	if write, _, err := v.Shield(*uint256.NewInt(4), *uint256.NewInt(1), interpreter, scope); err != nil || !write {
+		t.Error("reentrant write to an unprotected slot blocked")
+	}
+}
+
+func TestBatchTransferLimits(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	var violations []ShieldViolation
+	interpreter.cfg.ShieldEventHook = func(v ShieldViolation) { violations = append(violations, v) }
+	scope.Contract.BatchBalancesSlot = *uint256.NewInt(3)
+	scope.Contract.BatchTransferLimits = map[string]uint64{"7": 100}
+
+	// _balances[7][holder], with the preimages recorded by KECCAK256
+	innerData := append(common.LeftPadBytes([]byte{7}, 32), common.LeftPadBytes([]byte{3}, 32)...)
+	inner := crypto.Keccak256Hash(innerData)
+	outerData := append(common.LeftPadBytes([]byte("holder"), 32), inner.Bytes()...)
+	outer := crypto.Keccak256Hash(outerData)
+	scope.Contract.recordPreimage(inner, innerData)
+	scope.Contract.recordPreimage(outer, outerData)
+	loc := *new(uint256.Int).SetBytes(outer.Bytes())
+
+	sc := NewShieldedContract(scope.Contract, nil)
+	balance := func() uint64 {
+		return new(uint256.Int).SetBytes(interpreter.evm.StateDB.GetState(shieldTestAddress, outer).Bytes()).Uint64()
+	}
+	for _, tt := range []struct {
+		mode    ShieldMode
+		value   uint64
+		want    uint64
+		blocked bool
+	}{
+		{ShieldModeEnforce, 100, 100, false}, // within the limit
+		{ShieldModeEnforce, 201, 100, true},  // moves 101
+		{ShieldModeAudit, 50, 50, false},
+		{ShieldModeAudit, 151, 151, true}, // reported, but written
+	} {
+		violations = nil
+		interpreter.cfg.ShieldMode = tt.mode
+		if _, err := sc.sstore(loc, *uint256.NewInt(tt.value), interpreter, scope); err != nil {
+			t.Fatal(err)
+		}
+		if have := balance(); have != tt.want {
+			t.Errorf("mode %d, value %d: have balance %d, want %d", tt.mode, tt.value, have, tt.want)
+		}
+		switch {
+		case !tt.blocked && len(violations) != 0:
+			t.Errorf("mode %d, value %d: write within the limit reported: %+v", tt.mode, tt.value, violations)
+		case tt.blocked && len(violations) != 1:
+			t.Errorf("mode %d, value %d: have %d violations, want 1", tt.mode, tt.value, len(violations))
+		case tt.blocked && (violations[0].Blocked != (tt.mode == ShieldModeEnforce) || !strings.HasPrefix(violations[0].Reason, "token 7 moved 101")):
+			t.Errorf("mode %d, value %d: unexpected violation %+v", tt.mode, tt.value, violations[0])
+		}
+	}
+}
+
+func TestERC777ReentrancyRule(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	rule := ERC777ReentrancyRule(*uint256.NewInt(1))
+	scope.Contract.NoSelfReentrancy = rule.NoSelfReentrancy
+	balances := &rule.FunctionShield[0]
+	balances.InitSlot()
+
+	// balances[holder] is discovered when its slot is hashed
+	slot := *uint256.NewInt(0xb0b)
+	balances.IdentifyMap(*uint256.NewInt(1), slot, interpreter, scope)
+
+	hook := common.HexToAddress("0x777")
+	scope.Contract.recordCallStack([]common.Address{hook, shieldTestAddress})
+	if write, _, err := balances.Shield(slot, *uint256.NewInt(1), interpreter, scope); err != nil || !write {
+		t.Error("balance write from send blocked")
+	}
+	// token -> tokensReceived hook -> token
+	scope.Contract.recordCallStack([]common.Address{shieldTestAddress, hook, shieldTestAddress})
+	if write, _, err := balances.Shield(slot, *uint256.NewInt(1), interpreter, scope); err != nil || write {
+		t.Error("balance write from a reentrant hook not blocked")
+	}
+	if write, _, err := balances.Shield(*uint256.NewInt(5), *uint256.NewInt(1), interpreter, scope); err != nil || !write {
+		t.Error("reentrant write outside the balances blocked")
+	}
+}
+
+func TestShieldStruct(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	var rule Contract
+	data := []byte(`{"Functionname":"a9059cbb","FunctionShield":[{"StartSlot":"0x4","IfStruct":true,"StructFields":[{"Name":"owner"},{"Name":"nonce","IfMonotonicIncrease":true}]}]}`)
+	if err := json.Unmarshal(data, &rule); err != nil {
+		t.Fatal(err)
+	}
+	if err := rule.ValidateRule(); err != nil {
+		t.Fatal(err)
+	}
+	v := &rule.FunctionShield[0]
+	v.InitSlot()
+	setShieldTestSlot(interpreter, 5, 7)
+
+	if write, _, err := v.Shield(*uint256.NewInt(4), *uint256.NewInt(1), interpreter, scope); err != nil || write {
+		t.Error("write to the owner field not blocked")
+	}
+	if write, _, err := v.Shield(*uint256.NewInt(5), *uint256.NewInt(8), interpreter, scope); err != nil || !write {
+		t.Error("nonce increment blocked")
+	}
+	if write, _, err := v.Shield(*uint256.NewInt(5), *uint256.NewInt(6), interpreter, scope); err != nil || write {
+		t.Error("nonce decrement not blocked")
+	}
+	if write, _, err := v.Shield(*uint256.NewInt(6), *uint256.NewInt(1), interpreter, scope); err != nil || !write {
+		t.Error("write after the struct blocked")
+	}
+
+	encoded, err := json.Marshal(&rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Contract
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	decoded.FunctionShield[0].InitSlot()
+	if again, _ := json.Marshal(&decoded); !bytes.Equal(again, encoded) {
+		t.Errorf("struct rule does not round-trip:\nhave %s\nwant %s", again, encoded)
+	}
+
+	empty := Variable{IfStruct: true}
+	if err := empty.validate(); err == nil {
+		t.Error("struct without fields accepted")
+	}
+}
+
+func TestShieldDynamicUpdateInterrupted(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	v := Variable{IfDynamic: true, DynamicStart: *uint256.NewInt(9)}
+	v.InitSlot()
+	first := crypto.Keccak256Hash(v.DynamicStart.Bytes())
+	interpreter.evm.StateDB.SetState(shieldTestAddress, first, common.HexToHash("0x01"))
+
+	interpreter.evm.Cancel()
+	if write, _, err := v.Shield(*uint256.NewInt(1), *uint256.NewInt(1), interpreter, scope); !errors.Is(err, ErrIncompleteDynamicSlots) || write {
+		t.Errorf("interrupted update: have (%v, %v), want (false, %v)", write, err, ErrIncompleteDynamicSlots)
+	}
+}
+
+func TestEvalShieldExpr(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	owner := common.HexToAddress("0x0e")
+	// Blocks writes to slot 1 unless made through the owner
+	expr := RuleExpr{And: []RuleExpr{
+		{Variable: &Variable{StartSlot: *uint256.NewInt(1)}},
+		{Variable: &Variable{StartSlot: *uint256.NewInt(1), RequiredCallPath: []common.Address{owner, shieldTestAddress}}},
+	}}
+	expr.initSlots()
+
+	tests := []struct {
+		slot      uint64
+		callStack []common.Address
+		write     bool
+	}{
+		{1, []common.Address{shieldTestAddress}, false},
+		{1, []common.Address{owner, shieldTestAddress}, true},
+		{2, []common.Address{shieldTestAddress}, true},
+	}
+	for i, tt := range tests {
+		interpreter.callStack = tt.callStack
+		if write, err := scope.Contract.EvalShieldExpr(expr, *uint256.NewInt(tt.slot), *uint256.NewInt(1), interpreter, scope); err != nil || write != tt.write {
+			t.Errorf("test %d: have (%v, %v), want %v", i, write, err, tt.write)
+		}
+	}
+	// Not and Or over the same leaves
+	or := RuleExpr{Or: []RuleExpr{
+		{Not: &RuleExpr{Variable: &Variable{StartSlot: *uint256.NewInt(2)}}},
+		{Variable: &Variable{StartSlot: *uint256.NewInt(3)}},
+	}}
+	or.initSlots()
+	for slot, want := range map[uint64]bool{1: false, 2: true, 3: false} {
+		if write, err := scope.Contract.EvalShieldExpr(or, *uint256.NewInt(slot), *uint256.NewInt(1), interpreter, scope); err != nil || write != want {
+			t.Errorf("slot %d: have (%v, %v), want %v", slot, write, err, want)
+		}
+	}
+	if _, err := scope.Contract.EvalShieldExpr(RuleExpr{}, *uint256.NewInt(1), *uint256.NewInt(1), interpreter, scope); err == nil {
+		t.Error("empty expression evaluated without error")
+	}
+}
+
+func TestShieldEnum(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	// enum State {Created, Locked, Released} packed after an address
+	v := Variable{StartSlot: *uint256.NewInt(3), IfEnum: true, PackageStart: 11, PackageSize: 1, ValidEnumValues: []uint8{0, 1, 2}}
+	v.InitSlot()
+
+	owner := new(uint256.Int).SetBytes(common.HexToAddress("0x0e").Bytes())
+	for _, tt := range []struct {
+		state uint64
+		write bool
+	}{
+		{2, true},
+		{255, false},
+		{3, false},
+	} {
+		val := new(uint256.Int).Lsh(uint256.NewInt(tt.state), 160)
+		val.Or(val, owner)
+		if write, _, err := v.Shield(*uint256.NewInt(3), *val, interpreter, scope); err != nil || write != tt.write {
+			t.Errorf("state %d: have %v, want %v", tt.state, write, tt.write)
+		}
+	}
+}
+
+func TestShieldMaxChildCodeSize(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	scope.Contract.Gas = 1000000
+	scope.Contract.MaxChildCodeSize = 16
+	scope.Memory.Resize(64)
+
+	create := func(size uint64) bool {
+		// size, offset, value
+		for _, item := range []*uint256.Int{uint256.NewInt(size), new(uint256.Int), new(uint256.Int)} {
+			scope.Stack.push(item)
+		}
+		if _, err := opCreate(new(uint64), interpreter, scope); err != nil {
+			t.Fatal(err)
+		}
+		addr := scope.Stack.pop()
+		return !addr.IsZero()
+	}
+	if !create(16) {
+		t.Error("creation within MaxChildCodeSize failed")
+	}
+	gas := scope.Contract.Gas
+	if create(17) {
+		t.Error("oversized creation not blocked")
+	}
+	if scope.Contract.Gas != gas {
+		t.Errorf("blocked creation used %d gas", gas-scope.Contract.Gas)
+	}
+}
+
+// writeShieldTestRule points the rule loader at a rule file holding rule.
+// readShieldTestRule binds the rule of selector from the rule file at path.
+func readShieldTestRule(path, selector string) (*Contract, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	contract := NewContract(AccountRef(common.Address{}), AccountRef(shieldTestAddress), new(big.Int), 0)
+	contract.Input = common.FromHex(selector)
+	return contract.NewRuleFromBytes(data)
+}
+
+func writeShieldTestRule(t *testing.T, rule string) {
+	path := filepath.Join(t.TempDir(), "rule.json")
+	if err := ioutil.WriteFile(path, []byte(rule), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(ruleFileEnv, path)
+}
+
+func TestCallBindsRule(t *testing.T) {
+	writeShieldTestRule(t, `{"Functionname": "a9059cbb", "FunctionShield": [{"StartSlot": "0x1"}]}`)
+	interpreter, _ := newShieldTestEnv()
+	interpreter.cfg.ShieldEventHook = func(ShieldViolation) {}
+	evm := interpreter.evm
+	evm.StateDB.AddAddressToAccessList(shieldTestAddress)
+	// sstore(1, 7)
+	evm.StateDB.SetCode(shieldTestAddress, []byte{byte(PUSH1), 7, byte(PUSH1), 1, byte(SSTORE), byte(STOP)})
+
+	for selector, stored := range map[string]bool{"a9059cbb": false, "23b872dd": true} {
+		evm.StateDB.SetState(shieldTestAddress, common.BigToHash(big.NewInt(1)), common.Hash{})
+		if _, _, err := evm.Call(AccountRef(common.Address{}), shieldTestAddress, common.FromHex(selector), 100000, new(big.Int)); err != nil {
+			t.Fatalf("call of %s: %v", selector, err)
+		}
+		value := evm.StateDB.GetState(shieldTestAddress, common.BigToHash(big.NewInt(1)))
+		if have := value == common.BigToHash(big.NewInt(7)); have != stored {
+			t.Errorf("call of %s: stored %v, want %v", selector, have, stored)
+		}
+	}
+}
+
+func TestCallAbortsOnInvalidRule(t *testing.T) {
+	writeShieldTestRule(t, `{"Functionname": "a9059cbb", "FunctionShield": [{"StartSlot": "0x1", "IfFixedArray": true}]}`)
+	interpreter, _ := newShieldTestEnv()
+	evm := interpreter.evm
+	evm.StateDB.AddAddressToAccessList(shieldTestAddress)
+	// sstore(1, 7)
+	evm.StateDB.SetCode(shieldTestAddress, []byte{byte(PUSH1), 7, byte(PUSH1), 1, byte(SSTORE), byte(STOP)})
+
+	if _, _, err := evm.Call(AccountRef(common.Address{}), shieldTestAddress, common.FromHex("a9059cbb"), 100000, new(big.Int)); err == nil {
+		t.Fatal("call ran with an invalid rule")
+	}
+	if value := evm.StateDB.GetState(shieldTestAddress, common.BigToHash(big.NewInt(1))); value != (common.Hash{}) {
+		t.Errorf("unshielded write stored %x", value)
+	}
+}
+
+func TestNewRuleWithABI(t *testing.T) {
+	const transferABI = `[{"type":"function","name":"transfer","inputs":[{"name":"to","type":"address"},{"name":"value","type":"uint256"}]}]`
+	for _, tt := range []struct {
+		rule  string
+		floor uint64
+		fails bool
+	}{
+		{`{"MinGasFloor": 1}`, 1, false},
+		{`{"Functionname": "A9059CBB", "MinGasFloor": 2}`, 2, false},
+		{`{"Functionname": "23b872dd"}`, 0, true},
+		{`[{"Functionname": "23b872dd", "MinGasFloor": 3}, {"MinGasFloor": 4}]`, 4, false},
+	} {
+		writeShieldTestRule(t, tt.rule)
+		contract := NewContract(AccountRef(common.Address{}), AccountRef(shieldTestAddress), new(big.Int), 0)
+		contract.Input = common.FromHex("a9059cbb")
+		_, err := contract.NewRuleWithABI([]byte(transferABI), "transfer(address,uint256)")
+		if (err != nil) != tt.fails || contract.MinGasFloor != tt.floor {
+			t.Errorf("rule %s: have MinGasFloor %d, error %v", tt.rule, contract.MinGasFloor, err)
+		}
+	}
+}
+
+func TestNewRuleWithRetryMissingFile(t *testing.T) {
+	t.Setenv(ruleFileEnv, filepath.Join(t.TempDir(), "missing.json"))
+	contract := NewContract(AccountRef(common.Address{}), AccountRef(shieldTestAddress), new(big.Int), 0)
+	contract.Input = common.FromHex("a9059cbb")
+
+	start := time.Now()
+	if _, err := contract.NewRuleWithRetry(5, time.Second); !os.IsNotExist(err) {
+		t.Errorf("have %v, want not exist", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("missing file retried for %v", elapsed)
+	}
+	// Reading a directory fails with a retried path error
+	t.Setenv(ruleFileEnv, t.TempDir())
+	if _, err := contract.NewRuleWithRetry(1, -time.Second); err == nil {
+		t.Error("directory read as a rule file")
+	}
+}
+
+func TestNewRulePerAddressFile(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	writeRule := func(path string, floor uint64) {
+		data := fmt.Sprintf(`{"Functionname": "a9059cbb", "MinGasFloor": %d}`, floor)
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeRule("rule.json", 1)
+	if err := os.Mkdir("rules", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeRule(filepath.Join("rules", shieldTestAddress.Hex()+".json"), 2)
+
+	other := common.BytesToAddress([]byte("other"))
+	for addr, floor := range map[common.Address]uint64{shieldTestAddress: 2, other: 1} {
+		contract := NewContract(AccountRef(common.Address{}), AccountRef(addr), new(big.Int), 0)
+		contract.Input = common.FromHex("a9059cbb")
+		if contract.NewRule(); contract.MinGasFloor != floor {
+			t.Errorf("rule of %v: have MinGasFloor %d, want %d", addr, contract.MinGasFloor, floor)
+		}
+		// The rule is written back to the file it was loaded from, a per-address
+		// file would hide the other rules of the fallback file
+		contract.MinGasFloor += 10
+		if err := contract.Write(); err != nil {
+			t.Fatal(err)
+		}
+		reloaded := NewContract(AccountRef(common.Address{}), AccountRef(addr), new(big.Int), 0)
+		reloaded.Input = common.FromHex("a9059cbb")
+		if reloaded.NewRule(); reloaded.MinGasFloor != floor+10 {
+			t.Errorf("rule of %v: have MinGasFloor %d after write back, want %d", addr, reloaded.MinGasFloor, floor+10)
+		}
+	}
+	if _, err := os.Stat(filepath.Join("rules", other.Hex()+".json")); !os.IsNotExist(err) {
+		t.Errorf("write back created a per-address file: %v", err)
+	}
+}
+
+func TestNewRuleTOML(t *testing.T) {
+	dir := t.TempDir()
+	jsonPath, tomlPath := filepath.Join(dir, "rule.json"), filepath.Join(dir, "rule.toml")
+	rule := `{
+		"Functionname": "a9059cbb",
+		"MinGasFloor": 21000,
+		"AllowedEthRecipients": ["0x0000000000000000000000000000000000000bad"],
+		"SafeVault": "0x000000000000000000000000000000000000cafe",
+		"FunctionShield": [
+			{"Name": "owner", "StartSlot": "0x1", "IfProtectDelete": true},
+			{"Name": "balances", "IfMapping": true, "Deep": 1, "MappingStart": "0x2", "MaxDeltaPercent": 50, "Slot": null}
+		]
+	}`
+	if err := ioutil.WriteFile(jsonPath, []byte(rule), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ConvertJSONToTOML(jsonPath, tomlPath); err != nil {
+		t.Fatal(err)
+	}
+	fromJSON, err := readShieldTestRule(jsonPath, "a9059cbb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contract := NewContract(AccountRef(common.Address{}), AccountRef(shieldTestAddress), new(big.Int), 0)
+	contract.Input = common.FromHex("a9059cbb")
+	if _, err := contract.NewRuleTOML(tomlPath); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := json.Marshal(fromJSON.FunctionRule)
+	have, _ := json.Marshal(contract.FunctionRule)
+	if !bytes.Equal(have, want) {
+		t.Errorf("TOML rule differs from JSON rule:\nhave %s\nwant %s", have, want)
+	}
+}
+
+func TestNewRuleFromBytes(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		rule  string
+		floor uint64
+		fails bool
+	}{
+		{"single", "a9059cbb", `{"Functionname": "a9059cbb", "MinGasFloor": 1}`, 1, false},
+		{"no match", "23b872dd", `{"Functionname": "a9059cbb", "MinGasFloor": 1}`, 0, false},
+		{"array", "23b872dd", `[{"Functionname": "a9059cbb", "MinGasFloor": 1}, {"Functionname": "23b872dd", "MinGasFloor": 2}]`, 2, false},
+		{"first match", "a9059cbb", ` [{"Selectors": ["0xa9059cbb"], "MinGasFloor": 3}, {"Functionname": "a9059cbb", "MinGasFloor": 4}]`, 3, false},
+		{"no selector", "", `{"Functionname": "a9059cbb", "MinGasFloor": 1}`, 0, false},
+		{"invalid json", "a9059cbb", `{"Functionname": `, 0, true},
+		{"invalid rule", "a9059cbb", `[{"Functionname": "a9059cbb", "AllowedEthRecipients": ["0x0000000000000000000000000000000000000bad"]}]`, 0, true},
+		{"null rule", "a9059cbb", `[null]`, 0, true},
+	}
+	for _, tt := range tests {
+		contract := NewContract(AccountRef(common.Address{}), AccountRef(shieldTestAddress), new(big.Int), 0)
+		contract.Input = common.FromHex(tt.input)
+		_, err := contract.NewRuleFromBytes([]byte(tt.rule))
+		if (err != nil) != tt.fails {
+			t.Errorf("%s: have error %v, want failure %v", tt.name, err, tt.fails)
+		}
+		if contract.MinGasFloor != tt.floor {
+			t.Errorf("%s: have MinGasFloor %d, want %d", tt.name, contract.MinGasFloor, tt.floor)
+		}
+	}
+}
+
+func TestFunctionnameSelector(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"a9059cbb":   true,
+		"A9059CBB":   true,
+		"":           true, // matched through Selectors
+		"a9059cbb00": false,
+		"a9059c":     false,
+		"a9059cb":    false,
+		"0xa9059cbb": false,
+		"transfer":   false,
+	} {
+		rule := fmt.Sprintf(`{"Functionname": %q, "MinGasFloor": 1}`, name)
+		contract := NewContract(AccountRef(common.Address{}), AccountRef(shieldTestAddress), new(big.Int), 0)
+		contract.Input = common.FromHex("a9059cbb")
+		if _, err := contract.NewRuleFromBytes([]byte(rule)); (err == nil) != valid {
+			t.Errorf("Functionname %q: have error %v, want valid %v", name, err, valid)
+		}
+	}
+}
+
+func TestPackageBounds(t *testing.T) {
+	for _, tt := range []struct {
+		start, size int
+		valid       bool
+	}{
+		{0, 32, true}, {30, 2, true}, {30, 5, false}, {40, 1, false}, {-1, 4, false}, {4, 0, false},
+	} {
+		rule := fmt.Sprintf(`{"Functionname": "a9059cbb", "FunctionShield": [{"IfPackage": true, "PackageStart": %d, "PackageSize": %d}]}`, tt.start, tt.size)
+		contract := NewContract(AccountRef(common.Address{}), AccountRef(shieldTestAddress), new(big.Int), 0)
+		contract.Input = common.FromHex("a9059cbb")
+		if _, err := contract.NewRuleFromBytes([]byte(rule)); (err == nil) != tt.valid {
+			t.Errorf("package %d+%d: have error %v, want valid %v", tt.start, tt.size, err, tt.valid)
+		}
+	}
+	// Rules built in code bypass the loader and are rejected when used
+	interpreter, scope := newShieldTestEnv()
+	v := Variable{StartSlot: *uint256.NewInt(1), IfPackage: true, PackageStart: 40, PackageSize: 1}
+	v.InitSlot()
+	if _, _, err := v.Shield(*uint256.NewInt(1), *uint256.NewInt(1), interpreter, scope); err != errPackageOutsideSlot {
+		t.Errorf("have %v, want %v", err, errPackageOutsideSlot)
+	}
+}
+
+func TestNewRuleContractAddress(t *testing.T) {
+	other := common.BytesToAddress([]byte("other"))
+	rule := fmt.Sprintf(`{"Functionname": "a9059cbb", "MinGasFloor": 1, "contractAddress": "%s"}`, shieldTestAddress.Hex())
+	for addr, floor := range map[common.Address]uint64{shieldTestAddress: 1, other: 0} {
+		contract := NewContract(AccountRef(common.Address{}), AccountRef(addr), new(big.Int), 0)
+		contract.Input = common.FromHex("a9059cbb")
+		if _, err := contract.NewRuleFromBytes([]byte(rule)); err != nil || contract.MinGasFloor != floor {
+			t.Errorf("contract %v: have MinGasFloor %d, want %d (err %v)", addr, contract.MinGasFloor, floor, err)
+		}
+	}
+	// The rule of the proxy carries over to the implementation it delegates to
+	proxy := NewContract(AccountRef(common.Address{}), AccountRef(shieldTestAddress), new(big.Int), 0)
+	proxy.Input = common.FromHex("a9059cbb")
+	proxy.NewRuleFromBytes([]byte(rule))
+	impl := NewContract(proxy, AccountRef(shieldTestAddress), nil, 0).AsDelegate()
+	if impl.matchedSelector != "a9059cbb" || impl.MinGasFloor != 1 {
+		t.Errorf("delegate frame did not inherit the rule: %+v", impl.FunctionRule)
+	}
+}
+
+func TestNewRuleEnvPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shield.json")
+	defer os.Setenv(ruleFileEnv, os.Getenv(ruleFileEnv))
+	os.Setenv(ruleFileEnv, path)
+
+	contract := NewContract(AccountRef(common.Address{}), AccountRef(shieldTestAddress), new(big.Int), 0)
+	contract.Input = common.FromHex("a9059cbb")
+	if _, err := contract.NewRule(); !os.IsNotExist(err) {
+		t.Fatalf("missing configured rule file: have %v, want not exist", err)
+	}
+	if err := ioutil.WriteFile(path, []byte(`{"Functionname": "a9059cbb", "MinGasFloor": 7}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := contract.NewRule(); err != nil || contract.MinGasFloor != 7 {
+		t.Fatalf("rule not loaded from %s: %v", ruleFileEnv, err)
+	}
+	contract.MinGasFloor = 8
+	if err := contract.Write(); err != nil {
+		t.Fatal(err)
+	}
+	if rule, err := readShieldTestRule(path, "a9059cbb"); err != nil || rule.MinGasFloor != 8 {
+		t.Errorf("rule not written back to %s: %v", ruleFileEnv, err)
+	}
+}
+
+func TestReloadRule(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shield.json")
+	defer os.Setenv(ruleFileEnv, os.Getenv(ruleFileEnv))
+	os.Setenv(ruleFileEnv, path)
+	if err := ioutil.WriteFile(path, []byte(`{"Functionname": "a9059cbb", "FunctionShield": [{"StartSlot": "0x1"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	interpreter, scope := newShieldTestEnv()
+	contract := scope.Contract
+	contract.Input = common.FromHex("a9059cbb")
+	contract.FunctionShield = []Variable{{IfMapping: true}, {StartSlot: *uint256.NewInt(2)}}
+	contract.FunctionAllow = []Variable{{StartSlot: *uint256.NewInt(3)}}
+	for i := range contract.FunctionShield {
+		contract.FunctionShield[i].InitSlot()
+	}
+	mapping := &contract.FunctionShield[0]
+	mapping.IdentifyMap(*uint256.NewInt(0), *uint256.NewInt(0xaa), interpreter, scope)
+
+	contract.ClearShield()
+	contract.ClearAllow()
+	if len(contract.FunctionShield) != 0 || len(contract.FunctionAllow) != 0 {
+		t.Fatalf("rule not cleared: %d shielded, %d allowed", len(contract.FunctionShield), len(contract.FunctionAllow))
+	}
+	if mapping.Slot.Contains(*uint256.NewInt(0xaa)) {
+		t.Error("discovered mapping slot survived ClearShield")
+	}
+	if _, err := contract.ReloadRule(); err != nil {
+		t.Fatal(err)
+	}
+	if len(contract.FunctionShield) != 1 || !contract.FunctionShield[0].Slot.Contains(*uint256.NewInt(1)) {
+		t.Errorf("rule not reloaded: %d shielded", len(contract.FunctionShield))
+	}
+}
+
+func TestVariableClone(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	var v Variable
+	data := []byte(`{"Name":"balances","StartSlot":"0x2","SlotRanges":[{"Start":"0x10","End":"0x20"}],"IfMapping":true,"MappingStart":"0x2","Deep":1,
+		"ValidEnumValues":[1,2],"RequiredCallPath":["0x0000000000000000000000000000000000000001"],"StateMachine":{"States":["a"],"Transitions":{"a":["b"]}},
+		"StructFields":[{"Name":"field"}],"BigValueThreshold":"0x5","ActiveHoursUTC":[1,2],"MaxDeltaPercent":10}`)
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatal(err)
+	}
+	v.InitSlot()
+	v.IdentifyMap(*uint256.NewInt(2), *uint256.NewInt(0xaa), interpreter, scope)
+
+	clone := v.Clone()
+	want, _ := json.Marshal(&v)
+	if have, _ := json.Marshal(&clone); !bytes.Equal(have, want) {
+		t.Fatalf("clone differs:\nhave %s\nwant %s", have, want)
+	}
+	clone.IdentifyMap(*uint256.NewInt(2), *uint256.NewInt(0xbb), interpreter, scope)
+	clone.MapValue[0].Slot.Add(*uint256.NewInt(0xcc))
+	clone.StateMachine.Transitions["a"][0] = "c"
+	clone.StructFields[0].Name = "other"
+	if v.Slot.Contains(*uint256.NewInt(0xbb)) || len(v.MapValue) != 1 || v.MapValue[0].Slot.Contains(*uint256.NewInt(0xcc)) {
+		t.Error("slots discovered on the clone leaked into the original")
+	}
+	if v.StateMachine.Transitions["a"][0] != "b" || v.StructFields[0].Name != "field" {
+		t.Error("configuration of the clone shared with the original")
+	}
+}
+
+func TestVariableMerge(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	mapping := func() *Variable {
+		v := &Variable{StartSlot: *uint256.NewInt(2), IfMapping: true, MappingStart: *uint256.NewInt(2), Deep: 1}
+		v.InitSlot()
+		return v
+	}
+	v, other := mapping(), mapping()
+	v.IdentifyMap(*uint256.NewInt(2), *uint256.NewInt(0xaa), interpreter, scope)
+	other.IdentifyMap(*uint256.NewInt(2), *uint256.NewInt(0xaa), interpreter, scope)
+	other.IdentifyMap(*uint256.NewInt(2), *uint256.NewInt(0xbb), interpreter, scope)
+	other.Slot.Add(*uint256.NewInt(7))
+
+	if err := v.Merge(other); err != nil {
+		t.Fatal(err)
+	}
+	if !v.Slot.Contains(*uint256.NewInt(7)) || !v.Slot.Contains(other.MapValue[1].MappingStart) {
+		t.Error("slots of the merged variable missing")
+	}
+	if len(v.MapValue) != 2 {
+		t.Errorf("have %d mapping entries, want 2", len(v.MapValue))
+	}
+	if err := v.Merge(&Variable{StartSlot: *uint256.NewInt(2)}); err == nil {
+		t.Error("merged a mapping into a plain variable")
+	}
+
+	rules, err := parseRules([]byte(`[{"Functionname":"a9059cbb","FunctionShield":[
+		{"StartSlot":"0x1"},{"StartSlot":"0x2","IfProtectDelete":true},{"Name":"again","StartSlot":"0x1"},{"StartSlot":"0x2"}]}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have := len(rules[0].FunctionShield); have != 3 {
+		t.Errorf("have %d variables, want 3", have)
+	}
+	if _, err := parseRules([]byte(`[{"FunctionShield":[{"StartSlot":"0x1"},{"StartSlot":"0x1","IfPackage":true,"PackageSize":1}]}]`)); err == nil {
+		t.Error("conflicting layouts accepted")
+	}
+}
+
+func TestMaxMemoryExpansion(t *testing.T) {
+	interpreter, _ := newShieldTestEnv()
+	for offset, want := range map[byte]error{0x00: nil, 0xe0: nil, 0xe1: ErrMemoryExpansionLimit} {
+		contract := NewContract(AccountRef(common.Address{}), AccountRef(shieldTestAddress), new(big.Int), 100000)
+		// mstore(offset, 1)
+		contract.Code = []byte{byte(PUSH1), 1, byte(PUSH1), offset, byte(MSTORE), byte(STOP)}
+		contract.MaxMemoryExpansion = 256
+		if _, err := interpreter.Run(contract, nil, false); err != want {
+			t.Errorf("mstore at %#x: have %v, want %v", offset, err, want)
+		}
+	}
+}
+
+func TestAnalyzeRevertData(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	var reasons []string
+	interpreter.cfg.ShieldEventHook = func(v ShieldViolation) { reasons = append(reasons, v.Reason) }
+	scope.Contract.matchedSelector = "a9059cbb"
+	scope.Contract.AnalyzeRevertData = true
+
+	stringType, _ := abi.NewType("string", "", nil)
+	reason, _ := abi.Arguments{{Type: stringType}}.Pack("ERC20: transfer amount exceeds balance")
+	revert := func(data []byte) {
+		scope.Memory.Resize(uint64(len(data)))
+		scope.Memory.Set(0, uint64(len(data)), data)
+		scope.Stack.push(uint256.NewInt(uint64(len(data))))
+		scope.Stack.push(new(uint256.Int))
+		if _, err := opRevert(new(uint64), interpreter, scope); err != ErrExecutionReverted {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	revert(append(common.FromHex("08c379a0"), reason...))
+	revert(append(common.CopyBytes(panicSelector), common.LeftPadBytes([]byte{0x11}, 32)...))
+
+	want := []string{
+		`reverted with Error("ERC20: transfer amount exceeds balance"), a known attack signature, without shield intervention`,
+		"reverted with Panic(0x11), without shield intervention",
+	}
+	if len(reasons) != len(want) {
+		t.Fatalf("have %d reports, want %d", len(reasons), len(want))
+	}
+	for i := range want {
+		if reasons[i] != want[i] {
+			t.Errorf("report %d: have %q, want %q", i, reasons[i], want[i])
+		}
+	}
+}
+
+func TestRevertOnBlock(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	interpreter.cfg.ShieldEventHook = func(ShieldViolation) {}
+	scope.Contract.RevertOnBlock = true
+	scope.Contract.FunctionShield = []Variable{{StartSlot: *uint256.NewInt(1)}}
+	scope.Contract.FunctionShield[0].InitSlot()
+
+	scope.Stack.push(uint256.NewInt(7))
+	scope.Stack.push(uint256.NewInt(1))
+	ret, err := opSstore(new(uint64), interpreter, scope)
+	if err != ErrExecutionReverted {
+		t.Fatalf("have error %v, want %v", err, ErrExecutionReverted)
+	}
+	if value := interpreter.evm.StateDB.GetState(shieldTestAddress, common.BigToHash(big.NewInt(1))); value != (common.Hash{}) {
+		t.Errorf("blocked write stored %x", value)
+	}
+	if !bytes.Equal(ret, interpreter.returnData) {
+		t.Errorf("return data %x does not match revert data %x", interpreter.returnData, ret)
+	}
+	if !bytes.Equal(ret[:4], shieldViolationSelector) {
+		t.Fatalf("have selector %x, want %x", ret[:4], shieldViolationSelector)
+	}
+	args, err := shieldViolationArgs.Unpack(ret[4:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slot := args[0].([32]byte); slot != uint256.NewInt(1).Bytes32() {
+		t.Errorf("have slot %x, want 1", slot)
+	}
+	if value := args[1].([32]byte); value != uint256.NewInt(7).Bytes32() {
+		t.Errorf("have value %x, want 7", value)
+	}
+	if reason := args[2].(string); reason != "write to shielded slot" {
+		t.Errorf("have reason %q", reason)
+	}
+}
+
+func TestGetDynamicSlotLimit(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	for slot := uint64(100); slot < 103; slot++ {
+		setShieldTestSlot(interpreter, slot, 1)
+	}
+	first := uint256.NewInt(100).Bytes()
+
+	v := Variable{}
+	v.InitSlot()
+	if _, err := v.GetDynamicSlot(first, interpreter, scope); err != nil {
+		t.Fatal(err)
+	}
+	for slot := uint64(100); slot < 104; slot++ {
+		if have, want := v.Slot.Contains(*uint256.NewInt(slot)), slot < 103; have != want {
+			t.Errorf("slot %d: have %v, want %v", slot, have, want)
+		}
+	}
+	limited := Variable{MaxDynamicSlots: 2}
+	limited.InitSlot()
+	if _, err := limited.GetDynamicSlot(first, interpreter, scope); !errors.Is(err, ErrIncompleteDynamicSlots) {
+		t.Errorf("slot limit not enforced: %v", err)
+	}
+}
+
+// finiteStateDB returns non-zero values for the first n slots and counts the
+// slots read.
+type finiteStateDB struct {
+	StateDB
+	n     uint64
+	reads int
+}
+
+func (db *finiteStateDB) GetState(addr common.Address, slot common.Hash) common.Hash {
+	db.reads++
+	if new(big.Int).SetBytes(slot[:]).Uint64() < db.n {
+		return common.BigToHash(big.NewInt(1))
+	}
+	return common.Hash{}
+}
+
+func TestGetDynamicSlotTerminates(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	db := &finiteStateDB{StateDB: interpreter.evm.StateDB, n: 5}
+	interpreter.evm.StateDB = db
+
+	v := Variable{}
+	v.InitSlot()
+	if _, err := v.GetDynamicSlot(nil, interpreter, scope); err != nil {
+		t.Fatal(err)
+	}
+	if db.reads != 6 {
+		t.Errorf("have %d reads, want 6", db.reads)
+	}
+	for slot := uint64(0); slot < 6; slot++ {
+		if have, want := v.Slot.Contains(*uint256.NewInt(slot)), slot < 5; have != want {
+			t.Errorf("slot %d: have %v, want %v", slot, have, want)
+		}
+	}
+}
+
+func TestShieldAccessListCoverage(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	interpreter.cfg.ShieldEventHook = func(ShieldViolation) {}
+	scope.Contract.EnforceAccessListCoverage = true
+	interpreter.evm.TxContext.AccessList = types.AccessList{
+		{Address: shieldTestAddress, StorageKeys: []common.Hash{common.BigToHash(big.NewInt(1))}},
+		{Address: common.BytesToAddress([]byte("other")), StorageKeys: []common.Hash{common.BigToHash(big.NewInt(2))}},
+	}
+	for slot, stored := range map[uint64]bool{1: true, 2: false, 3: false} {
+		scope.Stack.push(uint256.NewInt(7))
+		scope.Stack.push(uint256.NewInt(slot))
+		if _, err := opSstore(new(uint64), interpreter, scope); err != nil {
+			t.Fatal(err)
+		}
+		value := interpreter.evm.StateDB.GetState(shieldTestAddress, common.BigToHash(new(big.Int).SetUint64(slot)))
+		if have := value == common.BigToHash(big.NewInt(7)); have != stored {
+			t.Errorf("slot %d: stored %v, want %v", slot, have, stored)
+		}
+	}
+}
+
+func TestShieldMinBlockGasLimit(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	var violations int
+	interpreter.cfg.ShieldEventHook = func(ShieldViolation) { violations++ }
+	scope.Contract.MinBlockGasLimit = 15000000
+	v := Variable{StartSlot: *uint256.NewInt(3), IfMonotonicIncrease: true}
+	v.InitSlot()
+
+	interpreter.evm.Context.GasLimit = 30000000
+	opGasLimit(new(uint64), interpreter, scope)
+	if write, _, err := v.Shield(*uint256.NewInt(3), *uint256.NewInt(1), interpreter, scope); err != nil || !write {
+		t.Error("write blocked under a normal gas limit")
+	}
+	interpreter.evm.Context.GasLimit = 1000000
+	opGasLimit(new(uint64), interpreter, scope)
+	if violations != 1 {
+		t.Errorf("have %d violations, want 1", violations)
+	}
+	if write, _, err := v.Shield(*uint256.NewInt(3), *uint256.NewInt(1), interpreter, scope); err != nil || write {
+		t.Error("write not blocked after reading a low gas limit")
+	}
+}
+
+func TestSlotSet(t *testing.T) {
+	set := NewSlotSet(*uint256.NewInt(1))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for slot := uint64(0); slot < 100; slot++ {
+				set.Add(*uint256.NewInt(slot))
+				set.Contains(*uint256.NewInt(slot))
+			}
+		}()
+	}
+	wg.Wait()
+	if set.Cardinality() != 100 {
+		t.Fatalf("have %d slots, want 100", set.Cardinality())
+	}
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := new(SlotSet)
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Cardinality() != 100 || !decoded.Contains(*uint256.NewInt(99)) {
+		t.Errorf("set not preserved by JSON: %s", data)
+	}
+}
+
+func TestShieldFixedArray(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+
+	v := Variable{StartSlot: *uint256.NewInt(3), IfFixedArray: true, FixedArrayLen: 5}
+	v.InitSlot()
+	for slot := uint64(2); slot <= 8; slot++ {
+		write, _, err := v.Shield(*uint256.NewInt(slot), *uint256.NewInt(1), interpreter, scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inArray := slot >= 3 && slot <= 7; write == inArray {
+			t.Errorf("slot %d: have write %v, want %v", slot, write, !inArray)
+		}
+	}
+}
+
+func TestShieldStats(t *testing.T) {
+	defer func(stats *ShieldStats) { GlobalStats = stats }(GlobalStats)
+	GlobalStats = new(ShieldStats)
+
+	interpreter, scope := newShieldTestEnv()
+	v := Variable{StartSlot: *uint256.NewInt(1)}
+	v.InitSlot()
+	for slot := uint64(1); slot <= 3; slot++ {
+		v.Shield(*uint256.NewInt(slot), *uint256.NewInt(1), interpreter, scope)
+	}
+	m := Variable{IfMapping: true}
+	m.InitSlot()
+	m.IdentifyMap(*uint256.NewInt(0), *uint256.NewInt(0xaa), interpreter, scope)
+
+	stats := Stats()
+	if stats.Checks != 3 || stats.Blocked != 1 || stats.MappingUpdates != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	ResetStats()
+	if stats := Stats(); stats != (ShieldStats{}) {
+		t.Errorf("stats not reset: %+v", stats)
+	}
+}
+
+func TestSlotRanges(t *testing.T) {
+	v := &Variable{
+		StartSlot: *uint256.NewInt(1000),
+		SlotRanges: []SlotRange{
+			{Start: *uint256.NewInt(300), End: *uint256.NewInt(399)},
+			{Start: *uint256.NewInt(100), End: *uint256.NewInt(199)},
+			{Start: *uint256.NewInt(150), End: *uint256.NewInt(200)},
+		},
+	}
+	v.InitSlot()
+	if len(v.SlotRanges) != 2 {
+		t.Fatalf("have %d ranges after merging, want 2", len(v.SlotRanges))
+	}
+	for _, tt := range []struct {
+		slot uint64
+		want bool
+	}{
+		{99, false}, {100, true}, {200, true}, {201, false},
+		{300, true}, {399, true}, {400, false}, {1000, true},
+	} {
+		if have := v.contains(*uint256.NewInt(tt.slot)); have != tt.want {
+			t.Errorf("slot %d: have %v, want %v", tt.slot, have, tt.want)
+		}
+	}
+	bad := &Variable{SlotRanges: []SlotRange{{Start: *uint256.NewInt(2), End: *uint256.NewInt(1)}}}
+	if err := bad.validate(); err == nil {
+		t.Error("inverted range accepted")
+	}
+}
+
+func TestAllowCheck(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	interpreter.cfg.ShieldEventHook = func(ShieldViolation) {}
+	if !scope.Contract.AllowCheck(*uint256.NewInt(5)) {
+		t.Error("write blocked without an allow list")
+	}
+	scope.Contract.FunctionAllow = []Variable{{StartSlot: *uint256.NewInt(1)}, {StartSlot: *uint256.NewInt(2)}}
+	for i := range scope.Contract.FunctionAllow {
+		scope.Contract.FunctionAllow[i].InitSlot()
+	}
+	for slot, stored := range map[uint64]bool{1: true, 2: true, 3: false} {
+		scope.Stack.push(uint256.NewInt(7))
+		scope.Stack.push(uint256.NewInt(slot))
+		if _, err := opSstore(new(uint64), interpreter, scope); err != nil {
+			t.Fatal(err)
+		}
+		value := interpreter.evm.StateDB.GetState(shieldTestAddress, common.BigToHash(new(big.Int).SetUint64(slot)))
+		if have := value == common.BigToHash(big.NewInt(7)); have != stored {
+			t.Errorf("slot %d: stored %v, want %v", slot, have, stored)
+		}
+	}
+}
+
+func TestDetectReadAfterWriteHazard(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	var hazards []uint64
+	interpreter.cfg.ShieldEventHook = func(v ShieldViolation) { hazards = append(hazards, v.Slot.Uint64()) }
+	scope.Contract.DetectReadAfterWriteHazard = true
+
+	sload := func(slot uint64) {
+		scope.Stack.push(uint256.NewInt(slot))
+		if _, err := opSload(new(uint64), interpreter, scope); err != nil {
+			t.Fatal(err)
+		}
+		scope.Stack.pop()
+	}
+	sload(1)
+	scope.Stack.push(uint256.NewInt(7))
+	scope.Stack.push(uint256.NewInt(1))
+	if _, err := opSstore(new(uint64), interpreter, scope); err != nil {
+		t.Fatal(err)
+	}
+	sload(2)
+	sload(1)
+	if len(hazards) != 1 || hazards[0] != 1 {
+		t.Fatalf("have hazards on slots %v, want [1]", hazards)
+	}
+	// A new transaction starts with a clean set
+	interpreter.enterShieldFrame()
+	interpreter.exitShieldFrame()
+	sload(1)
+	if len(hazards) != 1 {
+		t.Errorf("hazard carried over to the next transaction")
+	}
+
+	// Contracts without the check do not record their writes
+	scope.Contract.DetectReadAfterWriteHazard = false
+	scope.Stack.push(uint256.NewInt(7))
+	scope.Stack.push(uint256.NewInt(3))
+	if _, err := opSstore(new(uint64), interpreter, scope); err != nil {
+		t.Fatal(err)
+	}
+	if interpreter.txWrittenSlots != nil && interpreter.txWrittenSlots.Cardinality() != 0 {
+		t.Errorf("write recorded without the hazard check: %v", interpreter.txWrittenSlots)
+	}
+	// unless the contract's rule in the registry enables it
+	interpreter.cfg.ShieldRegistry = NewRuleRegistry()
+	interpreter.cfg.ShieldRegistry.Register(shieldTestAddress, &FunctionRule{DetectReadAfterWriteHazard: true})
+	scope.Stack.push(uint256.NewInt(7))
+	scope.Stack.push(uint256.NewInt(3))
+	if _, err := opSstore(new(uint64), interpreter, scope); err != nil {
+		t.Fatal(err)
+	}
+	if interpreter.txWrittenSlots == nil || interpreter.txWrittenSlots.Cardinality() != 1 {
+		t.Errorf("write not recorded for the registered rule")
+	}
+}
+
+func TestShieldedContractSSTOREAllowed(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	interpreter.cfg.ShieldEventHook = func(ShieldViolation) {}
+	scope.Contract.FunctionShield = []Variable{{StartSlot: *uint256.NewInt(1)}}
+	scope.Contract.FunctionShield[0].InitSlot()
+
+	sc := NewShieldedContract(scope.Contract, NewRuleRegistry())
+	for slot, want := range map[uint64]bool{1: false, 2: true} {
+		if allowed, err := sc.SSTOREAllowed(*uint256.NewInt(slot), *uint256.NewInt(7), interpreter, scope); err != nil || allowed != want {
+			t.Errorf("slot %d: have allowed %v, want %v", slot, allowed, want)
+		}
+		// Deciding must not write
+		if value := interpreter.evm.StateDB.GetState(shieldTestAddress, common.BigToHash(new(big.Int).SetUint64(slot))); value != (common.Hash{}) {
+			t.Errorf("slot %d written by SSTOREAllowed", slot)
+		}
+	}
+}
+
+// fakeShieldSpan records what the shield sets on a span.
+type fakeShieldSpan struct {
+	name  string
+	attrs map[string]interface{}
+	ended bool
+}
+
+func (s *fakeShieldSpan) SetAttributes(attrs map[string]interface{}) { s.attrs = attrs }
+func (s *fakeShieldSpan) End()                                       { s.ended = true }
+
+// fakeShieldSpanStarter records the spans started by the shield.
+type fakeShieldSpanStarter struct {
+	spans []*fakeShieldSpan
+}
+
+func (f *fakeShieldSpanStarter) Start(ctx context.Context, spanName string) (context.Context, ShieldSpan) {
+	span := &fakeShieldSpan{name: spanName}
+	f.spans = append(f.spans, span)
+	return ctx, span
+}
+
+func TestShieldOtelTracer(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	interpreter.cfg.ShieldEventHook = func(ShieldViolation) {}
+	starter := new(fakeShieldSpanStarter)
+	interpreter.cfg.ShieldTracer = &ShieldOtelTracer{Tracer: starter}
+	scope.Contract.matchedSelector = "a9059cbb"
+	scope.Contract.FunctionShield = []Variable{{Name: "owner", StartSlot: *uint256.NewInt(1)}}
+	scope.Contract.FunctionShield[0].InitSlot()
+
+	sc := NewShieldedContract(scope.Contract, nil)
+	for i, slot := range []uint64{2, 1} {
+		if _, err := sc.SSTOREAllowed(*uint256.NewInt(slot), *uint256.NewInt(7), interpreter, scope); err != nil {
+			t.Fatal(err)
+		}
+		if len(starter.spans) != i+1 {
+			t.Fatalf("slot %d: have %d spans, want %d", slot, len(starter.spans), i+1)
+		}
+		span := starter.spans[i]
+		if span.name != "evmshield.check" || !span.ended {
+			t.Errorf("slot %d: span %q ended %v", slot, span.name, span.ended)
+		}
+		want := map[string]interface{}{
+			"shield.slot":          uint256.NewInt(slot).Hex(),
+			"shield.blocked":       slot == 1,
+			"shield.variable_name": "owner",
+			"shield.function":      "a9059cbb",
+		}
+		if !reflect.DeepEqual(span.attrs, want) {
+			t.Errorf("slot %d: have attributes %v, want %v", slot, span.attrs, want)
+		}
+	}
+}
+
+func TestShieldGas(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	interpreter.cfg.ShieldEventHook = func(ShieldViolation) {}
+	v := Variable{IfMapping: true, MappingStart: *uint256.NewInt(0)}
+	v.InitSlot()
+	for key := uint64(1); key <= 9; key++ {
+		v.IdentifyMap(*uint256.NewInt(0), *uint256.NewInt(0x100 + key), interpreter, scope)
+	}
+	if _, gas, _ := v.Shield(*uint256.NewInt(1), *uint256.NewInt(1), interpreter, scope); gas != 10*shieldSlotGas {
+		t.Errorf("gas of 10 slots: have %d, want %d", gas, 10*shieldSlotGas)
+	}
+
+	scope.Contract.FunctionShield = []Variable{{IfMapping: true, MappingStart: *uint256.NewInt(0), IfProtectDelete: true}}
+	scope.Contract.FunctionShield[0].InitSlot()
+	sc := NewShieldedContract(scope.Contract, nil)
+	scope.Contract.Gas = shieldSlotGas
+	if allowed, err := sc.SSTOREAllowed(*uint256.NewInt(0), *uint256.NewInt(7), interpreter, scope); err != nil || !allowed || scope.Contract.Gas != 0 {
+		t.Errorf("check not charged: allowed %v, gas left %d", allowed, scope.Contract.Gas)
+	}
+	if allowed, err := sc.SSTOREAllowed(*uint256.NewInt(0), *uint256.NewInt(7), interpreter, scope); err != nil || allowed {
+		t.Error("write allowed without gas for the check")
+	}
+	// Audit mode only observes and leaves the gas alone
+	interpreter.cfg.ShieldMode = ShieldModeAudit
+	scope.Contract.Gas = shieldSlotGas
+	if sc.SSTOREAllowed(*uint256.NewInt(0), *uint256.NewInt(7), interpreter, scope); scope.Contract.Gas != shieldSlotGas {
+		t.Errorf("audit mode charged the check: gas left %d", scope.Contract.Gas)
+	}
+}
+
+func TestExpectZeroValue(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	var blocked int
+	interpreter.cfg.ShieldEventHook = func(v ShieldViolation) {
+		if v.Blocked {
+			blocked++
+		}
+	}
+	scope.Contract.ExpectZeroValue = true
+
+	for i, value := range []int64{0, 1} {
+		scope.Contract.value = big.NewInt(value)
+		scope.Stack.push(uint256.NewInt(7))
+		scope.Stack.push(uint256.NewInt(uint64(i)))
+		if _, err := opSstore(new(uint64), interpreter, scope); err != nil {
+			t.Fatal(err)
+		}
+		stored := interpreter.evm.StateDB.GetState(shieldTestAddress, common.BigToHash(big.NewInt(int64(i)))) == common.BigToHash(big.NewInt(7))
+		if stored != (value == 0) {
+			t.Errorf("call value %d: stored %v", value, stored)
+		}
+	}
+	if blocked != 1 {
+		t.Errorf("have %d blocked writes reported, want 1", blocked)
+	}
+}
+
+func TestRequireOriginEqualsCaller(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	interpreter.cfg.ShieldEventHook = func(ShieldViolation) {}
+	scope.Contract.RequireOriginEqualsCaller = true
+
+	user, relayer := common.HexToAddress("0x05e4"), common.HexToAddress("0x4e1a")
+	interpreter.evm.TxContext.Origin = user
+	for i, caller := range []common.Address{user, relayer} {
+		scope.Contract.CallerAddress = caller
+		scope.Stack.push(uint256.NewInt(7))
+		scope.Stack.push(uint256.NewInt(uint64(i)))
+		if _, err := opSstore(new(uint64), interpreter, scope); err != nil {
+			t.Fatal(err)
+		}
+		stored := interpreter.evm.StateDB.GetState(shieldTestAddress, common.BigToHash(big.NewInt(int64(i)))) == common.BigToHash(big.NewInt(7))
+		if stored != (caller == user) {
+			t.Errorf("caller %v: stored %v", caller, stored)
+		}
+	}
+}
+
+func TestShieldPostConditions(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	var reasons []string
+	interpreter.cfg.ShieldEventHook = func(v ShieldViolation) { reasons = append(reasons, v.Reason) }
+
+	// totalSupply may grow, but must stay below the cap
+	supplyCap := func(newVal uint256.Int, db StateDB, addr common.Address) bool {
+		return newVal.LtUint64(1000)
+	}
+	scope.Contract.FunctionShield = []Variable{{
+		Name:                "totalSupply",
+		StartSlot:           *uint256.NewInt(2),
+		IfMonotonicIncrease: true,
+		PostConditionFuncs:  []func(uint256.Int, StateDB, common.Address) bool{supplyCap},
+	}}
+	scope.Contract.FunctionShield[0].InitSlot()
+
+	for _, value := range []uint64{500, 5000} {
+		scope.Stack.push(uint256.NewInt(value))
+		scope.Stack.push(uint256.NewInt(2))
+		if _, err := opSstore(new(uint64), interpreter, scope); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(reasons) != 1 || reasons[0] != `post-condition 0 of variable "totalSupply" failed` {
+		t.Errorf("unexpected reports: %q", reasons)
+	}
+	// The write is not undone
+	if value := interpreter.evm.StateDB.GetState(shieldTestAddress, common.BigToHash(big.NewInt(2))); value != common.BigToHash(big.NewInt(5000)) {
+		t.Errorf("post-condition failure reverted the write: %x", value)
+	}
+}
+
+func TestShieldAuditLog(t *testing.T) {
+	interpreter, scope := newShieldTestEnv()
+	interpreter.cfg.ShieldEventHook = func(ShieldViolation) {}
+	var buf bytes.Buffer
+	scope.Contract.AuditLog = &buf
+	scope.Contract.matchedSelector = "a9059cbb"
+	scope.Contract.FunctionShield = []Variable{{StartSlot: *uint256.NewInt(1)}, {StartSlot: *uint256.NewInt(2)}}
+	for i := range scope.Contract.FunctionShield {
+		scope.Contract.FunctionShield[i].InitSlot()
+	}
+	for _, slot := range []uint64{2, 3} {
+		scope.Stack.push(uint256.NewInt(7))
+		scope.Stack.push(uint256.NewInt(slot))
+		if _, err := opSstore(new(uint64), interpreter, scope); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := `{"block":1,"contract":"` + shieldTestAddress.Hex() + `","function":"0xa9059cbb","slot":"0x2","value":"0x7","rule":"1"}` + "\n"
+	if buf.String() != want {
+		t.Errorf("audit log mismatch:\nhave %s\nwant %s", buf.String(), want)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/holiman/uint256"
+)
+
+// shieldStateAddress is the account whose storage keeps the shield state that
+// spans transactions, i.e. pending timelocked writes and per block write
+// counts. Keeping it in the StateDB journals it like any other write: it is
+// reverted with the frame that made it and discarded with eth_call and other
+// simulations, so every node derives the same state from the same blocks.
+var shieldStateAddress = common.BytesToAddress([]byte("evmshield-state"))
+
+// Kinds of shield state kept for a slot.
+const (
+	shieldStateTimelock    = "timelock"
+	shieldStateBlockWrites = "blockWrites"
+)
+
+// shieldStateSlot returns the first of the two storage slots of shieldStateAddress
+// holding the state of the given kind for slot of addr.
+func shieldStateSlot(addr common.Address, slot uint256.Int, kind string) uint256.Int {
+	key := slot.Bytes32()
+	var first uint256.Int
+	first.SetBytes(crypto.Keccak256(addr.Bytes(), key[:], []byte(kind)))
+	return first
+}
+
+// readShieldState returns the two words of shield state starting at first.
+func readShieldState(db StateDB, first uint256.Int) (uint256.Int, uint256.Int) {
+	var a, b, next uint256.Int
+	word := db.GetState(shieldStateAddress, first.Bytes32())
+	a.SetBytes(word[:])
+	word = db.GetState(shieldStateAddress, next.AddUint64(&first, 1).Bytes32())
+	b.SetBytes(word[:])
+	return a, b
+}
+
+// writeShieldState stores the two words of shield state starting at first.
+func writeShieldState(db StateDB, first, a, b uint256.Int) {
+	// An account with storage only is empty and would be deleted under EIP-158
+	if db.GetNonce(shieldStateAddress) == 0 {
+		db.SetNonce(shieldStateAddress, 1)
+	}
+	var next uint256.Int
+	db.SetState(shieldStateAddress, first.Bytes32(), a.Bytes32())
+	db.SetState(shieldStateAddress, next.AddUint64(&first, 1).Bytes32(), b.Bytes32())
+}
+
+// 【*】writeBudgetAllows implements MaxWritesPerBlock: a slot may be written at
+// most that many times within a block, across all transactions. The count is
+// kept as (block, count) in the storage of shieldStateAddress.
+func (v *Variable) writeBudgetAllows(loc uint256.Int, interpreter *EVMInterpreter, scope *ScopeContext) bool {
+	var (
+		db     = interpreter.evm.StateDB
+		first  = shieldStateSlot(scope.Contract.Address(), loc, shieldStateBlockWrites)
+		number = interpreter.evm.Context.BlockNumber.Uint64()
+	)
+	block, count := readShieldState(db, first)
+	if !block.IsUint64() || block.Uint64() != number {
+		count.Clear()
+	}
+	if !count.Lt(uint256.NewInt(v.MaxWritesPerBlock)) {
+		return false
+	}
+	if interpreter.cfg.ShieldMode == ShieldModeEnforce {
+		writeShieldState(db, first, *uint256.NewInt(number), *count.AddUint64(&count, 1))
+	}
+	return true
+}
+
+// 【*】timelockAllows implements EnforcementDelay: the first change of a slot is
+// allowed and recorded, after which the slot keeps its new value until
+// EnforcementDelay blocks have passed. The pending change is kept as
+// (value, block+1) in the storage of shieldStateAddress, a zero block meaning
+// none, so it is undone if the transaction reverts.
+func (v *Variable) timelockAllows(loc uint256.Int, val uint256.Int, interpreter *EVMInterpreter, scope *ScopeContext) bool {
+	var (
+		db     = interpreter.evm.StateDB
+		first  = shieldStateSlot(scope.Contract.Address(), loc, shieldStateTimelock)
+		number = interpreter.evm.Context.BlockNumber.Uint64()
+	)
+	value, block := readShieldState(db, first)
+	if !block.IsZero() && block.IsUint64() && block.Uint64()-1+v.EnforcementDelay > number {
+		return value.Eq(&val)
+	}
+	// Replays and simulations in audit mode must not start a timelock
+	if interpreter.cfg.ShieldMode == ShieldModeEnforce {
+		writeShieldState(db, first, val, *uint256.NewInt(number + 1))
+	}
+	return true
+}
@@ -0,0 +1,119 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/naoina/toml"
+)
+
+// 【*】NewRuleTOML loads the rule file at path written in TOML and binds it to
+// the contract. The TOML schema is the JSON one: the document is decoded into
+// a generic tree and handed to the JSON decoder, so every field, including
+// the hex encoded slots and values, is spelled exactly as in rule.json.
+func (c *Contract) NewRuleTOML(path string) (*Contract, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	var tree map[string]interface{}
+	if err := toml.Unmarshal(data, &tree); err != nil {
+		return c, err
+	}
+	blob, err := json.Marshal(tree)
+	if err != nil {
+		return c, err
+	}
+	return c.NewRuleFromBytes(blob)
+}
+
+// ConvertJSONToTOML rewrites the JSON rule file at jsonPath as TOML at tomlPath.
+// Null fields are dropped, as TOML has no null value.
+func ConvertJSONToTOML(jsonPath, tomlPath string) error {
+	data, err := os.ReadFile(jsonPath)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var tree interface{}
+	if err := decoder.Decode(&tree); err != nil {
+		return err
+	}
+	table, ok := tree.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("rule file is not a JSON object")
+	}
+	converted, err := tomlValue(table)
+	if err != nil {
+		return err
+	}
+	out, err := toml.Marshal(converted)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(context.Background(), tomlPath, out, 0644)
+}
+
+// tomlValue converts a decoded JSON value into its TOML encodable equivalent.
+func tomlValue(value interface{}) (interface{}, error) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		table := make(map[string]interface{}, len(value))
+		for key, field := range value {
+			if field == nil {
+				continue
+			}
+			converted, err := tomlValue(field)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			}
+			table[key] = converted
+		}
+		return table, nil
+
+	case []interface{}:
+		array := make([]interface{}, 0, len(value))
+		for i, item := range value {
+			if item == nil {
+				return nil, fmt.Errorf("[%d]: null array element", i)
+			}
+			converted, err := tomlValue(item)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %v", i, err)
+			}
+			array = append(array, converted)
+		}
+		return array, nil
+
+	case json.Number:
+		if n, err := value.Int64(); err == nil {
+			return n, nil
+		}
+		if n, err := value.Float64(); err == nil && bytes.ContainsAny([]byte(value), ".eE") {
+			return n, nil
+		}
+		return nil, fmt.Errorf("number %s does not fit a TOML integer", value)
+	}
+	return value, nil
+}
@@ -0,0 +1,135 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// errPackageOutsideSlot is returned by Shield for a packed variable whose bytes
+// do not fit the slot, which ValidateRule rejects for rules loaded from files.
+var errPackageOutsideSlot = errors.New("packed variable exceeds the 32 byte slot")
+
+// ABITypeSizes is the storage size in bytes of every Solidity value type.
+var ABITypeSizes = func() map[string]int {
+	sizes := map[string]int{
+		"bool":    1,
+		"address": 20,
+		"byte":    1,
+		"uint":    32,
+		"int":     32,
+	}
+	for bits := 8; bits <= 256; bits += 8 {
+		sizes["uint"+strconv.Itoa(bits)] = bits / 8
+		sizes["int"+strconv.Itoa(bits)] = bits / 8
+	}
+	for n := 1; n <= 32; n++ {
+		sizes["bytes"+strconv.Itoa(n)] = n
+	}
+	return sizes
+}()
+
+// abiTypeSize returns the storage size of a Solidity value type.
+func abiTypeSize(typ string) (int, bool) {
+	size, ok := ABITypeSizes[typ]
+	return size, ok
+}
+
+// 【*】ValidateRule checks the rule for inconsistencies that would otherwise make
+// the shield silently protect the wrong bytes.
+func (r *FunctionRule) ValidateRule() error {
+	// An empty name leaves matching to Selectors
+	if r.Functionname != "" {
+		fn, err := hex.DecodeString(r.Functionname)
+		if err != nil {
+			return fmt.Errorf("invalid Functionname %q: %v", r.Functionname, err)
+		}
+		if len(fn) != 4 {
+			return fmt.Errorf("Functionname %q is %d bytes, want a 4 byte selector", r.Functionname, len(fn))
+		}
+	}
+	for i := range r.FunctionShield {
+		if err := r.FunctionShield[i].validate(); err != nil {
+			return fmt.Errorf("FunctionShield[%d]: %v", i, err)
+		}
+	}
+	for i := range r.FunctionAllow {
+		if err := r.FunctionAllow[i].validate(); err != nil {
+			return fmt.Errorf("FunctionAllow[%d]: %v", i, err)
+		}
+	}
+	if len(r.AllowedEthRecipients) != 0 && r.SafeVault == (common.Address{}) {
+		return errors.New("AllowedEthRecipients requires a SafeVault")
+	}
+	return nil
+}
+
+// validate checks a single variable of a rule.
+func (v *Variable) validate() error {
+	if v.IfPackage && v.ExpectedABIType != "" {
+		size, ok := abiTypeSize(v.ExpectedABIType)
+		if !ok {
+			return fmt.Errorf("unknown ABI type %q", v.ExpectedABIType)
+		}
+		if v.PackageSize != size {
+			return fmt.Errorf("PackageSize %d does not match %s (%d bytes)", v.PackageSize, v.ExpectedABIType, size)
+		}
+	}
+	if v.IfPackage && !v.packageInSlot() {
+		return fmt.Errorf("package of %d bytes at %d outside the slot", v.PackageSize, v.PackageStart)
+	}
+	for i, r := range v.SlotRanges {
+		if r.Start.Gt(&r.End) {
+			return fmt.Errorf("SlotRanges[%d]: start %s after end %s", i, r.Start.Hex(), r.End.Hex())
+		}
+	}
+	if v.IfFixedArray && v.FixedArrayLen <= 0 {
+		return fmt.Errorf("fixed array of length %d", v.FixedArrayLen)
+	}
+	if v.IfStruct {
+		if len(v.StructFields) == 0 {
+			return errors.New("struct without fields")
+		}
+		for i := range v.StructFields {
+			if err := v.StructFields[i].validate(); err != nil {
+				return fmt.Errorf("StructFields[%d]: %v", i, err)
+			}
+		}
+	}
+	if v.ActiveHoursUTC[0] > 23 || v.ActiveHoursUTC[1] > 24 {
+		return fmt.Errorf("ActiveHoursUTC %v outside the day", v.ActiveHoursUTC)
+	}
+	if v.IfEnum && (v.PackageStart < 0 || v.PackageStart >= 32) {
+		return fmt.Errorf("enum PackageStart %d outside the slot", v.PackageStart)
+	}
+	switch v.HashLayout {
+	case "", HashLayoutSolidity, HashLayoutVyper:
+	default:
+		return fmt.Errorf("unknown hash layout %q", v.HashLayout)
+	}
+	return nil
+}
+
+// packageInSlot reports whether the packed bytes lie within the 32 byte slot.
+func (v *Variable) packageInSlot() bool {
+	return v.PackageStart >= 0 && v.PackageSize > 0 && v.PackageStart+v.PackageSize <= 32
+}
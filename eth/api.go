@@ -590,3 +590,31 @@ func (api *DebugAPI) GetAccessibleState(from, to rpc.BlockNumber) (uint64, error
 	}
 	return 0, errors.New("no state found")
 }
+
+// ShieldAPI provides the evmshield namespace, predicting shield outcomes.
+type ShieldAPI struct {
+	eth *Ethereum
+}
+
+// NewShieldAPI creates a new ShieldAPI instance.
+func NewShieldAPI(eth *Ethereum) *ShieldAPI {
+	return &ShieldAPI{eth: eth}
+}
+
+// SimulateTransaction executes the given signed, RLP encoded transaction on top
+// of the current head with the shield in audit mode and returns the decision of
+// every SSTORE, without submitting the transaction or changing any state.
+func (api *ShieldAPI) SimulateTransaction(ctx context.Context, input hexutil.Bytes) (*core.SimulationResult, error) {
+	tx := new(types.Transaction)
+	if err := tx.UnmarshalBinary(input); err != nil {
+		return nil, err
+	}
+	chain := api.eth.BlockChain()
+	block := chain.CurrentBlock()
+	statedb, err := chain.StateAt(block.Root())
+	if err != nil {
+		return nil, err
+	}
+	processor := core.NewStateProcessor(chain.Config(), chain, api.eth.Engine())
+	return processor.SimulateTransaction(tx, block, statedb, chain.GetVMConfig().ShieldRegistry)
+}
@@ -315,6 +315,9 @@ func (s *Ethereum) APIs() []rpc.API {
 		}, {
 			Namespace: "net",
 			Service:   s.netRPCService,
+		}, {
+			Namespace: "evmshield",
+			Service:   NewShieldAPI(s),
 		},
 	}...)
 }
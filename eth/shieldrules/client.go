@@ -0,0 +1,98 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package shieldrules
+
+import (
+	"context"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// Client pulls rules from a ShieldRuleServer.
+type Client struct {
+	c *rpc.Client
+}
+
+// Dial connects a client to the rule server at rawurl.
+func Dial(rawurl string) (*Client, error) {
+	c, err := rpc.Dial(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(c), nil
+}
+
+// NewClient creates a client that uses the given RPC client.
+func NewClient(c *rpc.Client) *Client {
+	return &Client{c: c}
+}
+
+// Close closes the underlying RPC connection.
+func (c *Client) Close() {
+	c.c.Close()
+}
+
+// GetRule returns the rules of addr.
+func (c *Client) GetRule(ctx context.Context, addr common.Address) (FunctionRuleSet, error) {
+	var rules FunctionRuleSet
+	err := c.c.CallContext(ctx, &rules, Namespace+"_getRule", addr)
+	return rules, err
+}
+
+// SetRule replaces the rules of addr on the server. The server only accepts it
+// from authenticated callers.
+func (c *Client) SetRule(ctx context.Context, addr common.Address, rules FunctionRuleSet) error {
+	return c.c.CallContext(ctx, nil, Namespace+"_setRule", addr, rules)
+}
+
+// WatchRules delivers the current rules of addr on ch, followed by every
+// update to them.
+func (c *Client) WatchRules(ctx context.Context, addr common.Address, ch chan<- FunctionRuleSet) (ethereum.Subscription, error) {
+	return c.c.Subscribe(ctx, Namespace, ch, "watchRules", addr)
+}
+
+// SyncRegistry keeps the rule of addr in registry in step with the server until
+// the subscription ends. The registry holds one rule per contract, so the first
+// rule of the served set is registered; an empty set unregisters addr.
+func (c *Client) SyncRegistry(ctx context.Context, addr common.Address, registry *vm.RuleRegistry) (ethereum.Subscription, error) {
+	updates := make(chan FunctionRuleSet, 16)
+	sub, err := c.WatchRules(ctx, addr, updates)
+	if err != nil {
+		return nil, err
+	}
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case rules := <-updates:
+				if len(rules) == 0 {
+					registry.Unregister(addr)
+				} else {
+					registry.Register(addr, &rules[0])
+				}
+			case err := <-sub.Err():
+				return err
+			case <-quit:
+				return nil
+			}
+		}
+	}), nil
+}
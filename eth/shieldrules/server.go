@@ -0,0 +1,209 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package shieldrules implements a central rule service for EVMShield nodes.
+//
+// A ShieldRuleServer keeps the rules of every shielded contract and exposes
+// them over JSON-RPC in the "shield" namespace. Nodes pull the rules with a
+// Client and watch for updates, so a rule change is deployed fleet-wide
+// without managing rule files on every node. Watching requires a transport
+// with notification support, i.e. WebSocket or IPC.
+//
+// Reading and watching rules is public, changing them is not: shield_setRule
+// is only registered as an authenticated API, so a node serves it behind its
+// JWT-protected endpoint and never on the public HTTP or WebSocket one.
+package shieldrules
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// Namespace is the JSON-RPC namespace the rule service is registered under.
+const Namespace = "shield"
+
+// FunctionRuleSet is the set of function rules protecting one contract.
+type FunctionRuleSet []vm.FunctionRule
+
+// ruleUpdate is sent on the server feed whenever the rules of a contract change.
+type ruleUpdate struct {
+	addr  common.Address
+	rules json.RawMessage
+}
+
+// ShieldRuleServer stores the rules of the shielded contracts and serves them
+// to the nodes of a fleet. It is safe for concurrent use.
+//
+// The rules are kept JSON encoded, so neither the caller of SetRule nor the
+// callers of GetRule share any memory with the stored copy.
+type ShieldRuleServer struct {
+	rules map[common.Address]json.RawMessage
+	lock  sync.RWMutex
+	feed  event.Feed // Sends ruleUpdate events
+}
+
+// NewShieldRuleServer creates a rule server without any rules.
+func NewShieldRuleServer() *ShieldRuleServer {
+	return &ShieldRuleServer{rules: make(map[common.Address]json.RawMessage)}
+}
+
+// GetRule returns a copy of the rules of addr, or an empty set if it is not
+// shielded.
+func (s *ShieldRuleServer) GetRule(addr common.Address) (FunctionRuleSet, error) {
+	var rules FunctionRuleSet
+	if enc := s.encodedRule(addr); enc != nil {
+		if err := json.Unmarshal(enc, &rules); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+// encodedRule returns the stored encoding of the rules of addr.
+func (s *ShieldRuleServer) encodedRule(addr common.Address) json.RawMessage {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.rules[addr]
+}
+
+// SetRule replaces the rules of addr and notifies its watchers. An empty set
+// removes the contract from the server.
+func (s *ShieldRuleServer) SetRule(addr common.Address, rules FunctionRuleSet) error {
+	for i := range rules {
+		if err := rules[i].ValidateRule(); err != nil {
+			return err
+		}
+	}
+	var enc json.RawMessage
+	if len(rules) > 0 {
+		var err error
+		if enc, err = json.Marshal(rules); err != nil {
+			return err
+		}
+	}
+	s.lock.Lock()
+	if enc == nil {
+		delete(s.rules, addr)
+	} else {
+		s.rules[addr] = enc
+	}
+	s.lock.Unlock()
+
+	s.feed.Send(ruleUpdate{addr: addr, rules: enc})
+	return nil
+}
+
+// RuleAPI is the public part of the rule service, letting anyone read and
+// watch the rules.
+type RuleAPI struct {
+	s *ShieldRuleServer
+}
+
+// GetRule returns the rules of addr, or an empty set if it is not shielded.
+func (api *RuleAPI) GetRule(addr common.Address) (FunctionRuleSet, error) {
+	return api.s.GetRule(addr)
+}
+
+// WatchRules creates a subscription that first delivers the current rules of
+// addr and then every update to them.
+func (api *RuleAPI) WatchRules(ctx context.Context, addr common.Address) (*rpc.Subscription, error) {
+	s := api.s
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return &rpc.Subscription{}, rpc.ErrNotificationsUnsupported
+	}
+	rpcSub := notifier.CreateSubscription()
+
+	// Subscribe before reading the current rules, so no update is missed
+	updates := make(chan ruleUpdate, 16)
+	updatesSub := s.feed.Subscribe(updates)
+	current := s.encodedRule(addr)
+
+	go func() {
+		defer updatesSub.Unsubscribe()
+
+		notifier.Notify(rpcSub.ID, ruleSetJSON(current))
+		for {
+			select {
+			case update := <-updates:
+				if update.addr == addr {
+					notifier.Notify(rpcSub.ID, ruleSetJSON(update.rules))
+				}
+			case <-rpcSub.Err():
+				return
+			case <-notifier.Closed():
+				return
+			}
+		}
+	}()
+	return rpcSub, nil
+}
+
+// ruleSetJSON returns the notification payload of an encoded rule set, an
+// empty set for a contract that is not shielded.
+func ruleSetJSON(enc json.RawMessage) json.RawMessage {
+	if enc == nil {
+		return json.RawMessage("[]")
+	}
+	return enc
+}
+
+// RuleAdminAPI is the part of the rule service changing the rules. It must only
+// be reachable by authenticated callers.
+type RuleAdminAPI struct {
+	s *ShieldRuleServer
+}
+
+// SetRule replaces the rules of addr and notifies its watchers.
+func (api *RuleAdminAPI) SetRule(addr common.Address, rules FunctionRuleSet) error {
+	return api.s.SetRule(addr, rules)
+}
+
+// APIs returns the RPC descriptors of the rule service. The admin API is marked
+// authenticated, so a node only serves it on its JWT-protected endpoint.
+func (s *ShieldRuleServer) APIs() []rpc.API {
+	return []rpc.API{
+		{Namespace: Namespace, Service: &RuleAPI{s}},
+		{Namespace: Namespace, Service: &RuleAdminAPI{s}, Authenticated: true},
+	}
+}
+
+// Handler returns an HTTP handler serving the public, read-only part of the
+// rule service, upgrading WebSocket requests so that WatchRules is available
+// to them. Rules are changed through SetRule or the authenticated admin API.
+func (s *ShieldRuleServer) Handler(allowedOrigins []string) (http.Handler, error) {
+	srv := rpc.NewServer()
+	if err := srv.RegisterName(Namespace, &RuleAPI{s}); err != nil {
+		return nil, err
+	}
+	ws := srv.WebsocketHandler(allowedOrigins)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			ws.ServeHTTP(w, r)
+			return
+		}
+		srv.ServeHTTP(w, r)
+	}), nil
+}
@@ -0,0 +1,159 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package shieldrules
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+func TestShieldRuleServer(t *testing.T) {
+	server := NewShieldRuleServer()
+	srv := rpc.NewServer()
+	for _, api := range server.APIs() {
+		if err := srv.RegisterName(api.Namespace, api.Service); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer srv.Stop()
+	client := NewClient(rpc.DialInProc(srv))
+	defer client.Close()
+
+	var (
+		ctx   = context.Background()
+		addr  = common.HexToAddress("0x5e1f")
+		rules = FunctionRuleSet{{Functionname: "a9059cbb", MinGasFloor: 21000}}
+	)
+	updates := make(chan FunctionRuleSet, 4)
+	sub, err := client.WatchRules(ctx, addr, updates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+
+	if err := client.SetRule(ctx, addr, rules); err != nil {
+		t.Fatal(err)
+	}
+	have, err := client.GetRule(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(have) != 1 || have[0].Functionname != "a9059cbb" || have[0].MinGasFloor != 21000 {
+		t.Errorf("unexpected rules: %+v", have)
+	}
+	// The watcher sees the initial empty set, then the update
+	for i, want := range []int{0, 1} {
+		select {
+		case update := <-updates:
+			if len(update) != want {
+				t.Errorf("update %d: have %d rules, want %d", i, len(update), want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("update %d not delivered", i)
+		}
+	}
+	if err := client.SetRule(ctx, addr, FunctionRuleSet{{FunctionShield: []vm.Variable{{HashLayout: "unknown"}}}}); err == nil {
+		t.Error("invalid rule accepted")
+	}
+
+	// Returned rules are copies of the stored ones
+	local, _ := server.GetRule(addr)
+	local[0].MinGasFloor = 1
+	if have, _ := server.GetRule(addr); have[0].MinGasFloor != 21000 {
+		t.Errorf("stored rule changed through GetRule: %+v", have)
+	}
+}
+
+func TestShieldRuleServerAuth(t *testing.T) {
+	server := NewShieldRuleServer()
+	for _, api := range server.APIs() {
+		if _, admin := api.Service.(*RuleAdminAPI); admin != api.Authenticated {
+			t.Errorf("%T: authenticated %v", api.Service, api.Authenticated)
+		}
+	}
+	handler, err := server.Handler(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpsrv := httptest.NewServer(handler)
+	defer httpsrv.Close()
+
+	client, err := Dial(httpsrv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	addr := common.HexToAddress("0x5e1f")
+	if err := client.SetRule(context.Background(), addr, FunctionRuleSet{{Functionname: "a9059cbb"}}); err == nil {
+		t.Error("rules changed over the public handler")
+	}
+	if err := server.SetRule(addr, FunctionRuleSet{{Functionname: "a9059cbb"}}); err != nil {
+		t.Fatal(err)
+	}
+	if have, err := client.GetRule(context.Background(), addr); err != nil || len(have) != 1 {
+		t.Errorf("public read: have %v, %v", have, err)
+	}
+}
+
+func TestSyncRegistry(t *testing.T) {
+	server := NewShieldRuleServer()
+	srv := rpc.NewServer()
+	for _, api := range server.APIs() {
+		if err := srv.RegisterName(api.Namespace, api.Service); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer srv.Stop()
+	client := NewClient(rpc.DialInProc(srv))
+	defer client.Close()
+
+	var (
+		addr     = common.HexToAddress("0x5e1f")
+		registry = vm.NewRuleRegistry()
+	)
+	sub, err := client.SyncRegistry(context.Background(), addr, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+
+	waitFor := func(what string, cond func(*vm.FunctionRule) bool) {
+		t.Helper()
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if cond(registry.Rule(addr)) {
+				return
+			}
+		}
+		t.Fatalf("registry not synced: %s", what)
+	}
+	if err := server.SetRule(addr, FunctionRuleSet{{Functionname: "a9059cbb", BlockExtcodecopy: true}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("rule registered", func(rule *vm.FunctionRule) bool { return rule != nil && rule.BlockExtcodecopy })
+
+	if err := server.SetRule(addr, nil); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("rule unregistered", func(rule *vm.FunctionRule) bool { return rule == nil })
+}
@@ -926,8 +926,13 @@ func (api *API) traceTx(ctx context.Context, message core.Message, txctx *Contex
 	}()
 	defer cancel()
 
-	// Run the transaction with tracing enabled.
-	vmenv := vm.NewEVM(vmctx, txContext, statedb, api.backend.ChainConfig(), vm.Config{Debug: true, Tracer: tracer, NoBaseFee: true})
+	// Run the transaction with tracing enabled. Tracers explaining shield decisions
+	// replay in audit mode, so the traced execution matches the original one.
+	vmConf := vm.Config{Debug: true, Tracer: tracer, NoBaseFee: true}
+	if _, ok := tracer.(vm.ShieldLogger); ok {
+		vmConf.ShieldMode = vm.ShieldModeAudit
+	}
+	vmenv := vm.NewEVM(vmctx, txContext, statedb, api.backend.ChainConfig(), vmConf)
 	// Call Prepare to clear out the statedb access list
 	statedb.Prepare(txctx.TxHash, txctx.TxIndex)
 	if _, err = core.ApplyMessage(vmenv, message, new(core.GasPool).AddGas(message.Gas())); err != nil {
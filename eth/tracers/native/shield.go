@@ -0,0 +1,124 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"encoding/json"
+	"math/big"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/eth/tracers"
+)
+
+func init() {
+	register("shieldTracer", newShieldTracer)
+}
+
+// ShieldStore is the explanation of the shield decision of a single SSTORE.
+type ShieldStore struct {
+	Contract     common.Address `json:"contract"`
+	Function     string         `json:"function"`
+	Slot         string         `json:"slot"`
+	Value        string         `json:"value"`
+	Allowed      bool           `json:"allowed"`
+	Variable     int            `json:"variable"` // FunctionShield index that would block, -1 if none
+	VariableName string         `json:"variableName,omitempty"`
+}
+
+// shieldTracer records the shield decision of every SSTORE of a transaction.
+// Being a vm.ShieldLogger, it is replayed with the shield in audit mode: blocked
+// writes are reported but still executed.
+//
+// Example:
+//
+//	> debug.traceTransaction("0x...", {tracer: "shieldTracer"})
+//	[{contract: "0x...", function: "a9059cbb", slot: "0x3", value: "0x5", allowed: false, variable: 0}]
+type shieldTracer struct {
+	env       *vm.EVM
+	stores    []ShieldStore
+	interrupt uint32 // Atomic flag to signal execution interruption
+	reason    error  // Textual reason for the interruption
+}
+
+// newShieldTracer returns a native go tracer which explains shield decisions.
+func newShieldTracer(ctx *tracers.Context, _ json.RawMessage) (tracers.Tracer, error) {
+	return &shieldTracer{stores: []ShieldStore{}}, nil
+}
+
+// CaptureShield implements vm.ShieldLogger, recording a single decision.
+func (t *shieldTracer) CaptureShield(d vm.ShieldDecision) {
+	t.stores = append(t.stores, ShieldStore{
+		Contract:     d.Contract,
+		Function:     d.Function,
+		Slot:         d.Slot.Hex(),
+		Value:        d.Value.Hex(),
+		Allowed:      d.Allowed,
+		Variable:     d.Variable,
+		VariableName: d.VariableName,
+	})
+}
+
+// CaptureStart implements the EVMLogger interface to initialize the tracing operation.
+func (t *shieldTracer) CaptureStart(env *vm.EVM, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) {
+	t.env = env
+}
+
+// CaptureEnd is called after the call finishes to finalize the tracing.
+func (t *shieldTracer) CaptureEnd(output []byte, gasUsed uint64, _ time.Duration, err error) {
+}
+
+// CaptureState implements the EVMLogger interface to trace a single step of VM execution.
+func (t *shieldTracer) CaptureState(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, rData []byte, depth int, err error) {
+	if atomic.LoadUint32(&t.interrupt) > 0 {
+		t.env.Cancel()
+	}
+}
+
+// CaptureFault implements the EVMLogger interface to trace an execution fault.
+func (t *shieldTracer) CaptureFault(pc uint64, op vm.OpCode, gas, cost uint64, _ *vm.ScopeContext, depth int, err error) {
+}
+
+// CaptureEnter is called when EVM enters a new scope (via call, create or selfdestruct).
+func (t *shieldTracer) CaptureEnter(typ vm.OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) {
+}
+
+// CaptureExit is called when EVM exits a scope, even if the scope didn't
+// execute any code.
+func (t *shieldTracer) CaptureExit(output []byte, gasUsed uint64, err error) {
+}
+
+func (*shieldTracer) CaptureTxStart(gasLimit uint64) {}
+
+func (*shieldTracer) CaptureTxEnd(restGas uint64) {}
+
+// GetResult returns the json-encoded list of shield decisions.
+func (t *shieldTracer) GetResult() (json.RawMessage, error) {
+	res, err := json.Marshal(t.stores)
+	if err != nil {
+		return nil, err
+	}
+	return res, t.reason
+}
+
+// Stop terminates execution of the tracer at the first opportune moment.
+func (t *shieldTracer) Stop(err error) {
+	t.reason = err
+	atomic.StoreUint32(&t.interrupt, 1)
+}
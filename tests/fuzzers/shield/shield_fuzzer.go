@@ -0,0 +1,64 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package shield
+
+import (
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/holiman/uint256"
+)
+
+// maxNodes bounds the size of the generated variable graphs.
+const maxNodes = 16
+
+// Fuzz is the basic entry point for the go-fuzz tool
+//
+// The input describes a graph of nested mapping variables with arbitrary Deep
+// values and MapValue edges, possibly cyclic or shared, followed by the
+// slot/hash pairs fed to IdentifyMap. It returns 1 for inputs that produced a
+// graph, 0 otherwise.
+func Fuzz(input []byte) int {
+	if len(input) < 2 {
+		return 0
+	}
+	n := int(input[0])%maxNodes + 1
+	input = input[1:]
+	if len(input) < 2*n {
+		return 0
+	}
+	nodes := make([]*vm.Variable, n)
+	for i := range nodes {
+		nodes[i] = &vm.Variable{
+			IfMapping:    true,
+			Deep:         int(input[i] % 8),
+			MappingStart: *uint256.NewInt(uint64(input[n+i] % 4)),
+		}
+		nodes[i].InitSlot()
+	}
+	input = input[2*n:]
+
+	// Edges: pairs of (from, to) node indices terminated by a zero byte
+	for len(input) >= 2 && input[0] != 0 {
+		from, to := nodes[int(input[0])%n], nodes[int(input[1])%n]
+		from.MapValue = append(from.MapValue, to)
+		input = input[2:]
+	}
+	for ; len(input) >= 2; input = input[2:] {
+		slot, hash := uint256.NewInt(uint64(input[0]%4)), uint256.NewInt(uint64(input[1]))
+		nodes[0].IdentifyMap(*slot, *hash, nil, nil)
+	}
+	return 1
+}